@@ -0,0 +1,145 @@
+package cartridge
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	gzipExtension = ".gz"
+	zipExtension  = ".zip"
+)
+
+// Extensions of the rom files, either raw or inside an archive
+var romExtensions = map[string]bool{
+	".gb":  true,
+	".gbc": true,
+}
+
+var (
+	gzipMagic = []byte{0x1F, 0x8B}
+	zipMagic  = []byte{'P', 'K', 0x03, 0x04}
+)
+
+// IsRomFile reports whether the filename looks like a rom file or a compressed rom file.
+func IsRomFile(filename string) bool {
+	extension := strings.ToLower(filepath.Ext(filename))
+	return romExtensions[extension] || extension == gzipExtension || extension == zipExtension
+}
+
+func isRomEntry(name string) bool {
+	return romExtensions[strings.ToLower(path.Ext(name))]
+}
+
+// Returns the last element of a name stored in an archive, or an empty string if it
+// has no usable name. The archives made on Windows may use backslashes as separators.
+func entryBaseName(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// Reads an archive entry, refusing to extract more than the biggest rom
+func readEntry(reader io.Reader, name string) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxRomSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRomSize {
+		return nil, errors.New(fmt.Sprintf("The archive entry %s is bigger than the biggest rom (%dKB).", name, maxRomSize/1024))
+	}
+	return data, nil
+}
+
+// Extracts the rom from the file content if it is a .gz or .zip archive.
+// Returns the rom data and the name of the rom inside the archive,
+// or the content as is (and an empty name) if it is not compressed.
+func (c *Cartridge) extractROM(filename string, content []byte) ([]byte, string, error) {
+	switch {
+	case bytes.HasPrefix(content, gzipMagic):
+		return c.extractGzip(filename, content)
+	case bytes.HasPrefix(content, zipMagic):
+		return c.extractZip(filename, content)
+	default:
+		return content, "", nil
+	}
+}
+
+func (c *Cartridge) extractGzip(filename string, content []byte) ([]byte, string, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+
+	// The original filename is optional in the gzip header.
+	// Only its last element is used, as it comes from the archive and may be a path.
+	name := entryBaseName(reader.Name)
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	}
+
+	data, err := readEntry(reader, name)
+	if err != nil {
+		return nil, "", err
+	}
+	c.log.Printf("Extracted %s from %s.", name, filename)
+	return data, name, nil
+}
+
+func (c *Cartridge) extractZip(filename string, content []byte) ([]byte, string, error) {
+	reader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Use the entry selected by its full name or its last element, or else the first rom in the archive.
+	// The entries without a usable name are never used.
+	var entry *zip.File
+	var name string
+	selected := strings.Replace(c.options.ArchiveEntry, "\\", "/", -1)
+	for _, file := range reader.File {
+		baseName := entryBaseName(file.Name)
+		if baseName == "" {
+			continue
+		}
+		if selected != "" {
+			if strings.Replace(file.Name, "\\", "/", -1) == selected || baseName == selected {
+				entry, name = file, baseName
+				break
+			}
+		} else if isRomEntry(baseName) {
+			entry, name = file, baseName
+			break
+		}
+	}
+	if entry == nil {
+		if c.options.ArchiveEntry != "" {
+			return nil, "", errors.New(fmt.Sprintf("The archive %s doesn't contain %s.", filename, c.options.ArchiveEntry))
+		}
+		return nil, "", errors.New(fmt.Sprintf("The archive %s doesn't contain any rom file.", filename))
+	}
+
+	entryReader, err := entry.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer entryReader.Close()
+
+	data, err := readEntry(entryReader, name)
+	if err != nil {
+		return nil, "", err
+	}
+	c.log.Printf("Extracted %s from %s.", name, filename)
+	return data, name, nil
+}
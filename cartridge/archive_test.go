@@ -0,0 +1,151 @@
+package cartridge
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"testing"
+)
+
+func gzipContent(t *testing.T, name string, data []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Name = name
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestExtractGzipEntryName(t *testing.T) {
+	tests := []struct {
+		name     string // name stored in the gzip header
+		expected string
+	}{
+		{"tetris.gb", "tetris.gb"},
+		{"roms/tetris.gb", "tetris.gb"},
+		{"../../tetris.gb", "tetris.gb"},
+		{"/home/user/.config/tetris.gb", "tetris.gb"},
+		{"roms\\tetris.gb", "tetris.gb"},
+		{"..\\..\\tetris.gb", "tetris.gb"},
+		{"C:\\roms\\tetris.gb", "tetris.gb"},
+		// Without a usable name, the archive name without the .gz extension is used
+		{"", "game.gb"},
+		{".", "game.gb"},
+		{"..", "game.gb"},
+		{"/", "game.gb"},
+		{"roms/..", "game.gb"},
+		{"\\", "game.gb"},
+		{"roms\\..", "game.gb"},
+	}
+	rom := []byte{0x00, 0xC3, 0x50, 0x01}
+	for _, test := range tests {
+		c := &Cartridge{log: *newTestLogger()}
+		data, name, err := c.extractROM("/roms/game.gb.gz", gzipContent(t, test.name, rom))
+		if err != nil {
+			t.Errorf("extractROM with name %q: %v", test.name, err)
+			continue
+		}
+		if name != test.expected {
+			t.Errorf("extractROM with name %q = %q, expected %q", test.name, name, test.expected)
+		}
+		if !bytes.Equal(data, rom) {
+			t.Errorf("extractROM with name %q returned % x, expected % x", test.name, data, rom)
+		}
+	}
+}
+
+func zipContent(t *testing.T, names []string, data []byte) []byte {
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for _, name := range names {
+		entry, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := entry.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestExtractZipEntryName(t *testing.T) {
+	tests := []struct {
+		entries  []string // names of the entries in the archive
+		selected string   // the ArchiveEntry option
+		expected string   // empty if no entry must be extracted
+	}{
+		{[]string{"readme.txt", "tetris.gb"}, "", "tetris.gb"},
+		{[]string{"roms/tetris.gb"}, "", "tetris.gb"},
+		{[]string{"../../tetris.gb"}, "", "tetris.gb"},
+		{[]string{"roms\\tetris.gb"}, "", "tetris.gb"},
+		{[]string{"..\\..\\tetris.gb"}, "", "tetris.gb"},
+		{[]string{"tetris.gb", "roms/zelda.gbc"}, "zelda.gbc", "zelda.gbc"},
+		{[]string{"tetris.gb", "roms/zelda.gbc"}, "roms/zelda.gbc", "zelda.gbc"},
+		{[]string{"tetris.gb", "roms\\zelda.gbc"}, "zelda.gbc", "zelda.gbc"},
+		{[]string{"tetris.gb", "roms\\zelda.gbc"}, "roms/zelda.gbc", "zelda.gbc"},
+		{[]string{"tetris.gb", "roms/zelda.gbc"}, "roms\\zelda.gbc", "zelda.gbc"},
+		// The entries without a usable name are never extracted
+		{[]string{".."}, "..", ""},
+		{[]string{"roms/.."}, "..", ""},
+		{[]string{"roms\\.."}, "roms\\..", ""},
+		{[]string{"tetris.gb"}, "zelda.gbc", ""},
+		{[]string{"readme.txt"}, "", ""},
+	}
+	rom := []byte{0x00, 0xC3, 0x50, 0x01}
+	for _, test := range tests {
+		c := &Cartridge{log: *newTestLogger(), options: Options{ArchiveEntry: test.selected}}
+		data, name, err := c.extractROM("/roms/game.zip", zipContent(t, test.entries, rom))
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("extractROM of %q selecting %q extracted %q, expected an error", test.entries, test.selected, name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("extractROM of %q selecting %q: %v", test.entries, test.selected, err)
+			continue
+		}
+		if name != test.expected {
+			t.Errorf("extractROM of %q selecting %q = %q, expected %q", test.entries, test.selected, name, test.expected)
+		}
+		if !bytes.Equal(data, rom) {
+			t.Errorf("extractROM of %q returned % x, expected % x", test.entries, data, rom)
+		}
+	}
+}
+
+func TestExtractSizeLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		valid bool
+	}{
+		{"biggest rom", maxRomSize, true},
+		{"over the limit", maxRomSize + 1, false},
+	}
+	for _, test := range tests {
+		rom := make([]byte, test.size)
+		archives := map[string][]byte{
+			"/roms/game.gb.gz": gzipContent(t, "game.gb", rom),
+			"/roms/game.zip":   zipContent(t, []string{"game.gb"}, rom),
+		}
+		for filename, content := range archives {
+			c := &Cartridge{log: *newTestLogger()}
+			data, _, err := c.extractROM(filename, content)
+			if test.valid && (err != nil || len(data) != test.size) {
+				t.Errorf("%s, %s: extracted %d bytes (error %v), expected %d", filename, test.name, len(data), err, test.size)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("%s, %s: expected an error", filename, test.name)
+			}
+		}
+	}
+}
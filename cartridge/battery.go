@@ -0,0 +1,191 @@
+package cartridge
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lbarrios/yesSGMB/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	saveFileExtension = ".sav"
+	autoSaveInterval  = time.Second     // how often the RAM is checked for changes
+	autoSaveDebounce  = 2 * time.Second // time without writes before the RAM gets flushed
+)
+
+var batteryTypes = map[byte]bool{
+	MBC_1_RAM_BATTERY:               true,
+	MBC_2_BATTERY:                   true,
+	MBC_ROM_RAM_BATTERY:             true,
+	MMM_01_RAM_BATTERY:              true,
+	MBC_3_TIMER_BATTERY:             true,
+	MBC_3_TIMER_RAM_BATTERY:         true,
+	MBC_3_RAM_BATTERY:               true,
+	MBC_5_RAM_BATTERY:               true,
+	MBC_5_RUMBLE_RAM_BATTERY:        true,
+	MBC_7_SENSOR_RUMBLE_RAM_BATTERY: true,
+	HuC1_RAM_BATTERY:                true,
+}
+
+// SaveFilenameFor returns the default save file for a rom file,
+// which is the rom path with its extension replaced by .sav
+func SaveFilenameFor(romFilename string) string {
+	return strings.TrimSuffix(romFilename, filepath.Ext(romFilename)) + saveFileExtension
+}
+
+// DefaultSaveFilename returns the save file next to the rom file.
+// For compressed roms, it is named after the rom inside the archive.
+func (c *Cartridge) DefaultSaveFilename() string {
+	return SaveFilenameFor(c.romPath())
+}
+
+// HasBattery reports whether the cartridge RAM (and clock, if any) is kept when the GameBoy is turned off.
+func (c *Cartridge) HasBattery() bool {
+	return batteryTypes[c.Type]
+}
+
+// Read reads a byte through the Memory Bank Controller.
+func (c *Cartridge) Read(address types.Address) byte {
+	if !isExternalRamAddress(address) {
+		return c.MBC.Read(address)
+	}
+	// Reading the RAM area may update the RTC registers, so it must be synchronized with the saves
+	c.ramMutex.Lock()
+	defer c.ramMutex.Unlock()
+	return c.MBC.Read(address)
+}
+
+// Write writes a byte through the Memory Bank Controller,
+// keeping track of the changes in the external RAM.
+func (c *Cartridge) Write(address types.Address, value byte) {
+	c.ramMutex.Lock()
+	defer c.ramMutex.Unlock()
+	c.MBC.Write(address, value)
+	if isExternalRamAddress(address) {
+		c.ramDirty = true
+		c.lastRamWrite = time.Now()
+	}
+}
+
+func isExternalRamAddress(address types.Address) bool {
+	return address.High >= 0xA0 && address.High < 0xC0
+}
+
+// LoadSaveFile loads the external RAM from a save file, and uses that file for the following saves.
+// A missing save file is not an error, as it is created on the first save.
+func (c *Cartridge) LoadSaveFile(filename string) error {
+	c.SaveFilename = filename
+	if !c.HasBattery() {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		c.log.Printf("Save file %s not found, it will be created.", filename)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	c.ramMutex.Lock()
+	defer c.ramMutex.Unlock()
+
+	ram := c.ramData()
+	if len(data) < len(ram) {
+		return errors.New(fmt.Sprintf("The save file %s is too small (%d bytes, expected %d).", filename, len(data), len(ram)))
+	}
+	copy(ram, data)
+
+	// Any extra data after the RAM is the RTC footer
+	if rtc, ok := c.MBC.(rtcController); ok && len(data) > len(ram) {
+		if err := rtc.loadRtcFooter(data[len(ram):]); err != nil {
+			return err
+		}
+	}
+
+	c.log.Printf("Save file %s loaded.", filename)
+	return nil
+}
+
+// Save writes the external RAM (and the RTC state, if any) to the save file.
+func (c *Cartridge) Save() error {
+	if !c.HasBattery() || c.SaveFilename == "" {
+		return nil
+	}
+
+	c.ramMutex.Lock()
+	data := append([]byte{}, c.ramData()...)
+	if rtc, ok := c.MBC.(rtcController); ok {
+		data = append(data, rtc.rtcFooter()...)
+	}
+	c.ramDirty = false
+	c.ramMutex.Unlock()
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	// Write to a temporary file first, so a crash while saving never corrupts the previous save
+	tmpFilename := c.SaveFilename + ".tmp"
+	if err := ioutil.WriteFile(tmpFilename, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFilename, c.SaveFilename); err != nil {
+		return err
+	}
+
+	c.log.Printf("Save file %s written.", c.SaveFilename)
+	return nil
+}
+
+// StartAutoSave periodically flushes the external RAM to the save file,
+// once the game has stopped writing to it for a while.
+func (c *Cartridge) StartAutoSave() {
+	if !c.HasBattery() || c.autoSaveStop != nil {
+		return
+	}
+	c.autoSaveStop = make(chan struct{})
+	c.autoSaveDone = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(autoSaveInterval)
+		defer ticker.Stop()
+		defer close(c.autoSaveDone)
+		for {
+			select {
+			case <-c.autoSaveStop:
+				return
+			case <-ticker.C:
+				c.ramMutex.Lock()
+				pending := c.ramDirty && time.Since(c.lastRamWrite) >= autoSaveDebounce
+				c.ramMutex.Unlock()
+				if !pending {
+					continue
+				}
+				if err := c.Save(); err != nil {
+					c.log.Printf("ERROR: Cannot write save file: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops the auto save and flushes the external RAM to the save file.
+func (c *Cartridge) Close() error {
+	if c.autoSaveStop != nil {
+		close(c.autoSaveStop)
+		<-c.autoSaveDone
+		c.autoSaveStop = nil
+	}
+	return c.Save()
+}
+
+func (c *Cartridge) ramData() []byte {
+	if ram, ok := c.MBC.(ramController); ok {
+		return ram.ramData()
+	}
+	return nil
+}
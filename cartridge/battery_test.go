@@ -0,0 +1,252 @@
+package cartridge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/lbarrios/yesSGMB/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSaveDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Returns a MBC1+RAM+BATTERY cartridge with 8KB of RAM, saving to the given file
+func newBatteryCartridge(saveFilename string) *Cartridge {
+	c := &Cartridge{log: *newTestLogger(), Type: MBC_1_RAM_BATTERY, SaveFilename: saveFilename}
+	c.MBC = newTestMBC1(newBankedROM(4), ramBankSize)
+	c.Write(types.Word(0x0000).AsAddress(), 0x0A)
+	return c
+}
+
+func TestSaveFileRoundTrip(t *testing.T) {
+	dir := newTestSaveDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "game.sav")
+
+	c := newBatteryCartridge(filename)
+	for i, value := range []byte("yesSGMB") {
+		c.Write(types.Word(0xA000+i).AsAddress(), value)
+	}
+	c.Write(types.Word(0xBFFF).AsAddress(), 0x42)
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, c.ramData()) {
+		t.Errorf("the save file doesn't contain the RAM")
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary file was left after saving")
+	}
+
+	loaded := newBatteryCartridge("")
+	if err := loaded.LoadSaveFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.ramData(), c.ramData()) {
+		t.Errorf("the loaded RAM differs from the saved one")
+	}
+	if loaded.SaveFilename != filename {
+		t.Errorf("the following saves go to %s, expected %s", loaded.SaveFilename, filename)
+	}
+}
+
+func TestLoadSaveFile(t *testing.T) {
+	dir := newTestSaveDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name  string
+		data  []byte // nil if there is no save file
+		valid bool
+	}{
+		{"missing save file", nil, true},
+		{"exact size", make([]byte, ramBankSize), true},
+		{"too small", make([]byte, ramBankSize-1), false},
+		{"empty", []byte{}, false},
+	}
+	for i, test := range tests {
+		filename := filepath.Join(dir, string(rune('a'+i))+".sav")
+		if test.data != nil {
+			if err := ioutil.WriteFile(filename, test.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := newBatteryCartridge("").LoadSaveFile(filename)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestSaveKeepsThePreviousSaveOnErrors(t *testing.T) {
+	dir := newTestSaveDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "game.sav")
+	previous := bytes.Repeat([]byte{0x55}, ramBankSize)
+	if err := ioutil.WriteFile(filename, previous, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The temporary file can't be written, so the save fails before touching the previous one
+	if err := os.Mkdir(filename+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := newBatteryCartridge(filename)
+	if err := c.Save(); err == nil {
+		t.Errorf("expected an error writing the temporary file")
+	}
+	if data, _ := ioutil.ReadFile(filename); !bytes.Equal(data, previous) {
+		t.Errorf("the previous save was modified by a failed save")
+	}
+
+	// Once it can be written, it replaces the previous save
+	os.Remove(filename + ".tmp")
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filename); !bytes.Equal(data, c.ramData()) {
+		t.Errorf("the previous save was not replaced")
+	}
+}
+
+func TestSaveWithoutBattery(t *testing.T) {
+	dir := newTestSaveDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "game.sav")
+
+	c := newBatteryCartridge(filename)
+	c.Type = MBC_1_RAM
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("a save file was written for a cartridge without battery")
+	}
+}
+
+// Returns a MBC3+TIMER+RAM+BATTERY cartridge, and its clock
+func newRtcCartridge(saveFilename string) (*Cartridge, *MBC3, *testClock) {
+	mbc, clock := newTestMBC3()
+	c := &Cartridge{log: *newTestLogger(), Type: MBC_3_TIMER_RAM_BATTERY, SaveFilename: saveFilename, MBC: mbc}
+	return c, mbc, clock
+}
+
+func TestSaveFileRTCFooter(t *testing.T) {
+	dir := newTestSaveDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "game.sav")
+
+	c, mbc, clock := newRtcCartridge(filename)
+	mbc.Write(types.Word(0xA010).AsAddress(), 0x42)
+	clock.advance(2*time.Hour + 3*time.Minute + 4*time.Second)
+	mbc.latchRtc()
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != ramBankSize+rtcFooterSize {
+		t.Fatalf("the save file has %d bytes, expected %d", len(data), ramBankSize+rtcFooterSize)
+	}
+	footer := data[ramBankSize:]
+	for i, expected := range []uint32{4, 3, 2, 0, 0} {
+		if got := binary.LittleEndian.Uint32(footer[i*4:]); got != expected {
+			t.Errorf("RTC register %d saved as %d, expected %d", i, got, expected)
+		}
+		if got := binary.LittleEndian.Uint32(footer[rtcFooterLatchStart+i*4:]); got != expected {
+			t.Errorf("latched RTC register %d saved as %d, expected %d", i, got, expected)
+		}
+	}
+	if got, expected := int64(binary.LittleEndian.Uint64(footer[rtcFooterTimeStart:])), clock.now().Unix(); got != expected {
+		t.Errorf("the save time is %d, expected %d", got, expected)
+	}
+
+	// The clock keeps running while the emulator is closed
+	loaded, loadedMBC, loadedClock := newRtcCartridge("")
+	loadedClock.current = clock.now().Add(time.Minute)
+	if err := loaded.LoadSaveFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadedMBC.Read(types.Word(0xA010).AsAddress()); got != 0x42 {
+		t.Errorf("the loaded RAM reads %.2X, expected 42", got)
+	}
+	if got, expected := loadedMBC.readRtcRegisters(), [5]byte{4, 3, 2, 0, 0}; got != expected {
+		t.Errorf("the latched registers are %v after loading, expected %v", got, expected)
+	}
+	loadedMBC.latchRtc()
+	if got, expected := loadedMBC.readRtcRegisters(), [5]byte{4, 4, 2, 0, 0}; got != expected {
+		t.Errorf("the registers are %v a minute after saving, expected %v", got, expected)
+	}
+}
+
+func TestLoadLegacyRTCFooter(t *testing.T) {
+	dir := newTestSaveDir(t)
+	defer os.RemoveAll(dir)
+	saved := time.Date(2019, 12, 31, 23, 0, 0, 0, time.UTC)
+
+	// The old footer stores the save time in 32 bits
+	tests := []struct {
+		name       string
+		footerSize int
+		valid      bool
+	}{
+		{"legacy footer", rtcFooterLegacySize, true},
+		{"current footer", rtcFooterSize, true},
+		{"truncated footer", rtcFooterLegacySize - 4, false},
+		{"footer too long", rtcFooterSize + 4, false},
+	}
+	for i, test := range tests {
+		footer := make([]byte, test.footerSize)
+		for j, value := range []uint32{10, 20, 5, 0xFF, 0x01} {
+			binary.LittleEndian.PutUint32(footer[j*4:], value)
+			binary.LittleEndian.PutUint32(footer[rtcFooterLatchStart+j*4:], value)
+		}
+		if test.footerSize == rtcFooterSize {
+			binary.LittleEndian.PutUint64(footer[rtcFooterTimeStart:], uint64(saved.Unix()))
+		} else if test.footerSize >= rtcFooterLegacySize {
+			binary.LittleEndian.PutUint32(footer[rtcFooterTimeStart:], uint32(saved.Unix()))
+		}
+		filename := filepath.Join(dir, string(rune('a'+i))+".sav")
+		if err := ioutil.WriteFile(filename, append(make([]byte, ramBankSize), footer...), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		c, mbc, clock := newRtcCartridge("")
+		clock.current = saved.Add(time.Hour + 30*time.Second)
+		err := c.LoadSaveFile(filename)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		mbc.latchRtc()
+		// Day 0x1FF, 5:20:10 plus 1:00:30 elapsed
+		if got, expected := mbc.readRtcRegisters(), [5]byte{40, 20, 6, 0xFF, 0x01}; got != expected {
+			t.Errorf("%s: the registers are %v, expected %v", test.name, got, expected)
+		}
+	}
+}
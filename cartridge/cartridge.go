@@ -8,12 +8,17 @@ import (
 	"errors"
 	"fmt"
 	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/types"
 	"io/ioutil"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Cartridge struct {
 	Filename            string
+	EntryName           string // name of the rom inside the archive, for compressed roms
 	data                []byte
 	nintendoLogo        []byte
 	Title               string
@@ -33,9 +38,28 @@ type Cartridge struct {
 	headerChecksum      byte
 	globalChecksum      []byte
 	MBC                 MemoryBankController
+	SaveFilename        string
+	ramMutex            sync.Mutex
+	ramDirty            bool
+	lastRamWrite        time.Time
+	autoSaveStop        chan struct{}
+	autoSaveDone        chan struct{}
+	options             Options
 	log                 logger.Logger
 }
 
+// Options defines how a cartridge is loaded.
+// The zero value loads the rom file as is, refusing any invalid header.
+type Options struct {
+	Validation ValidationPolicy
+	// ArchiveEntry selects the rom inside a .zip archive, by default the first .gb or .gbc file is used
+	ArchiveEntry string
+	// Patches are IPS, UPS or BPS files applied to the rom before parsing the header
+	Patches []string
+	// DisableAutoPatch skips the patches named after the rom file (<rom>.ips, <rom>.ups and <rom>.bps)
+	DisableAutoPatch bool
+}
+
 const (
 	nintendoLogoStart          = 0x0104
 	nintendoLogoEnd            = 0x0133 + 1
@@ -62,8 +86,24 @@ const (
 	globalChecksumEnd          = 0x014F + 1
 )
 
-func NewCartridge(filename string, l *logger.Logger) (*Cartridge, error) {
+func NewCartridge(filename string, options Options, l *logger.Logger) (*Cartridge, error) {
+	c, err := ReadHeader(filename, options, l)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.initMBC(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ReadHeader loads the rom file and parses its header, without creating the Memory Bank Controller,
+// so it also works for the cartridge types that are not emulated. The returned cartridge can't be run.
+func ReadHeader(filename string, options Options, l *logger.Logger) (*Cartridge, error) {
 	c := new(Cartridge)
+	c.options = options
 	c.log = *l
 	c.log.SetPrefix("\033[0;30mCART: ")
 
@@ -71,6 +111,12 @@ func NewCartridge(filename string, l *logger.Logger) (*Cartridge, error) {
 		return nil, err
 	}
 
+	for _, patch := range c.patchFilenames() {
+		if err := c.ApplyPatchFile(patch); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := c.ParseHeader(); err != nil {
 		return nil, err
 	}
@@ -90,10 +136,11 @@ func (c *Cartridge) ParseHeader() error {
 	// The GameBoy boot procedure verifies the content of this bitmap (after it has displayed it), and LOCKS ITSELF UP if these bytes are incorrect.
 	// A CGB verifies only the first 18h bytes of the bitmap, but others (for example a Pocket GameBoy) verify all 30h bytes.
 	c.nintendoLogo = c.data[nintendoLogoStart:nintendoLogoEnd]
-	if !bytes.Equal(c.nintendoLogo, originalNintendoLogo) {
+	if err := c.validate(bytes.Equal(c.nintendoLogo, originalNintendoLogo),
+		"The cartridge is not original! It's a pirate copy, Nintendo is losing money!"); err != nil {
 		c.log.Println(c.nintendoLogo)
 		c.log.Println(originalNintendoLogo)
-		return errors.New("The cartridge is not original! It's a pirate copy, Nintendo is losing money!")
+		return err
 	}
 
 	// Title - The empty chars are filled with 0's
@@ -107,8 +154,9 @@ func (c *Cartridge) ParseHeader() error {
 	// 		80h - Game supports CGB functions, but works on old gameboys also.
 	// 		C0h - Game works on CGB only (physically the same as 80h).
 	c.colorFlag = c.data[colorFlagPosition]
-	if c.colorFlag == cgbOnlyColorFlag {
-		return errors.New("The cartridge is not compatible with GameBoy Classic; requires GameBoy Color")
+	if err := c.validate(c.colorFlag != cgbOnlyColorFlag,
+		"The cartridge is not compatible with GameBoy Classic; requires GameBoy Color"); err != nil {
+		return err
 	}
 
 	// Licensee Code
@@ -119,8 +167,8 @@ func (c *Cartridge) ParseHeader() error {
 	} else {
 		c.licensee = c.data[newLicenseeCodeStart:newLicenseeCodeEnd]
 	}
-	c.licenseeDescription = licenseeMap[fmt.Sprintf("%x", c.licensee)]
-	c.log.Printf("The game vendor is: %s=%s", fmt.Sprintf("%x", c.licensee), c.licenseeDescription)
+	c.licenseeDescription = licenseeMap[c.licenseeCode()]
+	c.log.Printf("The game vendor is: %s=%s", c.licenseeCode(), c.licenseeDescription)
 
 	// SGB - Super GameBoy Flag
 	// 		00h = No SGB functions (Normal Gameboy or CGB only game)
@@ -134,15 +182,6 @@ func (c *Cartridge) ParseHeader() error {
 	} else {
 		c.TypeDescription = desc
 	}
-	switch c.Type {
-	case MBC_ROMONLY:
-		c.MBC = &MBCRomOnly{log: c.log}
-	case MBC_1:
-		c.MBC = &MBC1{log: c.log}
-	default:
-		return errors.New(fmt.Sprintf("Unknown cartridge type for MBC: %X", c.Type))
-	}
-	c.MBC.Init(c.data)
 	c.log.Printf("The cartridge type is: %s", c.TypeDescription)
 
 	// ROM Banks and Size
@@ -168,27 +207,93 @@ func (c *Cartridge) ParseHeader() error {
 	// The lower 8 bits of the result must be the same than the value in this entry.
 	// The GAME WON'T WORK if this checksum is incorrect.
 	c.headerChecksum = c.data[headerChecksumPosition]
+	headerChecksum := computeHeaderChecksum(c.data)
+	if err := c.validate(headerChecksum == c.headerChecksum, fmt.Sprintf("Invalid header checksum: %.2X, expected %.2X",
+		c.headerChecksum, headerChecksum)); err != nil {
+		return err
+	}
 
 	// Global Checksum
+	// Contains a 16 bit checksum (upper byte first) across the whole cartridge ROM.
+	// Produced by adding all bytes of the cartridge (except for the two checksum bytes).
+	// The GameBoy doesn't verify this checksum.
 	c.globalChecksum = c.data[globalChecksumStart:globalChecksumEnd]
+	globalChecksum := computeGlobalChecksum(c.data)
+	expectedGlobalChecksum := types.WordFromBytes(c.globalChecksum[0], c.globalChecksum[1])
+	if err := c.validate(globalChecksum == expectedGlobalChecksum, fmt.Sprintf("Invalid global checksum: %.4X, expected %.4X",
+		expectedGlobalChecksum, globalChecksum)); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// Creates the Memory Bank Controller of the cartridge type.
+// It needs the ROM and RAM sizes, so it must be initialized after parsing the header.
+func (c *Cartridge) initMBC() error {
+	switch c.Type {
+	case MBC_ROMONLY, MBC_ROM_RAM, MBC_ROM_RAM_BATTERY:
+		c.MBC = &MBCRomOnly{log: c.log, ramSize: c.ramSize}
+	case MBC_1, MBC_1_RAM, MBC_1_RAM_BATTERY:
+		c.MBC = &MBC1{log: c.log, ramSize: c.ramSize}
+	case MBC_2, MBC_2_BATTERY:
+		c.MBC = &MBC2{log: c.log}
+	case MBC_3_TIMER_BATTERY, MBC_3_TIMER_RAM_BATTERY:
+		c.MBC = &MBC3{log: c.log, ramSize: c.ramSize, hasTimer: true}
+	case MBC_3, MBC_3_RAM, MBC_3_RAM_BATTERY:
+		c.MBC = &MBC3{log: c.log, ramSize: c.ramSize}
+	case MBC_5, MBC_5_RAM, MBC_5_RAM_BATTERY:
+		c.MBC = &MBC5{log: c.log, ramSize: c.ramSize}
+	case MBC_5_RUMBLE, MBC_5_RUMBLE_RAM, MBC_5_RUMBLE_RAM_BATTERY:
+		c.MBC = &MBC5{log: c.log, ramSize: c.ramSize, hasRumble: true}
+	default:
+		return errors.New(fmt.Sprintf("Unknown cartridge type for MBC: %X", c.Type))
+	}
+	c.MBC.Init(c.data)
+	return nil
+}
+
 func (c *Cartridge) LoadROMFile(filename string) error {
 	c.log.Printf("Loading file %s...", filename)
 	c.Filename = filename
 
-	if fileContent, err := ioutil.ReadFile(filename); err != nil {
+	fileContent, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	// The roms can be compressed as .gz or as .zip
+	if c.data, c.EntryName, err = c.extractROM(filename, fileContent); err != nil {
 		return err
-	} else {
-		c.data = fileContent
 	}
 
 	c.log.Printf("File %s loaded.", filename)
 	return nil
 }
 
+// Returns the path of the rom file, for compressed roms it is the path of the rom inside the archive
+// as if it were extracted next to it.
+func (c *Cartridge) romPath() string {
+	if c.EntryName == "" {
+		return c.Filename
+	}
+	return filepath.Join(filepath.Dir(c.Filename), c.EntryName)
+}
+
+// HasRumble reports whether the cartridge has a rumble motor.
+func (c *Cartridge) HasRumble() bool {
+	rumble, ok := c.MBC.(rumbleController)
+	return ok && rumble.HasRumble()
+}
+
+// SetRumbleHandler registers a function that is called every time the rumble motor is turned on or off.
+// It is called from the goroutine that writes to the cartridge.
+func (c *Cartridge) SetRumbleHandler(handler func(on bool)) {
+	if rumble, ok := c.MBC.(rumbleController); ok {
+		rumble.SetRumbleHandler(handler)
+	}
+}
+
 func romSizeForBanks(romBanks int) int {
 	var romSize int
 	if romBanks == 0 {
@@ -0,0 +1,59 @@
+package cartridge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadHeaderOfTypesWithoutMBC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cartridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		cartridgeType byte
+		emulated      bool
+	}{
+		{MBC_ROMONLY, true},
+		{MBC_5_RAM_BATTERY, true},
+		{0x0B, false}, // MMM01
+		{0x20, false}, // MBC6
+		{0xFC, false}, // POCKET CAMERA
+		{0xFE, false}, // HuC3
+		{0xFF, false}, // HuC1+RAM+BATTERY
+	}
+	for _, test := range tests {
+		data := newTestROM()
+		data[typePosition] = test.cartridgeType
+		fixHeaderChecksum(data)
+		fixGlobalChecksum(data)
+		filename := filepath.Join(dir, "game.gb")
+		if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := ReadHeader(filename, Options{}, newTestLogger())
+		if err != nil {
+			t.Errorf("ReadHeader of type %.2X: %v", test.cartridgeType, err)
+			continue
+		}
+		if info := c.Info(); info.Type != test.cartridgeType || info.TypeDescription != typeMap[test.cartridgeType] {
+			t.Errorf("ReadHeader of type %.2X returned type %.2X (%s)", test.cartridgeType, info.Type, info.TypeDescription)
+		}
+		if c.MBC != nil {
+			t.Errorf("ReadHeader of type %.2X created the Memory Bank Controller", test.cartridgeType)
+		}
+
+		_, err = NewCartridge(filename, Options{}, newTestLogger())
+		if test.emulated && err != nil {
+			t.Errorf("NewCartridge of type %.2X: %v", test.cartridgeType, err)
+		}
+		if !test.emulated && err == nil {
+			t.Errorf("NewCartridge of type %.2X: expected an error", test.cartridgeType)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package cartridge
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/lbarrios/yesSGMB/types"
+	"strings"
+)
+
+// Info is a read-only snapshot of the metadata parsed from the cartridge header.
+type Info struct {
+	Filename            string `json:"filename"`
+	EntryName           string `json:"entryName,omitempty"`
+	Title               string `json:"title"`
+	ManufacturerCode    string `json:"manufacturerCode"`
+	Licensee            string `json:"licensee"`
+	LicenseeDescription string `json:"licenseeDescription"`
+	CGBFlag             byte   `json:"cgbFlag"`
+	CGBSupport          string `json:"cgbSupport"`
+	SGBFlag             byte   `json:"sgbFlag"`
+	SGBSupport          bool   `json:"sgbSupport"`
+	Type                byte   `json:"type"`
+	TypeDescription     string `json:"typeDescription"`
+	HasBattery          bool   `json:"hasBattery"`
+	ROMBanks            int    `json:"romBanks"`
+	ROMSize             int    `json:"romSize"`
+	RAMSize             int    `json:"ramSize"`
+	DestinationCode     byte   `json:"destinationCode"`
+	Japanese            bool   `json:"japanese"`
+	Version             int    `json:"version"`
+	NintendoLogoValid   bool   `json:"nintendoLogoValid"`
+	HeaderChecksum      byte   `json:"headerChecksum"`
+	HeaderChecksumValid bool   `json:"headerChecksumValid"`
+	GlobalChecksum      uint16 `json:"globalChecksum"`
+	GlobalChecksumValid bool   `json:"globalChecksumValid"`
+}
+
+const (
+	sgbSupportedFlag = 0x03
+)
+
+// Info returns the metadata of the cartridge.
+func (c *Cartridge) Info() Info {
+	globalChecksum := types.WordFromBytes(c.globalChecksum[0], c.globalChecksum[1])
+	return Info{
+		Filename:            c.Filename,
+		EntryName:           c.EntryName,
+		Title:               c.Title,
+		ManufacturerCode:    strings.Trim(c.manufacturerCode, "\x00"),
+		Licensee:            c.licenseeCode(),
+		LicenseeDescription: c.licenseeDescription,
+		CGBFlag:             c.colorFlag,
+		CGBSupport:          c.cgbSupport(),
+		SGBFlag:             c.sgbFlag,
+		SGBSupport:          c.sgbFlag == sgbSupportedFlag,
+		Type:                c.Type,
+		TypeDescription:     c.TypeDescription,
+		HasBattery:          c.HasBattery(),
+		ROMBanks:            c.romBanks,
+		ROMSize:             c.romSize,
+		RAMSize:             c.ramSize,
+		DestinationCode:     c.destinationCode,
+		Japanese:            c.isJapanese,
+		Version:             c.versionNumber,
+		NintendoLogoValid:   bytes.Equal(c.nintendoLogo, originalNintendoLogo),
+		HeaderChecksum:      c.headerChecksum,
+		HeaderChecksumValid: computeHeaderChecksum(c.data) == c.headerChecksum,
+		GlobalChecksum:      uint16(globalChecksum),
+		GlobalChecksumValid: computeGlobalChecksum(c.data) == globalChecksum,
+	}
+}
+
+// The new licensee codes are two ASCII characters,
+// while the old ones are a single byte shown in hexadecimal.
+func (c *Cartridge) licenseeCode() string {
+	if len(c.licensee) == 1 {
+		return fmt.Sprintf("%.2X", c.licensee[0])
+	}
+	return string(c.licensee)
+}
+
+func (c *Cartridge) cgbSupport() string {
+	switch c.colorFlag {
+	case cgbOnlyColorFlag:
+		return "only"
+	case cgbCompatibleColorFlag:
+		return "compatible"
+	default:
+		return "none"
+	}
+}
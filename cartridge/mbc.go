@@ -36,48 +36,72 @@ const (
 	HuC1_RAM_BATTERY                = 0xFF
 )
 
+const (
+	romBankSize = 0x4000            // 16KB per ROM bank
+	ramBankSize = 0x2000            // 8KB per RAM bank
+	maxRomSize  = 512 * romBankSize // 8MB, the biggest rom supported by the MBC5
+)
+
 type MemoryBankController interface {
 	Init([]byte)
 	Write(address types.Address, value byte)
 	Read(address types.Address) byte
 }
 
-type MBCRomOnly struct {
-	romBank []byte
-	log     logger.Logger
+// Controllers with external RAM implement this interface,
+// so the RAM contents can be persisted for the battery-backed cartridges.
+type ramController interface {
+	ramData() []byte
 }
 
-func (mbc *MBCRomOnly) Init(data []byte) {
-	mbc.romBank = data[0x0000:0x8000]
-}
-
-func (mbc *MBCRomOnly) Write(address types.Address, value byte) {
-	if address.High >= 0x80 {
-		mbc.log.Fatalf("Cannot write to address: %.4x!", address.AsWord())
-		return
-	}
+// Controllers with a real-time clock implement this interface,
+// so the clock state can be persisted along with the RAM.
+type rtcController interface {
+	rtcFooter() []byte
+	loadRtcFooter(footer []byte) error
 }
 
-func (mbc *MBCRomOnly) Read(address types.Address) byte {
-	return mbc.romBank[address.AsWord()]
+// Controllers with a rumble motor implement this interface,
+// so the motor state can be shown to the user.
+type rumbleController interface {
+	HasRumble() bool
+	SetRumbleHandler(handler func(on bool))
 }
 
-type MBC1 struct {
+type MBCRomOnly struct {
 	romBank []byte
+	ram     []byte
+	ramSize int
 	log     logger.Logger
 }
 
-func (mbc *MBC1) Init(data []byte) {
+func (mbc *MBCRomOnly) Init(data []byte) {
 	mbc.romBank = data[0x0000:0x8000]
+	mbc.ram = make([]byte, mbc.ramSize)
 }
 
-func (mbc *MBC1) Write(address types.Address, value byte) {
+func (mbc *MBCRomOnly) Write(address types.Address, value byte) {
+	if address.High >= 0xA0 && address.High < 0xC0 && len(mbc.ram) > 0 {
+		// ROM+RAM cartridges have up to 8KB of RAM without banking
+		mbc.ram[int(address.AsWord()-0xA000)%len(mbc.ram)] = value
+		return
+	}
 	if address.High >= 0x80 {
 		mbc.log.Fatalf("Cannot write to address: %.4x!", address.AsWord())
 		return
 	}
 }
 
-func (mbc *MBC1) Read(address types.Address) byte {
+func (mbc *MBCRomOnly) Read(address types.Address) byte {
+	if address.High >= 0xA0 && address.High < 0xC0 {
+		if len(mbc.ram) == 0 {
+			return 0xFF
+		}
+		return mbc.ram[int(address.AsWord()-0xA000)%len(mbc.ram)]
+	}
 	return mbc.romBank[address.AsWord()]
 }
+
+func (mbc *MBCRomOnly) ramData() []byte {
+	return mbc.ram
+}
@@ -0,0 +1,145 @@
+package cartridge
+
+import (
+	"bytes"
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/types"
+)
+
+// MBC1 registers, selected by the address range that is written.
+//
+//	0000-1FFF: RAM Enable (0x0A in the lower nibble enables it)
+//	2000-3FFF: ROM Bank Number (lower 5 bits, 0 is translated to 1)
+//	4000-5FFF: RAM Bank Number or Upper Bits of ROM Bank Number (2 bits)
+//	6000-7FFF: ROM/RAM Mode Select (0 = simple ROM banking, 1 = advanced banking)
+const (
+	mbc1RamEnableEnd    = 0x2000
+	mbc1RomBankEnd      = 0x4000
+	mbc1UpperBankEnd    = 0x6000
+	mbc1ModeSelectEnd   = 0x8000
+	mbc1RamStart        = 0xA000
+	mbc1RamEnd          = 0xC000
+	mbc1RamEnableValue  = 0x0A
+	mbc1RomBankMask     = 0x1F
+	mbc1UpperBankMask   = 0x03
+	mbc1MulticartSize   = 1024 * 1024
+	mbc1MulticartShift  = 4
+	mbc1DefaultBankBits = 5
+)
+
+type MBC1 struct {
+	rom        []byte
+	ram        []byte
+	romBanks   int
+	ramBanks   int
+	ramSize    int
+	ramEnabled bool
+	romBank    byte // BANK1 register, 5 bits
+	upperBank  byte // BANK2 register, 2 bits
+	mode       byte // 0: ROM banking mode, 1: RAM banking mode
+	bankShift  uint // 5 for regular MBC1, 4 for MBC1M multicarts
+	log        logger.Logger
+}
+
+func (mbc *MBC1) Init(data []byte) {
+	mbc.rom = data
+	mbc.romBanks = len(data) / romBankSize
+	if mbc.romBanks == 0 {
+		mbc.romBanks = 1
+	}
+	mbc.ram = make([]byte, mbc.ramSize)
+	mbc.ramBanks = mbc.ramSize / ramBankSize
+	mbc.romBank = 1
+	mbc.bankShift = mbc1DefaultBankBits
+	if isMBC1Multicart(data) {
+		// MBC1M: the BANK2 register is wired to ROM address lines 18-19 instead of 19-20,
+		// so only the lower 4 bits of BANK1 are used to select the ROM bank.
+		mbc.log.Println("MBC1 multicart (MBC1M) detected.")
+		mbc.bankShift = mbc1MulticartShift
+	}
+}
+
+// Multicart cartridges (MBC1M) are 1MB ROMs that contain several games, each one
+// of them with its own header. They can be detected by the presence of the Nintendo
+// logo at the beginning of the second game (bank 0x10).
+func isMBC1Multicart(data []byte) bool {
+	if len(data) != mbc1MulticartSize {
+		return false
+	}
+	offset := 0x10 * romBankSize
+	logo := data[offset+nintendoLogoStart : offset+nintendoLogoEnd]
+	return bytes.Equal(logo, originalNintendoLogo)
+}
+
+func (mbc *MBC1) Write(address types.Address, value byte) {
+	addr := address.AsWord()
+	switch {
+	case addr < mbc1RamEnableEnd:
+		mbc.ramEnabled = value&0x0F == mbc1RamEnableValue
+	case addr < mbc1RomBankEnd:
+		// Writing 0 selects bank 1, this also happens for 0x20, 0x40 and 0x60
+		// since the zero check is done only over the 5 bits of the register.
+		mbc.romBank = value & mbc1RomBankMask
+		if mbc.romBank == 0 {
+			mbc.romBank = 1
+		}
+	case addr < mbc1UpperBankEnd:
+		mbc.upperBank = value & mbc1UpperBankMask
+	case addr < mbc1ModeSelectEnd:
+		mbc.mode = value & 0x01
+	case addr >= mbc1RamStart && addr < mbc1RamEnd:
+		if !mbc.ramEnabled || len(mbc.ram) == 0 {
+			return
+		}
+		mbc.ram[mbc.ramOffset(addr)] = value
+	default:
+		mbc.log.Fatalf("Cannot write to address: %.4x!", addr)
+	}
+}
+
+func (mbc *MBC1) Read(address types.Address) byte {
+	addr := address.AsWord()
+	switch {
+	case addr < mbc1RomBankEnd:
+		// In mode 1, the BANK2 register also affects the 0000-3FFF area,
+		// allowing the access to banks 0x20, 0x40 and 0x60 (or 0x10, 0x20 and 0x30 for MBC1M).
+		bank := 0
+		if mbc.mode == 1 {
+			bank = int(mbc.upperBank) << mbc.bankShift
+		}
+		return mbc.readRom(bank, addr)
+	case addr < mbc1ModeSelectEnd:
+		bank := int(mbc.upperBank)<<mbc.bankShift | int(mbc.romBank)&(1<<mbc.bankShift-1)
+		return mbc.readRom(bank, addr-mbc1RomBankEnd)
+	case addr >= mbc1RamStart && addr < mbc1RamEnd:
+		if !mbc.ramEnabled || len(mbc.ram) == 0 {
+			return 0xFF
+		}
+		return mbc.ram[mbc.ramOffset(addr)]
+	default:
+		mbc.log.Fatalf("Cannot read from address: %.4x!", addr)
+		return 0xFF
+	}
+}
+
+// Reads the byte at the given offset of the given bank.
+// Bank numbers beyond the cartridge size wrap around, as only the
+// address lines that are actually present in the ROM chip are connected.
+func (mbc *MBC1) readRom(bank int, offset types.Word) byte {
+	bank %= mbc.romBanks
+	return mbc.rom[bank*romBankSize+int(offset)]
+}
+
+// Returns the position in the RAM array for an address in the A000-BFFF area.
+// In mode 0 the bank 0 is always used, in mode 1 the BANK2 register selects it.
+func (mbc *MBC1) ramOffset(addr types.Word) int {
+	bank := 0
+	if mbc.mode == 1 && mbc.ramBanks > 1 {
+		bank = int(mbc.upperBank) % mbc.ramBanks
+	}
+	return (bank*ramBankSize + int(addr-mbc1RamStart)) % len(mbc.ram)
+}
+
+func (mbc *MBC1) ramData() []byte {
+	return mbc.ram
+}
@@ -0,0 +1,164 @@
+package cartridge
+
+import (
+	"github.com/lbarrios/yesSGMB/types"
+	"testing"
+)
+
+// Returns a rom whose banks start with their own bank number
+func newBankedROM(banks int) []byte {
+	rom := make([]byte, banks*romBankSize)
+	for bank := 0; bank < banks; bank++ {
+		rom[bank*romBankSize] = byte(bank)
+	}
+	return rom
+}
+
+func newTestMBC1(rom []byte, ramSize int) *MBC1 {
+	mbc := &MBC1{log: *newTestLogger(), ramSize: ramSize}
+	mbc.Init(rom)
+	return mbc
+}
+
+func writeMBC(mbc MemoryBankController, address types.Word, value byte) {
+	mbc.Write(address.AsAddress(), value)
+}
+
+func readMBC(mbc MemoryBankController, address types.Word) byte {
+	return mbc.Read(address.AsAddress())
+}
+
+func TestMBC1RomBankSelect(t *testing.T) {
+	tests := []struct {
+		name       string
+		banks      int
+		romBank    byte // written to 2000-3FFF
+		upperBank  byte // written to 4000-5FFF
+		expected   byte // bank mapped at 4000-7FFF
+		multicart  bool
+		lowerBank  byte // bank mapped at 0000-3FFF
+		modeSelect byte
+	}{
+		{"bank 0 is mapped as 1", 128, 0x00, 0, 0x01, false, 0, 0},
+		{"bank 1", 128, 0x01, 0, 0x01, false, 0, 0},
+		{"last lower bank", 128, 0x1F, 0, 0x1F, false, 0, 0},
+		{"only 5 bits are used", 128, 0x25, 0, 0x05, false, 0, 0},
+		{"bank 0x20 is mapped as 0x21", 128, 0x00, 1, 0x21, false, 0, 0},
+		{"bank 0x40 is mapped as 0x41", 128, 0x20, 2, 0x41, false, 0, 0},
+		{"bank 0x60 is mapped as 0x61", 128, 0x00, 3, 0x61, false, 0, 0},
+		{"upper bits", 128, 0x12, 2, 0x52, false, 0, 0},
+		{"banks beyond the rom size wrap around", 32, 0x02, 1, 0x02, false, 0, 0},
+		{"small rom", 4, 0x05, 0, 0x01, false, 0, 0},
+		{"mode 0 maps bank 0 at 0000", 128, 0x01, 2, 0x41, false, 0x00, 0},
+		{"mode 1 maps the upper bits at 0000", 128, 0x01, 2, 0x41, false, 0x40, 1},
+		{"mode 1 with the upper bits beyond the rom size", 32, 0x01, 1, 0x01, false, 0x00, 1},
+		{"multicart", 64, 0x12, 1, 0x12, true, 0, 0},
+		{"multicart bank 0 is mapped as 1", 64, 0x00, 2, 0x21, true, 0, 0},
+		{"multicart uses only 4 bits", 64, 0x1F, 3, 0x3F, true, 0, 0},
+		{"multicart mode 1 maps the game banks at 0000", 64, 0x03, 2, 0x23, true, 0x20, 1},
+	}
+	for _, test := range tests {
+		rom := newBankedROM(test.banks)
+		if test.multicart {
+			offset := 0x10 * romBankSize
+			copy(rom[offset+nintendoLogoStart:offset+nintendoLogoEnd], originalNintendoLogo)
+		}
+		mbc := newTestMBC1(rom, 0)
+		writeMBC(mbc, 0x2000, test.romBank)
+		writeMBC(mbc, 0x4000, test.upperBank)
+		writeMBC(mbc, 0x6000, test.modeSelect)
+		if got := readMBC(mbc, 0x4000); got != test.expected {
+			t.Errorf("%s: bank %.2X mapped at 4000, expected %.2X", test.name, got, test.expected)
+		}
+		if got := readMBC(mbc, 0x0000); got != test.lowerBank {
+			t.Errorf("%s: bank %.2X mapped at 0000, expected %.2X", test.name, got, test.lowerBank)
+		}
+	}
+}
+
+func TestMBC1MulticartDetection(t *testing.T) {
+	tests := []struct {
+		name      string
+		banks     int
+		logoBank  int // bank with the Nintendo logo, besides the bank 0
+		multicart bool
+	}{
+		{"1MB rom with a second game", 64, 0x10, true},
+		{"1MB rom without a second game", 64, -1, false},
+		{"1MB rom with a logo in another bank", 64, 0x20, false},
+		{"2MB rom with a logo in the bank 0x10", 128, 0x10, false},
+	}
+	for _, test := range tests {
+		rom := newBankedROM(test.banks)
+		copy(rom[nintendoLogoStart:nintendoLogoEnd], originalNintendoLogo)
+		if test.logoBank >= 0 {
+			offset := test.logoBank * romBankSize
+			copy(rom[offset+nintendoLogoStart:offset+nintendoLogoEnd], originalNintendoLogo)
+		}
+		mbc := newTestMBC1(rom, 0)
+		if multicart := mbc.bankShift == mbc1MulticartShift; multicart != test.multicart {
+			t.Errorf("%s: multicart detected = %t, expected %t", test.name, multicart, test.multicart)
+		}
+	}
+}
+
+func TestMBC1Ram(t *testing.T) {
+	mbc := newTestMBC1(newBankedROM(8), 4*ramBankSize)
+
+	// The RAM is disabled at power up
+	writeMBC(mbc, 0xA000, 0x42)
+	if got := readMBC(mbc, 0xA000); got != 0xFF {
+		t.Errorf("disabled RAM reads %.2X, expected FF", got)
+	}
+
+	writeMBC(mbc, 0x0000, 0x0A)
+	for bank := byte(0); bank < 4; bank++ {
+		writeMBC(mbc, 0x6000, 1)
+		writeMBC(mbc, 0x4000, bank)
+		writeMBC(mbc, 0xA123, 0x10+bank)
+	}
+	if mbc.ram[0x0000] != 0x00 {
+		t.Errorf("the write with the RAM disabled went through")
+	}
+
+	// In mode 1 the upper bits select the RAM bank
+	for bank := byte(0); bank < 4; bank++ {
+		writeMBC(mbc, 0x4000, bank)
+		if got := readMBC(mbc, 0xA123); got != 0x10+bank {
+			t.Errorf("mode 1, RAM bank %d reads %.2X, expected %.2X", bank, got, 0x10+bank)
+		}
+	}
+
+	// In mode 0 the bank 0 is always used
+	writeMBC(mbc, 0x6000, 0)
+	for bank := byte(0); bank < 4; bank++ {
+		writeMBC(mbc, 0x4000, bank)
+		if got := readMBC(mbc, 0xA123); got != 0x10 {
+			t.Errorf("mode 0, RAM bank %d reads %.2X, expected 10", bank, got)
+		}
+	}
+
+	// Any value without 0x0A in the lower nibble disables it
+	for _, value := range []byte{0x00, 0x0B, 0xA0} {
+		writeMBC(mbc, 0x0000, 0x0A)
+		writeMBC(mbc, 0x1FFF, value)
+		if got := readMBC(mbc, 0xA123); got != 0xFF {
+			t.Errorf("RAM disabled with %.2X reads %.2X, expected FF", value, got)
+		}
+	}
+	writeMBC(mbc, 0x1FFF, 0x1A)
+	if got := readMBC(mbc, 0xA123); got != 0x10 {
+		t.Errorf("RAM enabled with 1A reads %.2X, expected 10", got)
+	}
+}
+
+func TestMBC1SmallRamIsMirrored(t *testing.T) {
+	mbc := newTestMBC1(newBankedROM(8), 0x800)
+	writeMBC(mbc, 0x0000, 0x0A)
+	writeMBC(mbc, 0xA001, 0x42)
+	for _, address := range []types.Word{0xA801, 0xB001, 0xB801} {
+		if got := readMBC(mbc, address); got != 0x42 {
+			t.Errorf("address %.4X reads %.2X, expected 42", address, got)
+		}
+	}
+}
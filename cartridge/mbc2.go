@@ -0,0 +1,93 @@
+package cartridge
+
+import (
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/types"
+)
+
+// MBC2 registers, both of them are in the 0000-3FFF area.
+// The bit 8 of the address selects which one is written:
+//
+//	bit 8 clear: RAM Enable (0x0A in the lower nibble enables it)
+//	bit 8 set:   ROM Bank Number (lower 4 bits, 0 is translated to 1)
+//
+// The MBC2 has a built-in RAM of 512 x 4 bits, mapped at A000-A1FF and
+// echoed across the whole A000-BFFF area. Only the lower nibble is stored,
+// the upper one is always read as 1s.
+const (
+	mbc2RegistersEnd     = 0x4000
+	mbc2RomBankEnd       = 0x8000
+	mbc2RegisterSelect   = 8
+	mbc2RamStart         = 0xA000
+	mbc2RamEnd           = 0xC000
+	mbc2RamSize          = 512
+	mbc2RamEnableValue   = 0x0A
+	mbc2RomBankMask      = 0x0F
+	mbc2RamUnusedBitMask = 0xF0
+)
+
+type MBC2 struct {
+	rom        []byte
+	ram        [mbc2RamSize]byte
+	romBanks   int
+	ramEnabled bool
+	romBank    byte
+	log        logger.Logger
+}
+
+func (mbc *MBC2) Init(data []byte) {
+	mbc.rom = data
+	mbc.romBanks = len(data) / romBankSize
+	if mbc.romBanks == 0 {
+		mbc.romBanks = 1
+	}
+	mbc.romBank = 1
+}
+
+func (mbc *MBC2) Write(address types.Address, value byte) {
+	addr := address.AsWord()
+	switch {
+	case addr < mbc2RegistersEnd:
+		if addr&(1<<mbc2RegisterSelect) != 0 {
+			mbc.romBank = value & mbc2RomBankMask
+			if mbc.romBank == 0 {
+				mbc.romBank = 1
+			}
+		} else {
+			mbc.ramEnabled = value&0x0F == mbc2RamEnableValue
+		}
+	case addr < mbc2RomBankEnd:
+		// Writes to the switchable ROM bank area are ignored
+	case addr >= mbc2RamStart && addr < mbc2RamEnd:
+		if !mbc.ramEnabled {
+			return
+		}
+		mbc.ram[int(addr-mbc2RamStart)%mbc2RamSize] = value & 0x0F
+	default:
+		mbc.log.Fatalf("Cannot write to address: %.4x!", addr)
+	}
+}
+
+func (mbc *MBC2) Read(address types.Address) byte {
+	addr := address.AsWord()
+	switch {
+	case addr < mbc2RegistersEnd:
+		return mbc.rom[addr]
+	case addr < mbc2RomBankEnd:
+		bank := int(mbc.romBank) % mbc.romBanks
+		return mbc.rom[bank*romBankSize+int(addr-mbc2RegistersEnd)]
+	case addr >= mbc2RamStart && addr < mbc2RamEnd:
+		if !mbc.ramEnabled {
+			return 0xFF
+		}
+		return mbc.ram[int(addr-mbc2RamStart)%mbc2RamSize] | mbc2RamUnusedBitMask
+	default:
+		mbc.log.Fatalf("Cannot read from address: %.4x!", addr)
+		return 0xFF
+	}
+}
+
+// The RAM is stored one nibble per byte, which is also the layout of the save files.
+func (mbc *MBC2) ramData() []byte {
+	return mbc.ram[:]
+}
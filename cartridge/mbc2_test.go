@@ -0,0 +1,95 @@
+package cartridge
+
+import (
+	"github.com/lbarrios/yesSGMB/types"
+	"testing"
+)
+
+func newTestMBC2(banks int) *MBC2 {
+	mbc := &MBC2{log: *newTestLogger()}
+	mbc.Init(newBankedROM(banks))
+	return mbc
+}
+
+func TestMBC2RegisterSelect(t *testing.T) {
+	tests := []struct {
+		name       string
+		address    types.Word
+		value      byte
+		romBank    byte // bank mapped at 4000-7FFF after the write
+		ramEnabled bool
+	}{
+		// The bit 8 of the address selects the register, anywhere in 0000-3FFF
+		{"RAM enable", 0x0000, 0x0A, 0x01, true},
+		{"RAM enable in the last address", 0x3EFF, 0x0A, 0x01, true},
+		{"RAM enable with the upper nibble set", 0x0000, 0xFA, 0x01, true},
+		{"RAM enable with another value", 0x0000, 0x0B, 0x01, false},
+		{"ROM bank", 0x0100, 0x05, 0x05, false},
+		{"ROM bank in the last address", 0x3FFF, 0x0F, 0x0F, false},
+		{"ROM bank 0 is mapped as 1", 0x2100, 0x00, 0x01, false},
+		{"ROM bank uses only 4 bits", 0x2100, 0x13, 0x03, false},
+		{"ROM bank with the RAM enable value", 0x0100, 0x0A, 0x0A, false},
+		{"ROM bank area is not a register", 0x4100, 0x05, 0x01, false},
+	}
+	for _, test := range tests {
+		mbc := newTestMBC2(16)
+		writeMBC(mbc, test.address, test.value)
+		if got := readMBC(mbc, 0x4000); got != test.romBank {
+			t.Errorf("%s: bank %.2X mapped at 4000, expected %.2X", test.name, got, test.romBank)
+		}
+		if mbc.ramEnabled != test.ramEnabled {
+			t.Errorf("%s: RAM enabled = %t, expected %t", test.name, mbc.ramEnabled, test.ramEnabled)
+		}
+	}
+}
+
+func TestMBC2Ram(t *testing.T) {
+	mbc := newTestMBC2(4)
+
+	// The RAM is disabled at power up
+	writeMBC(mbc, 0xA000, 0x05)
+	if got := readMBC(mbc, 0xA000); got != 0xFF {
+		t.Errorf("disabled RAM reads %.2X, expected FF", got)
+	}
+
+	writeMBC(mbc, 0x0000, 0x0A)
+	tests := []struct {
+		address  types.Word
+		value    byte
+		expected byte
+	}{
+		// Only the lower nibble is stored, the upper one reads as 1s
+		{0xA000, 0x05, 0xF5},
+		{0xA001, 0xA3, 0xF3},
+		{0xA1FF, 0xFF, 0xFF},
+		{0xA100, 0x00, 0xF0},
+	}
+	for _, test := range tests {
+		writeMBC(mbc, test.address, test.value)
+		if got := readMBC(mbc, test.address); got != test.expected {
+			t.Errorf("address %.4X reads %.2X after writing %.2X, expected %.2X", test.address, got, test.value, test.expected)
+		}
+	}
+	if mbc.ram[1] != 0x03 {
+		t.Errorf("the RAM stores %.2X, expected only the lower nibble 03", mbc.ram[1])
+	}
+
+	// The 512 nibbles are echoed across the whole A000-BFFF area
+	for _, address := range []types.Word{0xA201, 0xA401, 0xB001, 0xBE01} {
+		if got := readMBC(mbc, address); got != 0xF3 {
+			t.Errorf("address %.4X reads %.2X, expected the echo of A001 F3", address, got)
+		}
+	}
+	writeMBC(mbc, 0xBFFF, 0x0C)
+	if got := readMBC(mbc, 0xA1FF); got != 0xFC {
+		t.Errorf("A1FF reads %.2X after writing its echo at BFFF, expected FC", got)
+	}
+
+	// Disabling the RAM ignores the writes
+	writeMBC(mbc, 0x0000, 0x00)
+	writeMBC(mbc, 0xA000, 0x0E)
+	writeMBC(mbc, 0x0000, 0x0A)
+	if got := readMBC(mbc, 0xA000); got != 0xF5 {
+		t.Errorf("A000 reads %.2X after writing with the RAM disabled, expected F5", got)
+	}
+}
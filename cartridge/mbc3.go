@@ -0,0 +1,329 @@
+package cartridge
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/types"
+	"time"
+)
+
+// MBC3 registers, selected by the address range that is written.
+//
+//	0000-1FFF: RAM and Timer Enable (0x0A in the lower nibble enables them)
+//	2000-3FFF: ROM Bank Number (7 bits, 0 is translated to 1)
+//	4000-5FFF: RAM Bank Number (00-03) or RTC Register Select (08-0C)
+//	6000-7FFF: Latch Clock Data (writing 0x00 and then 0x01 latches the RTC registers)
+//
+// The RTC registers are:
+//
+//	08h: RTC S   Seconds   0-59
+//	09h: RTC M   Minutes   0-59
+//	0Ah: RTC H   Hours     0-23
+//	0Bh: RTC DL  Lower 8 bits of Day Counter
+//	0Ch: RTC DH  Upper 1 bit of Day Counter, Carry Bit, Halt Flag
+//	       Bit 0  Most significant bit of Day Counter (Bit 8)
+//	       Bit 6  Halt (0=Active, 1=Stop Timer)
+//	       Bit 7  Day Counter Carry Bit (1=Counter Overflow)
+const (
+	mbc3RamEnableEnd   = 0x2000
+	mbc3RomBankEnd     = 0x4000
+	mbc3RamBankEnd     = 0x6000
+	mbc3LatchEnd       = 0x8000
+	mbc3RamStart       = 0xA000
+	mbc3RamEnd         = 0xC000
+	mbc3RamEnableValue = 0x0A
+	mbc3RomBankMask    = 0x7F
+	mbc3RamBankMask    = 0x03
+	mbc3RtcSeconds     = 0x08
+	mbc3RtcMinutes     = 0x09
+	mbc3RtcHours       = 0x0A
+	mbc3RtcDaysLow     = 0x0B
+	mbc3RtcDaysHigh    = 0x0C
+	mbc3RtcDayBit8     = 0
+	mbc3RtcHaltBit     = 6
+	mbc3RtcCarryBit    = 7
+	mbc3RtcMaxDays     = 512
+)
+
+// The RTC state is appended to the RAM in the save files, using the format
+// shared by most emulators (VBA-M, BGB, mGBA...). All the values are little endian:
+//
+//	5 x uint32: current S, M, H, DL, DH
+//	5 x uint32: latched S, M, H, DL, DH
+//	uint64:     UNIX timestamp of the moment the file was saved (uint32 in the older 44 bytes version)
+const (
+	rtcFooterSize       = 48
+	rtcFooterLegacySize = 44
+	rtcFooterLatchStart = 20
+	rtcFooterTimeStart  = 40
+)
+
+type MBC3 struct {
+	rom        []byte
+	ram        []byte
+	romBanks   int
+	ramBanks   int
+	ramSize    int
+	hasTimer   bool
+	ramEnabled bool
+	romBank    byte
+	bankSelect byte // RAM bank (00-03) or RTC register (08-0C)
+	latchValue byte // last value written to the latch register
+	rtc        realTimeClock
+	log        logger.Logger
+}
+
+func (mbc *MBC3) Init(data []byte) {
+	mbc.rom = data
+	mbc.romBanks = len(data) / romBankSize
+	if mbc.romBanks == 0 {
+		mbc.romBanks = 1
+	}
+	mbc.ram = make([]byte, mbc.ramSize)
+	mbc.ramBanks = mbc.ramSize / ramBankSize
+	mbc.romBank = 1
+	mbc.latchValue = 0xFF
+	if mbc.rtc.now == nil {
+		mbc.rtc.now = time.Now
+	}
+	mbc.rtc.lastUpdate = mbc.rtc.now()
+}
+
+// SetTimeSource replaces the function used by the RTC to obtain the current time.
+// By default it is time.Now, but it can be replaced in order to control the time deterministically.
+func (mbc *MBC3) SetTimeSource(now func() time.Time) {
+	mbc.rtc.now = now
+	mbc.rtc.lastUpdate = now()
+}
+
+func (mbc *MBC3) Write(address types.Address, value byte) {
+	addr := address.AsWord()
+	switch {
+	case addr < mbc3RamEnableEnd:
+		mbc.ramEnabled = value&0x0F == mbc3RamEnableValue
+	case addr < mbc3RomBankEnd:
+		mbc.romBank = value & mbc3RomBankMask
+		if mbc.romBank == 0 {
+			mbc.romBank = 1
+		}
+	case addr < mbc3RamBankEnd:
+		mbc.bankSelect = value
+	case addr < mbc3LatchEnd:
+		if mbc.hasTimer && mbc.latchValue == 0x00 && value == 0x01 {
+			mbc.rtc.latch()
+		}
+		mbc.latchValue = value
+	case addr >= mbc3RamStart && addr < mbc3RamEnd:
+		if !mbc.ramEnabled {
+			return
+		}
+		if mbc.selectsRtcRegister() {
+			mbc.rtc.write(mbc.bankSelect, value)
+			return
+		}
+		if offset, ok := mbc.ramOffset(addr); ok {
+			mbc.ram[offset] = value
+		}
+	default:
+		mbc.log.Fatalf("Cannot write to address: %.4x!", addr)
+	}
+}
+
+func (mbc *MBC3) Read(address types.Address) byte {
+	addr := address.AsWord()
+	switch {
+	case addr < mbc3RomBankEnd:
+		return mbc.rom[addr]
+	case addr < mbc3LatchEnd:
+		bank := int(mbc.romBank) % mbc.romBanks
+		return mbc.rom[bank*romBankSize+int(addr-mbc3RomBankEnd)]
+	case addr >= mbc3RamStart && addr < mbc3RamEnd:
+		if !mbc.ramEnabled {
+			return 0xFF
+		}
+		if mbc.selectsRtcRegister() {
+			return mbc.rtc.read(mbc.bankSelect)
+		}
+		if offset, ok := mbc.ramOffset(addr); ok {
+			return mbc.ram[offset]
+		}
+		return 0xFF
+	default:
+		mbc.log.Fatalf("Cannot read from address: %.4x!", addr)
+		return 0xFF
+	}
+}
+
+func (mbc *MBC3) selectsRtcRegister() bool {
+	return mbc.hasTimer && mbc.bankSelect >= mbc3RtcSeconds && mbc.bankSelect <= mbc3RtcDaysHigh
+}
+
+// Returns the position in the RAM array for an address in the A000-BFFF area,
+// and false if there is no RAM for the currently selected bank.
+func (mbc *MBC3) ramOffset(addr types.Word) (int, bool) {
+	if len(mbc.ram) == 0 || mbc.bankSelect > mbc3RamBankMask {
+		return 0, false
+	}
+	bank := 0
+	if mbc.ramBanks > 1 {
+		bank = int(mbc.bankSelect) % mbc.ramBanks
+	}
+	return (bank*ramBankSize + int(addr-mbc3RamStart)) % len(mbc.ram), true
+}
+
+// realTimeClock keeps the MBC3 clock counters. Instead of ticking every second,
+// the counters are brought up to date (using the time source) every time they are accessed.
+type realTimeClock struct {
+	seconds    byte
+	minutes    byte
+	hours      byte
+	days       uint16
+	halted     bool
+	dayCarry   bool
+	latched    [5]byte // S, M, H, DL, DH, as seen by the game after the last latch
+	lastUpdate time.Time
+	now        func() time.Time
+}
+
+// Advances the counters by the time elapsed since the last update.
+func (rtc *realTimeClock) update() {
+	now := rtc.now()
+	elapsed := int64(now.Sub(rtc.lastUpdate) / time.Second)
+	if rtc.halted || elapsed < 0 {
+		rtc.lastUpdate = now
+		return
+	}
+	// Only whole seconds are consumed, the remainder is kept for the next update
+	rtc.lastUpdate = rtc.lastUpdate.Add(time.Duration(elapsed) * time.Second)
+	rtc.advance(elapsed)
+}
+
+func (rtc *realTimeClock) advance(seconds int64) {
+	total := int64(rtc.seconds) + seconds
+	rtc.seconds = byte(total % 60)
+	total = int64(rtc.minutes) + total/60
+	rtc.minutes = byte(total % 60)
+	total = int64(rtc.hours) + total/60
+	rtc.hours = byte(total % 24)
+	total = int64(rtc.days) + total/24
+	if total >= mbc3RtcMaxDays {
+		rtc.dayCarry = true
+	}
+	rtc.days = uint16(total % mbc3RtcMaxDays)
+}
+
+func (rtc *realTimeClock) daysHigh() byte {
+	var dh byte
+	dh |= byte(rtc.days>>8) & 0x01 << mbc3RtcDayBit8
+	if rtc.halted {
+		dh |= 1 << mbc3RtcHaltBit
+	}
+	if rtc.dayCarry {
+		dh |= 1 << mbc3RtcCarryBit
+	}
+	return dh
+}
+
+// Copies the current value of the counters to the registers visible by the game.
+func (rtc *realTimeClock) latch() {
+	rtc.update()
+	rtc.latched = [5]byte{rtc.seconds, rtc.minutes, rtc.hours, byte(rtc.days), rtc.daysHigh()}
+}
+
+func (rtc *realTimeClock) read(register byte) byte {
+	return rtc.latched[register-mbc3RtcSeconds]
+}
+
+func (rtc *realTimeClock) write(register byte, value byte) {
+	rtc.update()
+	switch register {
+	case mbc3RtcSeconds:
+		rtc.seconds = value & 0x3F
+		// Writing the seconds resets the sub-second counter
+		rtc.lastUpdate = rtc.now()
+	case mbc3RtcMinutes:
+		rtc.minutes = value & 0x3F
+	case mbc3RtcHours:
+		rtc.hours = value & 0x1F
+	case mbc3RtcDaysLow:
+		rtc.days = rtc.days&0x100 | uint16(value)
+	case mbc3RtcDaysHigh:
+		rtc.days = rtc.days&0xFF | uint16(value&0x01)<<8
+		rtc.dayCarry = types.BitIsSet(value, mbc3RtcCarryBit)
+		halted := types.BitIsSet(value, mbc3RtcHaltBit)
+		if rtc.halted && !halted {
+			rtc.lastUpdate = rtc.now()
+		}
+		rtc.halted = halted
+	}
+	rtc.latched[register-mbc3RtcSeconds] = rtc.registerValue(register)
+}
+
+func (rtc *realTimeClock) registerValue(register byte) byte {
+	switch register {
+	case mbc3RtcSeconds:
+		return rtc.seconds
+	case mbc3RtcMinutes:
+		return rtc.minutes
+	case mbc3RtcHours:
+		return rtc.hours
+	case mbc3RtcDaysLow:
+		return byte(rtc.days)
+	default:
+		return rtc.daysHigh()
+	}
+}
+
+func (mbc *MBC3) ramData() []byte {
+	return mbc.ram
+}
+
+func (mbc *MBC3) rtcFooter() []byte {
+	if !mbc.hasTimer {
+		return nil
+	}
+	rtc := &mbc.rtc
+	rtc.update()
+	footer := make([]byte, rtcFooterSize)
+	current := [5]byte{rtc.seconds, rtc.minutes, rtc.hours, byte(rtc.days), rtc.daysHigh()}
+	for i := range current {
+		binary.LittleEndian.PutUint32(footer[i*4:], uint32(current[i]))
+		binary.LittleEndian.PutUint32(footer[rtcFooterLatchStart+i*4:], uint32(rtc.latched[i]))
+	}
+	binary.LittleEndian.PutUint64(footer[rtcFooterTimeStart:], uint64(rtc.lastUpdate.Unix()))
+	return footer
+}
+
+func (mbc *MBC3) loadRtcFooter(footer []byte) error {
+	if !mbc.hasTimer {
+		return nil
+	}
+	if len(footer) != rtcFooterSize && len(footer) != rtcFooterLegacySize {
+		return errors.New(fmt.Sprintf("Invalid RTC data size: %d bytes", len(footer)))
+	}
+	rtc := &mbc.rtc
+	var current [5]byte
+	for i := range current {
+		current[i] = byte(binary.LittleEndian.Uint32(footer[i*4:]))
+		rtc.latched[i] = byte(binary.LittleEndian.Uint32(footer[rtcFooterLatchStart+i*4:]))
+	}
+	rtc.seconds = current[0]
+	rtc.minutes = current[1]
+	rtc.hours = current[2]
+	rtc.days = uint16(current[3]) | uint16(current[4]&0x01)<<8
+	rtc.halted = types.BitIsSet(current[4], mbc3RtcHaltBit)
+	rtc.dayCarry = types.BitIsSet(current[4], mbc3RtcCarryBit)
+
+	var timestamp int64
+	if len(footer) == rtcFooterSize {
+		timestamp = int64(binary.LittleEndian.Uint64(footer[rtcFooterTimeStart:]))
+	} else {
+		timestamp = int64(binary.LittleEndian.Uint32(footer[rtcFooterTimeStart:]))
+	}
+	// The clock keeps running while the emulator is closed
+	rtc.lastUpdate = time.Unix(timestamp, 0)
+	rtc.update()
+	return nil
+}
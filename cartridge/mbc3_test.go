@@ -0,0 +1,225 @@
+package cartridge
+
+import (
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/types"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func newTestLogger() *logger.Logger {
+	l := new(logger.Logger)
+	l.Init()
+	l.Log = log.New(ioutil.Discard, "", 0)
+	return l
+}
+
+// testClock is a time source that only moves when the test advances it
+type testClock struct {
+	current time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.current
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.current = c.current.Add(d)
+}
+
+// Returns an MBC3 with timer, with the RAM and the RTC enabled
+func newTestMBC3() (*MBC3, *testClock) {
+	mbc := &MBC3{log: *newTestLogger(), ramSize: ramBankSize, hasTimer: true}
+	mbc.Init(make([]byte, 2*romBankSize))
+	clock := &testClock{current: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	mbc.SetTimeSource(clock.now)
+	mbc.Write(types.Address{High: 0x00, Low: 0x00}, mbc3RamEnableValue)
+	return mbc, clock
+}
+
+func (mbc *MBC3) latchRtc() {
+	mbc.Write(types.Address{High: 0x60, Low: 0x00}, 0x00)
+	mbc.Write(types.Address{High: 0x60, Low: 0x00}, 0x01)
+}
+
+func (mbc *MBC3) readRtc(register byte) byte {
+	mbc.Write(types.Address{High: 0x40, Low: 0x00}, register)
+	return mbc.Read(types.Address{High: 0xA0, Low: 0x00})
+}
+
+func (mbc *MBC3) writeRtc(register byte, value byte) {
+	mbc.Write(types.Address{High: 0x40, Low: 0x00}, register)
+	mbc.Write(types.Address{High: 0xA0, Low: 0x00}, value)
+}
+
+// Returns the latched S, M, H, DL, DH registers
+func (mbc *MBC3) readRtcRegisters() [5]byte {
+	var registers [5]byte
+	for i := range registers {
+		registers[i] = mbc.readRtc(mbc3RtcSeconds + byte(i))
+	}
+	return registers
+}
+
+func TestRTCLatch(t *testing.T) {
+	mbc, clock := newTestMBC3()
+	clock.advance(5 * time.Second)
+	if s := mbc.readRtc(mbc3RtcSeconds); s != 0 {
+		t.Errorf("seconds before latching = %d, expected 0", s)
+	}
+
+	mbc.latchRtc()
+	if s := mbc.readRtc(mbc3RtcSeconds); s != 5 {
+		t.Errorf("seconds after latching = %d, expected 5", s)
+	}
+
+	// The latched registers don't change while the clock runs
+	clock.advance(10 * time.Second)
+	if s := mbc.readRtc(mbc3RtcSeconds); s != 5 {
+		t.Errorf("seconds 10s after latching = %d, expected 5", s)
+	}
+
+	// Only a 0 to 1 transition latches the clock
+	mbc.Write(types.Address{High: 0x60, Low: 0x00}, 0x01)
+	if s := mbc.readRtc(mbc3RtcSeconds); s != 5 {
+		t.Errorf("seconds after writing 1 twice = %d, expected 5", s)
+	}
+	mbc.Write(types.Address{High: 0x60, Low: 0x00}, 0x00)
+	mbc.Write(types.Address{High: 0x60, Low: 0x00}, 0x02)
+	if s := mbc.readRtc(mbc3RtcSeconds); s != 5 {
+		t.Errorf("seconds after writing 0 and then 2 = %d, expected 5", s)
+	}
+
+	mbc.latchRtc()
+	if s := mbc.readRtc(mbc3RtcSeconds); s != 15 {
+		t.Errorf("seconds after latching again = %d, expected 15", s)
+	}
+}
+
+func TestRTCHalt(t *testing.T) {
+	mbc, clock := newTestMBC3()
+	clock.advance(3 * time.Second)
+	mbc.writeRtc(mbc3RtcDaysHigh, 1<<mbc3RtcHaltBit)
+
+	clock.advance(100 * time.Second)
+	mbc.latchRtc()
+	expected := [5]byte{3, 0, 0, 0, 1 << mbc3RtcHaltBit}
+	if registers := mbc.readRtcRegisters(); registers != expected {
+		t.Errorf("registers while halted = %v, expected %v", registers, expected)
+	}
+
+	// The time spent halted is not counted once the clock is resumed
+	mbc.writeRtc(mbc3RtcDaysHigh, 0x00)
+	clock.advance(4 * time.Second)
+	mbc.latchRtc()
+	expected = [5]byte{7, 0, 0, 0, 0}
+	if registers := mbc.readRtcRegisters(); registers != expected {
+		t.Errorf("registers after resuming = %v, expected %v", registers, expected)
+	}
+}
+
+func TestRTCRollover(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		name     string
+		elapsed  time.Duration
+		expected [5]byte // S, M, H, DL, DH
+	}{
+		{"seconds", 59 * time.Second, [5]byte{59, 0, 0, 0, 0}},
+		{"seconds into minutes", 60 * time.Second, [5]byte{0, 1, 0, 0, 0}},
+		{"minutes", 59*time.Minute + 59*time.Second, [5]byte{59, 59, 0, 0, 0}},
+		{"minutes into hours", time.Hour, [5]byte{0, 0, 1, 0, 0}},
+		{"hours", 23*time.Hour + 59*time.Minute + 59*time.Second, [5]byte{59, 59, 23, 0, 0}},
+		{"hours into days", day, [5]byte{0, 0, 0, 1, 0}},
+		{"days into bit 8", 256 * day, [5]byte{0, 0, 0, 0, 0x01}},
+		{"last day", 511*day + 23*time.Hour + 59*time.Minute + 59*time.Second, [5]byte{59, 59, 23, 0xFF, 0x01}},
+		{"day counter overflow", 512 * day, [5]byte{0, 0, 0, 0, 1 << mbc3RtcCarryBit}},
+		{"after day counter overflow", 513*day + time.Second, [5]byte{1, 0, 0, 1, 1 << mbc3RtcCarryBit}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mbc, clock := newTestMBC3()
+			clock.advance(test.elapsed)
+			mbc.latchRtc()
+			if registers := mbc.readRtcRegisters(); registers != test.expected {
+				t.Errorf("registers after %s = %v, expected %v", test.elapsed, registers, test.expected)
+			}
+		})
+	}
+}
+
+func TestRTCDayCarryIsKeptUntilCleared(t *testing.T) {
+	mbc, clock := newTestMBC3()
+	clock.advance(512 * 24 * time.Hour)
+	mbc.latchRtc()
+
+	// The carry bit is not cleared by the day counter going on
+	clock.advance(300 * 24 * time.Hour)
+	mbc.latchRtc()
+	expected := [5]byte{0, 0, 0, 0x2C, 0x01 | 1<<mbc3RtcCarryBit}
+	if registers := mbc.readRtcRegisters(); registers != expected {
+		t.Errorf("registers after the overflow = %v, expected %v", registers, expected)
+	}
+
+	// Only the game can clear it
+	mbc.writeRtc(mbc3RtcDaysHigh, 0x01)
+	mbc.latchRtc()
+	expected = [5]byte{0, 0, 0, 0x2C, 0x01}
+	if registers := mbc.readRtcRegisters(); registers != expected {
+		t.Errorf("registers after clearing the carry = %v, expected %v", registers, expected)
+	}
+}
+
+func TestRTCRegisterWrites(t *testing.T) {
+	mbc, clock := newTestMBC3()
+	mbc.writeRtc(mbc3RtcDaysHigh, 1<<mbc3RtcHaltBit)
+	mbc.writeRtc(mbc3RtcSeconds, 30)
+	mbc.writeRtc(mbc3RtcMinutes, 59)
+	mbc.writeRtc(mbc3RtcHours, 23)
+	mbc.writeRtc(mbc3RtcDaysLow, 0xFF)
+	mbc.writeRtc(mbc3RtcDaysHigh, 0x01)
+
+	// The written values can be read back without latching
+	expected := [5]byte{30, 59, 23, 0xFF, 0x01}
+	if registers := mbc.readRtcRegisters(); registers != expected {
+		t.Errorf("registers after writing = %v, expected %v", registers, expected)
+	}
+
+	// And the clock keeps counting from them
+	clock.advance(30 * time.Second)
+	mbc.latchRtc()
+	expected = [5]byte{0, 0, 0, 0, 1 << mbc3RtcCarryBit}
+	if registers := mbc.readRtcRegisters(); registers != expected {
+		t.Errorf("registers 30s after writing = %v, expected %v", registers, expected)
+	}
+
+	// Writing the seconds resets the sub-second counter
+	clock.advance(700 * time.Millisecond)
+	mbc.writeRtc(mbc3RtcSeconds, 10)
+	clock.advance(700 * time.Millisecond)
+	mbc.latchRtc()
+	if s := mbc.readRtc(mbc3RtcSeconds); s != 10 {
+		t.Errorf("seconds 0.7s after writing = %d, expected 10", s)
+	}
+	clock.advance(300 * time.Millisecond)
+	mbc.latchRtc()
+	if s := mbc.readRtc(mbc3RtcSeconds); s != 11 {
+		t.Errorf("seconds 1s after writing = %d, expected 11", s)
+	}
+}
+
+func TestRTCRegisterWritesAreMasked(t *testing.T) {
+	mbc, _ := newTestMBC3()
+	mbc.writeRtc(mbc3RtcDaysHigh, 0xFF)
+	mbc.writeRtc(mbc3RtcSeconds, 0xFF)
+	mbc.writeRtc(mbc3RtcMinutes, 0xFF)
+	mbc.writeRtc(mbc3RtcHours, 0xFF)
+	mbc.writeRtc(mbc3RtcDaysLow, 0xFF)
+
+	expected := [5]byte{0x3F, 0x3F, 0x1F, 0xFF, 0x01 | 1<<mbc3RtcHaltBit | 1<<mbc3RtcCarryBit}
+	if registers := mbc.readRtcRegisters(); registers != expected {
+		t.Errorf("registers after writing 0xFF = %v, expected %v", registers, expected)
+	}
+}
@@ -0,0 +1,143 @@
+package cartridge
+
+import (
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/types"
+)
+
+// MBC5 registers, selected by the address range that is written.
+//
+//	0000-1FFF: RAM Enable (0x0A enables it)
+//	2000-2FFF: Low 8 bits of ROM Bank Number (0 is a valid bank)
+//	3000-3FFF: High bit of ROM Bank Number (bit 8)
+//	4000-5FFF: RAM Bank Number (00-0F)
+//
+// On rumble cartridges the bit 3 of the RAM Bank Number register drives the
+// rumble motor, so only the bits 0-2 are used to select the RAM bank.
+const (
+	mbc5RamEnableEnd     = 0x2000
+	mbc5RomBankLowEnd    = 0x3000
+	mbc5RomBankHighEnd   = 0x4000
+	mbc5RamBankEnd       = 0x6000
+	mbc5RomEnd           = 0x8000
+	mbc5RamStart         = 0xA000
+	mbc5RamEnd           = 0xC000
+	mbc5RamEnableValue   = 0x0A
+	mbc5RamBankMask      = 0x0F
+	mbc5RumbleBankMask   = 0x07
+	mbc5RumbleMotorBit   = 3
+	mbc5RomBankHighShift = 8
+)
+
+type MBC5 struct {
+	rom        []byte
+	ram        []byte
+	romBanks   int
+	ramBanks   int
+	ramSize    int
+	hasRumble  bool
+	ramEnabled bool
+	romBank    uint16 // 9 bits
+	ramBank    byte
+	motorOn    bool
+	rumble     func(on bool)
+	log        logger.Logger
+}
+
+func (mbc *MBC5) Init(data []byte) {
+	mbc.rom = data
+	mbc.romBanks = len(data) / romBankSize
+	if mbc.romBanks == 0 {
+		mbc.romBanks = 1
+	}
+	mbc.ram = make([]byte, mbc.ramSize)
+	mbc.ramBanks = mbc.ramSize / ramBankSize
+	mbc.romBank = 1
+}
+
+// SetRumbleHandler registers a function that is called every time the rumble
+// motor is turned on or off. It is only used by the MBC5+RUMBLE cartridges.
+func (mbc *MBC5) SetRumbleHandler(handler func(on bool)) {
+	mbc.rumble = handler
+}
+
+// HasRumble reports whether the cartridge has a rumble motor.
+func (mbc *MBC5) HasRumble() bool {
+	return mbc.hasRumble
+}
+
+// MotorOn reports whether the rumble motor is currently on.
+func (mbc *MBC5) MotorOn() bool {
+	return mbc.motorOn
+}
+
+func (mbc *MBC5) Write(address types.Address, value byte) {
+	addr := address.AsWord()
+	switch {
+	case addr < mbc5RamEnableEnd:
+		mbc.ramEnabled = value == mbc5RamEnableValue
+	case addr < mbc5RomBankLowEnd:
+		mbc.romBank = mbc.romBank&0x100 | uint16(value)
+	case addr < mbc5RomBankHighEnd:
+		mbc.romBank = mbc.romBank&0xFF | uint16(value&0x01)<<mbc5RomBankHighShift
+	case addr < mbc5RamBankEnd:
+		if mbc.hasRumble {
+			mbc.ramBank = value & mbc5RumbleBankMask
+			mbc.setMotor(types.BitIsSet(value, mbc5RumbleMotorBit))
+		} else {
+			mbc.ramBank = value & mbc5RamBankMask
+		}
+	case addr < mbc5RomEnd:
+		// Writes to 6000-7FFF are ignored
+	case addr >= mbc5RamStart && addr < mbc5RamEnd:
+		if !mbc.ramEnabled || len(mbc.ram) == 0 {
+			return
+		}
+		mbc.ram[mbc.ramOffset(addr)] = value
+	default:
+		mbc.log.Fatalf("Cannot write to address: %.4x!", addr)
+	}
+}
+
+func (mbc *MBC5) Read(address types.Address) byte {
+	addr := address.AsWord()
+	switch {
+	case addr < romBankSize:
+		return mbc.rom[addr]
+	case addr < mbc5RomEnd:
+		// Unlike MBC1, the bank 0 can be mapped into the switchable area
+		bank := int(mbc.romBank) % mbc.romBanks
+		return mbc.rom[bank*romBankSize+int(addr-romBankSize)]
+	case addr >= mbc5RamStart && addr < mbc5RamEnd:
+		if !mbc.ramEnabled || len(mbc.ram) == 0 {
+			return 0xFF
+		}
+		return mbc.ram[mbc.ramOffset(addr)]
+	default:
+		mbc.log.Fatalf("Cannot read from address: %.4x!", addr)
+		return 0xFF
+	}
+}
+
+func (mbc *MBC5) setMotor(on bool) {
+	if on == mbc.motorOn {
+		return
+	}
+	mbc.motorOn = on
+	if mbc.rumble != nil {
+		mbc.rumble(on)
+	}
+}
+
+// Returns the position in the RAM array for an address in the A000-BFFF area.
+func (mbc *MBC5) ramOffset(addr types.Word) int {
+	bank := 0
+	if mbc.ramBanks > 1 {
+		bank = int(mbc.ramBank) % mbc.ramBanks
+	}
+	return (bank*ramBankSize + int(addr-mbc5RamStart)) % len(mbc.ram)
+}
+
+func (mbc *MBC5) ramData() []byte {
+	return mbc.ram
+}
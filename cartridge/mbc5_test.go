@@ -0,0 +1,50 @@
+package cartridge
+
+import (
+	"github.com/lbarrios/yesSGMB/types"
+	"reflect"
+	"testing"
+)
+
+func TestRumbleHandler(t *testing.T) {
+	c := &Cartridge{log: *newTestLogger()}
+	c.MBC = &MBC5{log: c.log, hasRumble: true}
+	c.MBC.Init(make([]byte, 2*romBankSize))
+	if !c.HasRumble() {
+		t.Fatalf("HasRumble() = false for a MBC5+RUMBLE cartridge")
+	}
+
+	var states []bool
+	c.SetRumbleHandler(func(on bool) {
+		states = append(states, on)
+	})
+	// The motor is driven by the bit 3 of the RAM bank register,
+	// and the handler is only called when it changes
+	for _, value := range []byte{0x08, 0x09, 0x01, 0x00, 0x0F} {
+		c.Write(types.Address{High: 0x40, Low: 0x00}, value)
+	}
+	if expected := []bool{true, false, true}; !reflect.DeepEqual(states, expected) {
+		t.Errorf("rumble states = %v, expected %v", states, expected)
+	}
+}
+
+func TestNoRumbleHandler(t *testing.T) {
+	c := &Cartridge{log: *newTestLogger()}
+	c.MBC = &MBC5{log: c.log, ramSize: 4 * ramBankSize}
+	c.MBC.Init(make([]byte, 2*romBankSize))
+	if c.HasRumble() {
+		t.Errorf("HasRumble() = true for a MBC5 cartridge without rumble")
+	}
+
+	c.SetRumbleHandler(func(on bool) {
+		t.Errorf("rumble handler called with %t", on)
+	})
+	c.Write(types.Address{High: 0x40, Low: 0x00}, 0x0B)
+
+	c.MBC = &MBC3{log: c.log}
+	c.MBC.Init(make([]byte, 2*romBankSize))
+	if c.HasRumble() {
+		t.Errorf("HasRumble() = true for a MBC3 cartridge")
+	}
+	c.SetRumbleHandler(func(on bool) {})
+}
@@ -0,0 +1,344 @@
+package cartridge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Patch formats supported, identified by the magic string at the beginning of the file
+var (
+	ipsMagic = []byte("PATCH")
+	ipsEOF   = []byte("EOF")
+	upsMagic = []byte("UPS1")
+	bpsMagic = []byte("BPS1")
+)
+
+// Extensions of the patch files that are applied automatically when they are next to the rom
+var patchExtensions = []string{".ips", ".ups", ".bps"}
+
+const (
+	patchFooterSize = 12 // source CRC32, target CRC32 and patch CRC32 of the UPS and BPS formats
+)
+
+const ( // BPS actions
+	bpsSourceRead = iota
+	bpsTargetRead
+	bpsSourceCopy
+	bpsTargetCopy
+)
+
+// Returns the patch files to apply: the ones found next to the rom file,
+// followed by the ones explicitly given in the options.
+func (c *Cartridge) patchFilenames() []string {
+	var filenames []string
+	seen := make(map[string]bool)
+	if !c.options.DisableAutoPatch {
+		base := strings.TrimSuffix(c.romPath(), filepath.Ext(c.romPath()))
+		for _, extension := range patchExtensions {
+			filename := base + extension
+			if _, err := os.Stat(filename); err == nil {
+				filenames = append(filenames, filename)
+				seen[filepath.Clean(filename)] = true
+			}
+		}
+	}
+	for _, filename := range c.options.Patches {
+		if !seen[filepath.Clean(filename)] {
+			filenames = append(filenames, filename)
+			seen[filepath.Clean(filename)] = true
+		}
+	}
+	return filenames
+}
+
+// ApplyPatchFile patches the rom data in memory with an IPS, UPS or BPS patch file.
+// It must be called before parsing the header.
+func (c *Cartridge) ApplyPatchFile(filename string) error {
+	patch, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var patched []byte
+	switch {
+	case bytes.HasPrefix(patch, ipsMagic):
+		patched, err = applyIPS(c.data, patch)
+	case bytes.HasPrefix(patch, upsMagic):
+		patched, err = applyUPS(c.data, patch)
+	case bytes.HasPrefix(patch, bpsMagic):
+		patched, err = applyBPS(c.data, patch)
+	default:
+		err = errors.New("unknown patch format")
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Cannot apply patch %s: %s", filename, err))
+	}
+
+	c.data = patched
+	c.log.Printf("Patch %s applied.", filename)
+	return nil
+}
+
+// IPS format:
+//
+//	"PATCH"
+//	records: 3 bytes offset, 2 bytes size, size bytes of data (big endian)
+//	         if size is 0, it is a RLE record: 2 bytes count, 1 byte value
+//	"EOF"
+//	optional 3 bytes with the size to truncate the output to
+func applyIPS(source []byte, patch []byte) ([]byte, error) {
+	target := append([]byte{}, source...)
+	pos := len(ipsMagic)
+	for {
+		if pos+len(ipsEOF) > len(patch) {
+			return nil, errors.New("unexpected end of IPS patch")
+		}
+		if bytes.Equal(patch[pos:pos+len(ipsEOF)], ipsEOF) {
+			pos += len(ipsEOF)
+			break
+		}
+		if pos+5 > len(patch) {
+			return nil, errors.New("unexpected end of IPS patch")
+		}
+		offset := int(patch[pos])<<16 | int(patch[pos+1])<<8 | int(patch[pos+2])
+		size := int(binary.BigEndian.Uint16(patch[pos+3:]))
+		pos += 5
+
+		var data []byte
+		if size == 0 {
+			if pos+3 > len(patch) {
+				return nil, errors.New("unexpected end of IPS patch")
+			}
+			count := int(binary.BigEndian.Uint16(patch[pos:]))
+			data = bytes.Repeat([]byte{patch[pos+2]}, count)
+			pos += 3
+		} else {
+			if pos+size > len(patch) {
+				return nil, errors.New("unexpected end of IPS patch")
+			}
+			data = patch[pos : pos+size]
+			pos += size
+		}
+
+		if offset+len(data) > len(target) {
+			target = append(target, make([]byte, offset+len(data)-len(target))...)
+		}
+		copy(target[offset:], data)
+	}
+
+	// Truncate extension
+	if pos+3 <= len(patch) {
+		size := int(patch[pos])<<16 | int(patch[pos+1])<<8 | int(patch[pos+2])
+		if size < len(target) {
+			target = target[:size]
+		}
+	}
+	return target, nil
+}
+
+// UPS format:
+//
+//	"UPS1"
+//	varint source size, varint target size
+//	hunks: varint relative offset, bytes to XOR with the source ended by a 0x00
+//	footer: source CRC32, target CRC32, patch CRC32 (little endian)
+func applyUPS(source []byte, patch []byte) ([]byte, error) {
+	if err := checkPatchFooter(source, patch); err != nil {
+		return nil, err
+	}
+	reader := patchReader{data: patch[:len(patch)-patchFooterSize], pos: len(upsMagic)}
+	sourceSize := reader.varint()
+	targetSize := reader.varint()
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	if sourceSize != uint64(len(source)) {
+		return nil, errors.New(fmt.Sprintf("source size mismatch: %d bytes, expected %d", len(source), sourceSize))
+	}
+	if targetSize > maxRomSize {
+		return nil, errors.New(fmt.Sprintf("target size too big: %d bytes", targetSize))
+	}
+
+	target := make([]byte, targetSize)
+	copy(target, source)
+	offset := uint64(0)
+	for reader.pos < len(reader.data) {
+		offset += reader.varint()
+		for {
+			x := reader.byte()
+			if reader.err != nil {
+				return nil, reader.err
+			}
+			if offset < targetSize {
+				target[offset] ^= x
+			}
+			offset++
+			if x == 0 {
+				break
+			}
+		}
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	return target, checkTargetCRC(target, patch)
+}
+
+// BPS format:
+//
+//	"BPS1"
+//	varint source size, varint target size, varint metadata size, metadata
+//	actions: varint (length-1)<<2 | command, followed by the command data
+//	footer: source CRC32, target CRC32, patch CRC32 (little endian)
+func applyBPS(source []byte, patch []byte) ([]byte, error) {
+	if err := checkPatchFooter(source, patch); err != nil {
+		return nil, err
+	}
+	reader := patchReader{data: patch[:len(patch)-patchFooterSize], pos: len(bpsMagic)}
+	sourceSize := reader.varint()
+	targetSize := reader.varint()
+	metadataSize := reader.varint()
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	if metadataSize > uint64(len(reader.data)-reader.pos) {
+		return nil, errors.New("unexpected end of BPS patch")
+	}
+	reader.pos += int(metadataSize) // metadata is ignored
+	if sourceSize != uint64(len(source)) {
+		return nil, errors.New(fmt.Sprintf("source size mismatch: %d bytes, expected %d", len(source), sourceSize))
+	}
+	if targetSize > maxRomSize {
+		return nil, errors.New(fmt.Sprintf("target size too big: %d bytes", targetSize))
+	}
+
+	target := make([]byte, targetSize)
+	outputOffset := 0
+	sourceRelativeOffset := 0
+	targetRelativeOffset := 0
+	for reader.pos < len(reader.data) && reader.err == nil {
+		data := reader.varint()
+		command := data & 0x03
+		if data>>2 >= uint64(len(target)-outputOffset) {
+			return nil, errors.New("BPS patch writes past the end of the target")
+		}
+		length := int(data>>2) + 1
+		switch command {
+		case bpsSourceRead:
+			if outputOffset+length > len(source) {
+				return nil, errors.New("BPS patch reads past the end of the source")
+			}
+			copy(target[outputOffset:], source[outputOffset:outputOffset+length])
+			outputOffset += length
+		case bpsTargetRead:
+			if reader.pos+length > len(reader.data) {
+				return nil, errors.New("unexpected end of BPS patch")
+			}
+			copy(target[outputOffset:], reader.data[reader.pos:reader.pos+length])
+			reader.pos += length
+			outputOffset += length
+		case bpsSourceCopy:
+			sourceRelativeOffset += reader.signedVarint()
+			if sourceRelativeOffset < 0 || sourceRelativeOffset > len(source)-length {
+				return nil, errors.New("BPS patch reads past the end of the source")
+			}
+			copy(target[outputOffset:], source[sourceRelativeOffset:sourceRelativeOffset+length])
+			sourceRelativeOffset += length
+			outputOffset += length
+		case bpsTargetCopy:
+			targetRelativeOffset += reader.signedVarint()
+			if targetRelativeOffset < 0 || targetRelativeOffset >= outputOffset {
+				return nil, errors.New("BPS patch reads past the end of the target")
+			}
+			// The regions can overlap, so it must be copied byte by byte
+			for i := 0; i < length; i++ {
+				target[outputOffset] = target[targetRelativeOffset]
+				outputOffset++
+				targetRelativeOffset++
+			}
+		}
+	}
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	return target, checkTargetCRC(target, patch)
+}
+
+// Verifies the CRC32 of the patch itself and of the source data.
+func checkPatchFooter(source []byte, patch []byte) error {
+	if len(patch) < len(upsMagic)+patchFooterSize {
+		return errors.New("patch file too small")
+	}
+	footer := patch[len(patch)-patchFooterSize:]
+	if crc := crc32.ChecksumIEEE(patch[:len(patch)-4]); crc != binary.LittleEndian.Uint32(footer[8:]) {
+		return errors.New(fmt.Sprintf("patch CRC32 mismatch: %.8X, expected %.8X", crc, binary.LittleEndian.Uint32(footer[8:])))
+	}
+	if crc := crc32.ChecksumIEEE(source); crc != binary.LittleEndian.Uint32(footer[0:]) {
+		return errors.New(fmt.Sprintf("source rom CRC32 mismatch: %.8X, expected %.8X (is it the right rom?)", crc, binary.LittleEndian.Uint32(footer[0:])))
+	}
+	return nil
+}
+
+// Verifies the CRC32 of the patched data.
+func checkTargetCRC(target []byte, patch []byte) error {
+	footer := patch[len(patch)-patchFooterSize:]
+	if crc := crc32.ChecksumIEEE(target); crc != binary.LittleEndian.Uint32(footer[4:]) {
+		return errors.New(fmt.Sprintf("patched rom CRC32 mismatch: %.8X, expected %.8X", crc, binary.LittleEndian.Uint32(footer[4:])))
+	}
+	return nil
+}
+
+// patchReader reads the variable length integers used by the UPS and BPS formats.
+// The first error is kept, and the following reads return 0.
+type patchReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *patchReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos >= len(r.data) {
+		r.err = errors.New("unexpected end of patch")
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *patchReader) varint() uint64 {
+	var value uint64
+	shift := uint64(1)
+	for {
+		x := r.byte()
+		if r.err != nil {
+			return 0
+		}
+		value += uint64(x&0x7F) * shift
+		if x&0x80 != 0 {
+			return value
+		}
+		shift <<= 7
+		value += shift
+	}
+}
+
+// The lowest bit is the sign, and the rest is the absolute value
+func (r *patchReader) signedVarint() int {
+	data := r.varint()
+	value := int(data >> 1)
+	if data&0x01 != 0 {
+		return -value
+	}
+	return value
+}
@@ -0,0 +1,251 @@
+package cartridge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+var patchSource = []byte("0123456789ABCDEF")
+
+// Encodes a number as the variable length integers of the UPS and BPS formats
+func encodeVarint(value uint64) []byte {
+	var data []byte
+	for {
+		x := byte(value & 0x7F)
+		value >>= 7
+		if value == 0 {
+			return append(data, x|0x80)
+		}
+		data = append(data, x)
+		value--
+	}
+}
+
+func encodeSignedVarint(value int) []byte {
+	if value < 0 {
+		return encodeVarint(uint64(-value)<<1 | 1)
+	}
+	return encodeVarint(uint64(value) << 1)
+}
+
+// Joins the parts of a patch, and appends the footer with the CRC32 of the source, the target and the patch
+func buildPatch(source []byte, target []byte, parts ...[]byte) []byte {
+	patch := bytes.Join(parts, nil)
+	footer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(footer[0:], crc32.ChecksumIEEE(source))
+	binary.LittleEndian.PutUint32(footer[4:], crc32.ChecksumIEEE(target))
+	patch = append(patch, footer...)
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(patch))
+	return append(patch, crc...)
+}
+
+func bpsAction(command uint64, length int) []byte {
+	return encodeVarint(uint64(length-1)<<2 | command)
+}
+
+type patchTest struct {
+	name     string
+	patch    []byte
+	expected []byte // nil if the patch must fail
+}
+
+func runPatchTests(t *testing.T, apply func(source []byte, patch []byte) ([]byte, error), tests []patchTest) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := append([]byte{}, patchSource...)
+			target, err := apply(source, test.patch)
+			if !bytes.Equal(source, patchSource) {
+				t.Errorf("the source was modified: %q", source)
+			}
+			if test.expected == nil {
+				if err == nil {
+					t.Errorf("expected an error, got %q", target)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(target, test.expected) {
+				t.Errorf("target = %q, expected %q", target, test.expected)
+			}
+		})
+	}
+}
+
+func TestPatchVarint(t *testing.T) {
+	for _, value := range []uint64{0, 1, 0x7F, 0x80, 0x407F, 0x4080, 1 << 32, 1<<63 | 5} {
+		reader := patchReader{data: encodeVarint(value)}
+		if decoded := reader.varint(); decoded != value || reader.err != nil || reader.pos != len(reader.data) {
+			t.Errorf("varint(% x) = %d (err %v), expected %d", reader.data, decoded, reader.err, value)
+		}
+	}
+	reader := patchReader{data: []byte{0x00, 0x7F}}
+	if reader.varint(); reader.err == nil {
+		t.Errorf("varint without the end bit didn't fail")
+	}
+}
+
+func TestApplyIPS(t *testing.T) {
+	runPatchTests(t, applyIPS, []patchTest{
+		{"empty", []byte("PATCHEOF"), patchSource},
+		{"record",
+			[]byte("PATCH\x00\x00\x02\x00\x03xyzEOF"),
+			[]byte("01xyz56789ABCDEF")},
+		{"rle record",
+			[]byte("PATCH\x00\x00\x04\x00\x00\x00\x05-EOF"),
+			[]byte("0123-----9ABCDEF")},
+		{"several records",
+			[]byte("PATCH\x00\x00\x00\x00\x01a\x00\x00\x0F\x00\x01zEOF"),
+			[]byte("a123456789ABCDEz")},
+		{"record past the end",
+			[]byte("PATCH\x00\x00\x12\x00\x02xyEOF"),
+			[]byte("0123456789ABCDEF\x00\x00xy")},
+		{"truncate",
+			[]byte("PATCH\x00\x00\x00\x00\x01aEOF\x00\x00\x04"),
+			[]byte("a123")},
+		{"truncate bigger than the target", []byte("PATCHEOF\x00\x01\x00"), patchSource},
+		{"EOF offset", []byte("PATCH\x45\x4F\x46"), patchSource},
+		{"missing EOF", []byte("PATCH\x00\x00\x02\x00\x03xyz"), nil},
+		{"truncated record header", []byte("PATCH\x00\x00\x02\x00"), nil},
+		{"truncated record data", []byte("PATCH\x00\x00\x02\x00\x05xyzEOF"), nil},
+		{"truncated rle record", []byte("PATCH\x00\x00\x02\x00\x00\x00\x05"), nil},
+	})
+}
+
+func TestApplyUPS(t *testing.T) {
+	target := []byte("01xyz56789ABCDEF")
+	grown := []byte("0123456789ABCDEF\x00\x00ab")
+	xor := func(a string, b string) []byte {
+		data := make([]byte, len(a))
+		for i := range data {
+			data[i] = a[i] ^ b[i]
+		}
+		return append(data, 0x00)
+	}
+	size := encodeVarint(uint64(len(patchSource)))
+
+	runPatchTests(t, applyUPS, []patchTest{
+		{"hunk",
+			buildPatch(patchSource, target, upsMagic, size, size, encodeVarint(2), xor("234", "xyz")),
+			target},
+		{"several hunks",
+			buildPatch(patchSource, []byte("a123456789ABCDEz"), upsMagic, size, size,
+				encodeVarint(0), xor("0", "a"), encodeVarint(13), xor("F", "z")),
+			[]byte("a123456789ABCDEz")},
+		{"grow",
+			buildPatch(patchSource, grown, upsMagic, size, encodeVarint(uint64(len(grown))),
+				encodeVarint(18), []byte("ab\x00")),
+			grown},
+		{"shrink",
+			buildPatch(patchSource, patchSource[:4], upsMagic, size, encodeVarint(4)),
+			patchSource[:4]},
+		{"source crc mismatch",
+			buildPatch([]byte("other"), target, upsMagic, size, size, encodeVarint(2), xor("234", "xyz")),
+			nil},
+		{"target crc mismatch",
+			buildPatch(patchSource, patchSource, upsMagic, size, size, encodeVarint(2), xor("234", "xyz")),
+			nil},
+		{"patch crc mismatch",
+			append(buildPatch(patchSource, target, upsMagic, size, size, encodeVarint(2), xor("234", "xyz"))[:20], 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0),
+			nil},
+		{"source size mismatch",
+			buildPatch(patchSource, target, upsMagic, encodeVarint(10), size, encodeVarint(2), xor("234", "xyz")),
+			nil},
+		{"huge target size",
+			buildPatch(patchSource, target, upsMagic, size, encodeVarint(1<<62), encodeVarint(2), xor("234", "xyz")),
+			nil},
+		{"target size over the limit",
+			buildPatch(patchSource, target, upsMagic, size, encodeVarint(maxRomSize+1)),
+			nil},
+		{"unterminated hunk",
+			buildPatch(patchSource, target, upsMagic, size, size, encodeVarint(2), []byte("abc")),
+			nil},
+		{"truncated header", buildPatch(patchSource, patchSource, upsMagic, []byte{0x10}), nil},
+		{"too small", []byte("UPS1"), nil},
+	})
+}
+
+func TestApplyBPS(t *testing.T) {
+	size := encodeVarint(uint64(len(patchSource)))
+	noMetadata := encodeVarint(0)
+
+	target := []byte("0123xyz789ABCDEF")
+	actions := [][]byte{
+		bpsAction(bpsSourceRead, 4),
+		bpsAction(bpsTargetRead, 3), []byte("xyz"),
+		bpsAction(bpsSourceCopy, 9), encodeSignedVarint(7),
+	}
+	valid := append([][]byte{bpsMagic, size, size, noMetadata}, actions...)
+
+	copies := []byte("CDEF0123AAAAAAAA")
+	copiesActions := [][]byte{bpsMagic, size, size, noMetadata,
+		bpsAction(bpsSourceCopy, 4), encodeSignedVarint(12),
+		bpsAction(bpsSourceCopy, 4), encodeSignedVarint(-16),
+		bpsAction(bpsTargetRead, 1), []byte("A"),
+		// Target copies can overlap the data being written
+		bpsAction(bpsTargetCopy, 7), encodeSignedVarint(8),
+	}
+
+	runPatchTests(t, applyBPS, []patchTest{
+		{"source read, target read and source copy", buildPatch(patchSource, target, valid...), target},
+		{"relative copies", buildPatch(patchSource, copies, copiesActions...), copies},
+		{"metadata",
+			buildPatch(patchSource, target, append([][]byte{bpsMagic, size, size, encodeVarint(4), []byte("meta")}, actions...)...),
+			target},
+		{"grow",
+			buildPatch(patchSource, []byte("0123456789ABCDEFab"), bpsMagic, size, encodeVarint(18), noMetadata,
+				bpsAction(bpsSourceRead, 16), bpsAction(bpsTargetRead, 2), []byte("ab")),
+			[]byte("0123456789ABCDEFab")},
+		{"source crc mismatch", buildPatch([]byte("other"), target, valid...), nil},
+		{"target crc mismatch", buildPatch(patchSource, patchSource, valid...), nil},
+		{"source size mismatch",
+			buildPatch(patchSource, target, append([][]byte{bpsMagic, encodeVarint(10), size, noMetadata}, actions...)...),
+			nil},
+		{"metadata past the end",
+			buildPatch(patchSource, target, append([][]byte{bpsMagic, size, size, encodeVarint(1 << 20)}, actions...)...),
+			nil},
+		{"metadata size overflow",
+			buildPatch(patchSource, target, append([][]byte{bpsMagic, size, size, encodeVarint(1<<63 | 5)}, actions...)...),
+			nil},
+		{"huge target size",
+			buildPatch(patchSource, target, append([][]byte{bpsMagic, size, encodeVarint(1 << 62), noMetadata}, actions...)...),
+			nil},
+		{"target size over the limit",
+			buildPatch(patchSource, target, bpsMagic, size, encodeVarint(maxRomSize+1), noMetadata),
+			nil},
+		{"write past the end of the target",
+			buildPatch(patchSource, target, bpsMagic, size, size, noMetadata, bpsAction(bpsSourceRead, 17)),
+			nil},
+		{"action length overflow",
+			buildPatch(patchSource, target, bpsMagic, size, size, noMetadata, encodeVarint(1<<63|bpsTargetRead)),
+			nil},
+		{"source read past the end of the source",
+			buildPatch(patchSource, target, bpsMagic, size, encodeVarint(18), noMetadata, bpsAction(bpsSourceRead, 17)),
+			nil},
+		{"truncated target read",
+			buildPatch(patchSource, target, bpsMagic, size, size, noMetadata, bpsAction(bpsTargetRead, 3), []byte("x")),
+			nil},
+		{"source copy before the start",
+			buildPatch(patchSource, target, bpsMagic, size, size, noMetadata, bpsAction(bpsSourceCopy, 1), encodeSignedVarint(-1)),
+			nil},
+		{"source copy past the end",
+			buildPatch(patchSource, target, bpsMagic, size, size, noMetadata, bpsAction(bpsSourceCopy, 2), encodeSignedVarint(15)),
+			nil},
+		{"source copy offset overflow",
+			buildPatch(patchSource, target, bpsMagic, size, size, noMetadata, bpsAction(bpsSourceCopy, 2), encodeVarint(1<<63-2)),
+			nil},
+		{"target copy of unwritten data",
+			buildPatch(patchSource, target, bpsMagic, size, size, noMetadata, bpsAction(bpsTargetCopy, 1), encodeSignedVarint(0)),
+			nil},
+		{"target copy before the start",
+			buildPatch(patchSource, target, bpsMagic, size, size, noMetadata,
+				bpsAction(bpsSourceRead, 4), bpsAction(bpsTargetCopy, 1), encodeSignedVarint(-1)),
+			nil},
+		{"truncated header", buildPatch(patchSource, patchSource, bpsMagic, []byte{0x10}), nil},
+		{"too small", []byte("BPS1"), nil},
+	})
+}
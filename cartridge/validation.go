@@ -0,0 +1,79 @@
+package cartridge
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lbarrios/yesSGMB/types"
+	"strings"
+)
+
+// ValidationPolicy defines what happens when the cartridge header
+// does not pass one of the checks done by the GameBoy (or by the emulator).
+type ValidationPolicy int
+
+const (
+	// ValidationStrict refuses to load the cartridge. It is the default policy.
+	ValidationStrict ValidationPolicy = iota
+	// ValidationWarn logs a warning and loads the cartridge anyway
+	ValidationWarn
+	// ValidationIgnore silently loads the cartridge
+	ValidationIgnore
+)
+
+var validationPolicyNames = map[ValidationPolicy]string{
+	ValidationStrict: "strict",
+	ValidationWarn:   "warn",
+	ValidationIgnore: "ignore",
+}
+
+// ParseValidationPolicy returns the policy for the given name (strict, warn or ignore).
+func ParseValidationPolicy(name string) (ValidationPolicy, error) {
+	for policy, policyName := range validationPolicyNames {
+		if strings.EqualFold(name, policyName) {
+			return policy, nil
+		}
+	}
+	return ValidationStrict, errors.New(fmt.Sprintf("Unknown validation policy: %s (expected strict, warn or ignore)", name))
+}
+
+func (p ValidationPolicy) String() string {
+	return validationPolicyNames[p]
+}
+
+// Applies the validation policy to the result of a check.
+// Returns an error only when the check failed and the policy is strict.
+func (c *Cartridge) validate(passed bool, message string) error {
+	if passed {
+		return nil
+	}
+	switch c.options.Validation {
+	case ValidationStrict:
+		return errors.New(message)
+	case ValidationIgnore:
+	default:
+		c.log.Printf("WARNING: %s", message)
+	}
+	return nil
+}
+
+// Computes the header checksum over the bytes 0134-014C, as it is done by the boot procedure.
+func computeHeaderChecksum(data []byte) byte {
+	var x byte
+	for _, b := range data[titleStart:headerChecksumPosition] {
+		x = x - b - 1
+	}
+	return x
+}
+
+// Computes the global checksum, the sum of all the bytes of the cartridge ROM
+// except the two checksum bytes. The GameBoy doesn't verify it.
+func computeGlobalChecksum(data []byte) types.Word {
+	var sum types.Word
+	for i, b := range data {
+		if i >= globalChecksumStart && i < globalChecksumEnd {
+			continue
+		}
+		sum += types.Word(b)
+	}
+	return sum
+}
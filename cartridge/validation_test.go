@@ -0,0 +1,116 @@
+package cartridge
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestParseValidationPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected ValidationPolicy
+		valid    bool
+	}{
+		{"strict", ValidationStrict, true},
+		{"warn", ValidationWarn, true},
+		{"ignore", ValidationIgnore, true},
+		{"STRICT", ValidationStrict, true},
+		{"Warn", ValidationWarn, true},
+		{"", ValidationStrict, false},
+		{"none", ValidationStrict, false},
+		{"warning", ValidationStrict, false},
+	}
+	for _, test := range tests {
+		policy, err := ParseValidationPolicy(test.name)
+		if test.valid && err != nil {
+			t.Errorf("ParseValidationPolicy(%q): unexpected error %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("ParseValidationPolicy(%q): expected an error", test.name)
+		}
+		if policy != test.expected {
+			t.Errorf("ParseValidationPolicy(%q) = %s, expected %s", test.name, policy, test.expected)
+		}
+	}
+}
+
+func TestValidationPolicyDefaultIsStrict(t *testing.T) {
+	if (Options{}).Validation != ValidationStrict {
+		t.Errorf("The zero value of Options should be strict, got %s", Options{}.Validation)
+	}
+}
+
+// Builds a 32KB ROM only cartridge with a valid header
+func newTestROM() []byte {
+	data := make([]byte, romSizeForBanks(0))
+	copy(data[nintendoLogoStart:nintendoLogoEnd], originalNintendoLogo)
+	copy(data[titleStart:titleEnd], "TEST")
+	data[typePosition] = MBC_ROMONLY
+	data[0x0150] = 0x42
+	fixHeaderChecksum(data)
+	fixGlobalChecksum(data)
+	return data
+}
+
+func fixHeaderChecksum(data []byte) {
+	data[headerChecksumPosition] = computeHeaderChecksum(data)
+}
+
+func fixGlobalChecksum(data []byte) {
+	checksum := computeGlobalChecksum(data)
+	data[globalChecksumStart] = checksum.High()
+	data[globalChecksumStart+1] = checksum.Low()
+}
+
+func TestValidationPolicies(t *testing.T) {
+	checks := []struct {
+		name    string
+		corrupt func(data []byte)
+	}{
+		{"none", func(data []byte) {}},
+		{"logo", func(data []byte) {
+			data[nintendoLogoStart+0x10] ^= 0xFF
+			fixGlobalChecksum(data)
+		}},
+		{"cgb only", func(data []byte) {
+			data[colorFlagPosition] = cgbOnlyColorFlag
+			fixHeaderChecksum(data)
+			fixGlobalChecksum(data)
+		}},
+		{"header checksum", func(data []byte) {
+			data[headerChecksumPosition]++
+			fixGlobalChecksum(data)
+		}},
+		{"global checksum", func(data []byte) {
+			data[globalChecksumStart+1]++
+		}},
+	}
+	for _, check := range checks {
+		for _, policy := range []ValidationPolicy{ValidationStrict, ValidationWarn, ValidationIgnore} {
+			data := newTestROM()
+			check.corrupt(data)
+
+			var output bytes.Buffer
+			l := newTestLogger()
+			l.Log = log.New(&output, "", 0)
+			c := &Cartridge{data: data, options: Options{Validation: policy}, log: *l}
+			err := c.ParseHeader()
+			warned := strings.Contains(output.String(), "WARNING")
+
+			failed := check.name != "none"
+			expectError := failed && policy == ValidationStrict
+			expectWarning := failed && policy == ValidationWarn
+			if expectError && err == nil {
+				t.Errorf("%s check, %s policy: expected an error", check.name, policy)
+			}
+			if !expectError && err != nil {
+				t.Errorf("%s check, %s policy: unexpected error %s", check.name, policy, err)
+			}
+			if warned != expectWarning {
+				t.Errorf("%s check, %s policy: warning logged = %t, expected %t", check.name, policy, warned, expectWarning)
+			}
+		}
+	}
+}
@@ -19,10 +19,12 @@ type clock struct {
 	mutex       sync.Mutex
 	peripherals map[string]chan uint64
 	wg          sync.WaitGroup
+	stopped     bool
 }
 
 type Clock interface {
 	DisconnectPeripheral(peripheral Peripheral)
+	Stop()
 }
 
 func NewClock(l *logger.Logger) *clock {
@@ -49,9 +51,28 @@ func (c *clock) DisconnectPeripheral(p Peripheral) {
 	c.mutex.Unlock()
 }
 
+// Stop stops the clock. The connected peripherals are notified by closing their channels,
+// so they can finish their execution.
+func (c *clock) Stop() {
+	c.mutex.Lock()
+	c.stopped = true
+	c.mutex.Unlock()
+}
+
 func (c *clock) Run(wg *sync.WaitGroup) {
 	c.log.Println("Clock started.")
 	for {
+		c.mutex.Lock()
+		stopped := c.stopped
+		c.mutex.Unlock()
+		if stopped {
+			c.log.Println("Clock stopped.")
+			for _, p := range c.peripherals {
+				close(p)
+			}
+			break
+		}
+
 		c.step()
 		for _, p := range c.peripherals {
 			c.wg.Add(1)
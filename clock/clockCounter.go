@@ -17,13 +17,19 @@ func (c *ClockCounter) Init(wg *sync.WaitGroup, channel chan uint64, clock Clock
 	c.Clock = clock
 }
 
-func (c *ClockCounter) WaitNextCycle() {
+// WaitNextCycle blocks until the clock reaches the cycles of the peripheral.
+// It returns false if the clock was stopped.
+func (c *ClockCounter) WaitNextCycle() bool {
 	for {
 		if c.Cycles <= c.ClockCycles {
-			return
+			return true
 		}
 		c.Wg.Done()
-		c.ClockCycles = <-c.Channel
+		clockCycles, ok := <-c.Channel
+		if !ok {
+			return false
+		}
+		c.ClockCycles = clockCycles
 	}
 }
 
@@ -3,19 +3,24 @@ package cpu
 
 import (
 	"github.com/lbarrios/yesSGMB/clock"
+	"github.com/lbarrios/yesSGMB/joypad"
 	"github.com/lbarrios/yesSGMB/logger"
 	"github.com/lbarrios/yesSGMB/mmu"
 	"github.com/lbarrios/yesSGMB/types"
 	"sync"
-	"github.com/lbarrios/yesSGMB/gpu"
-	"log"
 )
 
+// While sleeping in HALT or STOP mode, the CPU checks its wake up condition every machine cycle
+const sleepCycles = 4
+
 type cpu struct {
 	r                 Registers
 	mmu               mmu.MMU
 	interruptsEnabled bool
-	halted            bool
+	eiDelay           int  // instructions left until EI takes effect
+	halted            bool // HALT: sleeping until an interrupt is pending
+	haltBug           bool // HALT with IME=0 and a pending interrupt: the next byte is read twice
+	stopped           bool // STOP: sleeping until a button is pressed
 	log               logger.Logger
 	clock             clock.ClockCounter
 }
@@ -40,12 +45,26 @@ func (cpu *cpu) GetName() string {
 
 func (cpu *cpu) Reset() {
 	cpu.log.Println("CPU reset triggered.")
+
+	// With a boot rom, the execution starts at 0x0000 and the boot procedure
+	// initializes the registers and the IO ports by itself
+	if cpu.mmu.BootROMEnabled() {
+		cpu.r = Registers{}
+		cpu.interruptsEnabled = false
+		cpu.eiDelay = 0
+		cpu.halted = false
+		cpu.haltBug = false
+		cpu.stopped = false
+		return
+	}
+
+	// Otherwise, the state after the boot procedure is set directly
 	cpu.r.pc = 0x0100 // On power up, the GameBoy Program Counter is initialized to 0x0100
 	cpu.r.sp = 0xFFFE // On power up, the GameBoy Stack Pointer is initialized to 0xFFFE
 
 	// After power up, on GameBoy, AF = 0x01B0 = 0000 0001 1011 0000
 	cpu.r.af.a = 0x01
-	cpu.r.af.f = Flags{true, false, true, true, false, false, false, false}
+	cpu.r.af.f.loadByte(0xB0)
 	cpu.r.bc.b = 0x00
 	cpu.r.bc.c = 0x13
 	cpu.r.de.d = 0x00
@@ -87,52 +106,68 @@ func (cpu *cpu) Reset() {
 	cpu.mmu.WriteByte(types.Address{High: 0xFF, Low: 0xFF}, 0x00) // IE
 
 	cpu.interruptsEnabled = true
+	cpu.eiDelay = 0
+	cpu.halted = false
+	cpu.haltBug = false
+	cpu.stopped = false
 }
 
 func (cpu *cpu) Stop() {
-	// TODO: to implement
 	cpu.Reset()
 }
 
 func (cpu *cpu) Step() {
+	if cpu.sleeping() {
+		return
+	}
 	cpu.checkInterrupts()
 	op := cpu.fetch()
 	instr := cpu.decode(op)
 	cycles := cpu.execute(instr)
 	cpu.clock.Cycles += uint64(cycles)
+	cpu.updateEIDelay()
 }
 
-func (cpu *cpu) checkInterrupts() bool {
-	if !cpu.interruptsEnabled {
-		return false
-	}
-
-	interruptEnable := cpu.mmu.ReadByte(mmu.INTERRUPT_ENABLE_REGISTER.AsAddress())
-	interruptFlag := cpu.mmu.ReadByte(mmu.INTERRUPT_FLAG_ADDR.AsAddress())
-	interrupt := interruptFlag & interruptEnable
-
-	if interrupt == 0x00 {
-		return false
-	}
-
-	// Disable the interrupt, then push the current PC to stack
-	// and jump to the corresponding interruption handler
+// Returns true while the CPU is in HALT or STOP mode, advancing the clock meanwhile.
+func (cpu *cpu) sleeping() bool {
 	switch {
-	case interrupt&gpu.VBLANK_IRQ == gpu.VBLANK_IRQ:
-		cpu.mmu.WriteByte(mmu.INTERRUPT_FLAG_ADDR.AsAddress(), interruptFlag^gpu.VBLANK_IRQ)
-		cpu.jumpToInterruptHandler(V_BLANK_IR_ADDR)
-		cpu.interruptsEnabled = false
-	default:
-		log.Fatalf("Can't recognize interrupt %.2x", interrupt)
-		return false
+	case cpu.stopped:
+		// STOP mode is exited when any of the selected P10-P13 input lines goes low
+		if cpu.mmu.ReadByte(joypad.P1_ADDRESS.AsAddress())&joypad.P1_INPUT_MASK == joypad.P1_INPUT_MASK {
+			cpu.clock.Cycles += sleepCycles
+			return true
+		}
+		cpu.stopped = false
+	case cpu.halted:
+		// HALT mode is exited when there is a pending interrupt, even if the interrupts are disabled
+		// (in that case, the execution continues after the HALT without servicing it)
+		if cpu.mmu.PendingInterrupts() == 0 {
+			cpu.clock.Cycles += sleepCycles
+			return true
+		}
+		cpu.halted = false
 	}
+	return false
+}
 
-	return true
+// EI enables the interrupts after the instruction that follows it.
+func (cpu *cpu) updateEIDelay() {
+	if cpu.eiDelay > 0 {
+		cpu.eiDelay--
+		if cpu.eiDelay == 0 {
+			cpu.interruptsEnabled = true
+		}
+	}
 }
 
 func (cpu *cpu) fetch() byte {
 	address := types.Address{High: cpu.r.pc.High(), Low: cpu.r.pc.Low()}
 	opcode := cpu.mmu.ReadByte(address)
+	if cpu.haltBug {
+		// The PC fails to be incremented, so the byte after HALT is read twice
+		cpu.haltBug = false
+		return opcode
+	}
 	cpu.r.pc++
 	return opcode
 }
@@ -150,22 +185,11 @@ func (cpu *cpu) execute(instr instruction) cycleCount {
 func (cpu *cpu) Run(wg *sync.WaitGroup) {
 	cpu.log.Println("CPU started.")
 	for {
-		cpu.clock.WaitNextCycle()
-
-		cpu.Step()
-		if cpu.clock.Cycles >= 10000000 { //if cpu.r.pc == 0x02b2 {
-			cpu.log.Println("\033[1;31mBreakpoint at 0x02b2.")
-			cpu.StepDebug()
-			cpu.StepDebug()
-			cpu.log.Println("writing 0xff to 0xff40 (this will stop the GPU)")
-			cpu.mmu.WriteByte(types.Address{0xff, 0x40}, 0xff)
-			cpu.log.Println("writing 0xff to 0xff07 (this will stop the timer)")
-			cpu.mmu.WriteByte(types.Address{0xff, 0x07}, 0xff)
-			cpu.clock.Disconnect(cpu)
-			a := cpu.mmu.ReadByte(types.Address{0x80, 0x00})
-			cpu.log.Println(a)
+		if !cpu.clock.WaitNextCycle() {
 			break
 		}
+
+		cpu.Step()
 	}
 	wg.Done()
 }
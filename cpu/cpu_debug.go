@@ -6,6 +6,10 @@ import (
 
 func (cpu *cpu) StepDebug() {
 	cpu.log.Println(cpu.r)
+	if cpu.sleeping() {
+		cpu.log.Println("sleeping (halted or stopped)")
+		return
+	}
 	interrupts := cpu.checkInterrupts()
 	if interrupts {
 		cpu.log.Println("there are interruptions!")
@@ -15,6 +19,7 @@ func (cpu *cpu) StepDebug() {
 	instr := cpu.decodeDebug(op)
 	cycles := cpu.executeDebug(instr)
 	cpu.clock.Cycles += uint64(cycles)
+	cpu.updateEIDelay()
 	cpu.log.Println(cpu.r)
 	cpu.log.Println("")
 }
@@ -23,6 +28,11 @@ func (cpu *cpu) fetchDebug() byte {
 	address := types.Address{High: cpu.r.pc.High(), Low: cpu.r.pc.Low()}
 	opcode := cpu.mmu.ReadByte(address)
 	cpu.log.Printf("%d: fetch(\033[1;31m0x%.2x%.2x\033[0;34m) = 0x%.4x.", cpu.clock.Cycles, cpu.r.pc.High(), cpu.r.pc.Low(), opcode)
+	if cpu.haltBug {
+		cpu.log.Println("halt bug: the PC is not incremented")
+		cpu.haltBug = false
+		return opcode
+	}
 	cpu.r.pc++
 	return opcode
 }
@@ -0,0 +1,219 @@
+package cpu
+
+import (
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/mmu"
+	"github.com/lbarrios/yesSGMB/timer"
+	"github.com/lbarrios/yesSGMB/types"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+const (
+	testProgramStart = types.Word(0xC000) // the programs are run from the internal ram
+	testMemHl        = types.Word(0xC100) // address used by the (HL) operands
+	testIFAddress    = types.Word(0xFF0F)
+	testIEAddress    = types.Word(0xFFFF)
+)
+
+// testMMU is a flat memory, with the interrupt registers at their usual addresses.
+// Peripherals can be mapped to the IO register addresses.
+type testMMU struct {
+	memory    [0x10000]byte
+	registers map[types.Word]mmu.IORegister
+}
+
+func (m *testMMU) ReadByte(address types.Address) byte {
+	if register, ok := m.registers[address.AsWord()]; ok {
+		return register.ReadRegister(address)
+	}
+	return m.memory[address.AsWord()]
+}
+
+func (m *testMMU) WriteByte(address types.Address, value byte) {
+	if register, ok := m.registers[address.AsWord()]; ok {
+		register.WriteRegister(address, value)
+		return
+	}
+	m.memory[address.AsWord()] = value
+}
+
+func (m *testMMU) MapRegister(register mmu.IORegister, address types.Word) {
+	if m.registers == nil {
+		m.registers = make(map[types.Word]mmu.IORegister)
+	}
+	m.registers[address] = register
+}
+
+func (m *testMMU) RequestInterrupt(interrupt byte) {
+	m.memory[testIFAddress] |= interrupt
+}
+
+func (m *testMMU) BootROMEnabled() bool {
+	return false
+}
+
+func (m *testMMU) PendingInterrupts() byte {
+	return m.memory[testIFAddress] & m.memory[testIEAddress] & mmu.INTERRUPTS_MASK
+}
+
+func (m *testMMU) AcknowledgeInterrupt(interrupt byte) {
+	m.memory[testIFAddress] &^= interrupt
+}
+
+func newTestLogger() *logger.Logger {
+	l := new(logger.Logger)
+	l.Init()
+	l.Log = log.New(ioutil.Discard, "", 0)
+	return l
+}
+
+// Returns a CPU in the state after the boot procedure, ready to run the program
+func newTestCPU(program ...byte) (*cpu, *testMMU) {
+	m := new(testMMU)
+	cpu := NewCPU(m, newTestLogger())
+	cpu.load(m, program...)
+	return cpu, m
+}
+
+func (cpu *cpu) load(m *testMMU, program ...byte) {
+	copy(m.memory[testProgramStart:], program)
+	cpu.r.pc = testProgramStart
+}
+
+// Enables the interrupt and sets it as pending
+func (m *testMMU) raiseInterrupt(interrupt byte) {
+	m.memory[testIEAddress] |= interrupt
+	m.RequestInterrupt(interrupt)
+}
+
+// Returns the word at the top of the stack
+func (cpu *cpu) stackTop(m *testMMU) types.Word {
+	return types.Word(m.memory[cpu.r.sp+1])<<8 | types.Word(m.memory[cpu.r.sp])
+}
+
+func TestEIDelay(t *testing.T) {
+	// EI; NOP; NOP
+	cpu, m := newTestCPU(0xFB, 0x00, 0x00)
+	cpu.interruptsEnabled = false
+	m.raiseInterrupt(mmu.VBLANK_INTERRUPT)
+
+	// The interrupts are not enabled by EI, nor during the next instruction
+	cpu.Step()
+	if cpu.r.pc != testProgramStart+1 || cpu.interruptsEnabled {
+		t.Fatalf("after EI: PC=0x%.4x IME=%t, expected PC=0x%.4x IME=false", cpu.r.pc, cpu.interruptsEnabled, testProgramStart+1)
+	}
+	cpu.Step()
+	if cpu.r.pc != testProgramStart+2 || !cpu.interruptsEnabled {
+		t.Fatalf("after the instruction following EI: PC=0x%.4x IME=%t, expected PC=0x%.4x IME=true", cpu.r.pc, cpu.interruptsEnabled, testProgramStart+2)
+	}
+
+	// The interrupt is serviced before the second NOP, and the handler's first instruction (a NOP) is run
+	cpu.Step()
+	if cpu.r.pc != V_BLANK_IR_ADDR+1 || cpu.stackTop(m) != testProgramStart+2 {
+		t.Errorf("after the interrupt: PC=0x%.4x return address=0x%.4x, expected PC=0x%.4x return address=0x%.4x",
+			cpu.r.pc, cpu.stackTop(m), V_BLANK_IR_ADDR+1, testProgramStart+2)
+	}
+	if cpu.interruptsEnabled || m.memory[testIFAddress]&mmu.VBLANK_INTERRUPT != 0 {
+		t.Errorf("after the interrupt: IME=%t IF=0x%.2x, expected the interrupts disabled and the interrupt acknowledged",
+			cpu.interruptsEnabled, m.memory[testIFAddress])
+	}
+}
+
+func TestEIFollowedByDI(t *testing.T) {
+	// EI; DI; NOP
+	cpu, m := newTestCPU(0xFB, 0xF3, 0x00)
+	cpu.interruptsEnabled = false
+	m.raiseInterrupt(mmu.VBLANK_INTERRUPT)
+	for i := 0; i < 3; i++ {
+		cpu.Step()
+	}
+	if cpu.r.pc != testProgramStart+3 || cpu.interruptsEnabled {
+		t.Errorf("after EI; DI; NOP: PC=0x%.4x IME=%t, expected PC=0x%.4x IME=false", cpu.r.pc, cpu.interruptsEnabled, testProgramStart+3)
+	}
+}
+
+func TestHaltBug(t *testing.T) {
+	// HALT; INC A; NOP
+	cpu, m := newTestCPU(0x76, 0x3C, 0x00)
+	cpu.interruptsEnabled = false
+	cpu.r.af.a = 0x10
+	m.raiseInterrupt(mmu.TIMER_INTERRUPT)
+
+	// With the interrupts disabled and one already pending, the CPU doesn't halt,
+	// and the byte after HALT is read twice
+	cpu.Step()
+	if cpu.halted {
+		t.Fatalf("the CPU halted with an interrupt pending")
+	}
+	cpu.Step()
+	cpu.Step()
+	if cpu.r.af.a != 0x12 || cpu.r.pc != testProgramStart+2 {
+		t.Errorf("after HALT; INC A: A=0x%.2x PC=0x%.4x, expected A=0x12 PC=0x%.4x", cpu.r.af.a, cpu.r.pc, testProgramStart+2)
+	}
+	if m.memory[testIFAddress]&mmu.TIMER_INTERRUPT == 0 {
+		t.Errorf("the interrupt was acknowledged with the interrupts disabled")
+	}
+}
+
+func TestHaltWithInterruptsDisabled(t *testing.T) {
+	// HALT; INC A; NOP
+	cpu, m := newTestCPU(0x76, 0x3C, 0x00)
+	cpu.interruptsEnabled = false
+	cpu.r.af.a = 0x10
+	m.memory[testIEAddress] = mmu.TIMER_INTERRUPT
+
+	cpu.Step()
+	cpu.Step()
+	if !cpu.halted || cpu.r.pc != testProgramStart+1 {
+		t.Fatalf("after HALT: halted=%t PC=0x%.4x, expected halted at PC=0x%.4x", cpu.halted, cpu.r.pc, testProgramStart+1)
+	}
+
+	// A pending interrupt wakes it up, and the execution continues after HALT without servicing it
+	m.RequestInterrupt(mmu.TIMER_INTERRUPT)
+	cpu.Step()
+	if cpu.halted || cpu.r.af.a != 0x11 || cpu.r.pc != testProgramStart+2 {
+		t.Errorf("after waking up: halted=%t A=0x%.2x PC=0x%.4x, expected A=0x11 PC=0x%.4x",
+			cpu.halted, cpu.r.af.a, cpu.r.pc, testProgramStart+2)
+	}
+}
+
+func TestHaltWithInterruptsEnabled(t *testing.T) {
+	// HALT; INC A
+	cpu, m := newTestCPU(0x76, 0x3C)
+	cpu.interruptsEnabled = true
+	m.memory[testIEAddress] = mmu.TIMER_INTERRUPT
+
+	cpu.Step()
+	cpu.Step()
+	if !cpu.halted {
+		t.Fatalf("the CPU didn't halt")
+	}
+
+	m.RequestInterrupt(mmu.TIMER_INTERRUPT)
+	cpu.Step()
+	if cpu.halted || cpu.r.pc != TIMER_OVERFLOW_IR_ADDR+1 || cpu.stackTop(m) != testProgramStart+1 {
+		t.Errorf("after waking up: halted=%t PC=0x%.4x return address=0x%.4x, expected PC=0x%.4x return address=0x%.4x",
+			cpu.halted, cpu.r.pc, cpu.stackTop(m), TIMER_OVERFLOW_IR_ADDR+1, testProgramStart+1)
+	}
+}
+
+func TestStopResetsDivider(t *testing.T) {
+	// STOP 00
+	cpu, m := newTestCPU(0x10, 0x00)
+	Timer := timer.NewTimer(m, newTestLogger())
+	m.MapRegister(Timer, timer.DIV_ADDRESS)
+	Timer.Reset(false)
+	if div := m.ReadByte(timer.DIV_ADDRESS.AsAddress()); div == 0 {
+		t.Fatalf("DIV is 0 before STOP")
+	}
+
+	cpu.Step()
+	if div := m.ReadByte(timer.DIV_ADDRESS.AsAddress()); div != 0 {
+		t.Errorf("DIV after STOP = 0x%.2x, expected 0", div)
+	}
+	if !cpu.stopped || cpu.r.pc != testProgramStart+2 {
+		t.Errorf("after STOP: stopped=%t PC=0x%.4x, expected stopped at PC=0x%.4x", cpu.stopped, cpu.r.pc, testProgramStart+2)
+	}
+}
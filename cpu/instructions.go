@@ -1,6 +1,7 @@
 package cpu
 
 import (
+	"github.com/lbarrios/yesSGMB/timer"
 	"github.com/lbarrios/yesSGMB/types"
 )
 
@@ -1279,17 +1280,22 @@ func ldSpHl(cpu *cpu) cycleCount {
 // 		H - Set or reset according to operation.
 // 		C - Set or reset according to operation.
 
+// Returns SP + n, with n a signed immediate value. It is shared by LDHL SP,n and ADD SP,n.
+// The flags are set from the unsigned addition of n to the low byte of SP.
+func spPlusN(cpu *cpu) types.Word {
+	n := cpu.fetch()
+	cpu.r.setFlagZ(false)
+	cpu.r.setFlagN(false)
+	cpu.r.setFlagH(lowNibble(cpu.r.sp.Low())+lowNibble(n) > 0x0F)
+	cpu.r.setFlagC(uint16(cpu.r.sp.Low())+uint16(n) > 0xFF)
+	return cpu.r.sp + types.Word(int8(n))
+}
+
 func ldHlSpN(cpu *cpu) cycleCount {
 	// Put the value addressed by Stack Pointer (SP) + N, into register HL
-	oldHl := cpu.r.hlAsWord()
-	n := cpu.fetch()
-	hl := cpu.r.sp + types.Word(n)
+	hl := spPlusN(cpu)
 	cpu.r.hl.h = hl.High()
 	cpu.r.hl.l = hl.Low()
-	cpu.r.setFlagZ(false)
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((oldHl & 0xF) > (hl & 0xF))
-	cpu.r.setFlagC((oldHl & 0xFF) > (hl & 0xFF))
 	return ldHlSpNCycles
 }
 
@@ -1562,85 +1568,60 @@ func addAN(cpu *cpu) cycleCount {
 // 		ADC 			A,(HL) 			8E 			8
 // 		ADC 			A,# 			CE 			8
 
+// Add n + Carry flag to register A
+func adc(cpu *cpu, n byte) {
+	carry := cpu.r.flagAsByte(cpu.r.af.f.c)
+	result := uint16(cpu.r.af.a) + uint16(n) + uint16(carry)
+	cpu.r.setFlagZ(byte(result) == 0)
+	cpu.r.setFlagN(false)
+	cpu.r.setFlagH(lowNibble(cpu.r.af.a)+lowNibble(n)+carry > 0x0F)
+	cpu.r.setFlagC(result > 0xFF)
+	cpu.r.af.a = byte(result)
+}
+
 func adcAA(cpu *cpu) cycleCount {
 	// Add (A+Carry) into register A.
-	oldA := cpu.r.af.a
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((oldA & 0x0F) < (cpu.r.af.a & 0x0F))
-	cpu.r.setFlagC(oldA < cpu.r.af.a)
+	adc(cpu, cpu.r.af.a)
 	return adcAACycles
 }
 func adcAB(cpu *cpu) cycleCount {
 	// Add (B+Carry) into register A.
-	oldA := cpu.r.af.a
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((oldA & 0x0F) < (cpu.r.af.a & 0x0F))
-	cpu.r.setFlagC(oldA < cpu.r.af.a)
+	adc(cpu, cpu.r.bc.b)
 	return adcABCycles
 }
 func adcAC(cpu *cpu) cycleCount {
 	// Add (C+Carry) into register A.
-	oldA := cpu.r.af.a
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((oldA & 0x0F) < (cpu.r.af.a & 0x0F))
-	cpu.r.setFlagC(oldA < cpu.r.af.a)
+	adc(cpu, cpu.r.bc.c)
 	return adcACCycles
 }
 func adcAD(cpu *cpu) cycleCount {
 	// Add (D+Carry) into register A.
-	oldA := cpu.r.af.a
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((oldA & 0x0F) < (cpu.r.af.a & 0x0F))
-	cpu.r.setFlagC(oldA < cpu.r.af.a)
+	adc(cpu, cpu.r.de.d)
 	return adcADCycles
 }
 func adcAE(cpu *cpu) cycleCount {
 	// Add (E+Carry) into register A.
-	oldA := cpu.r.af.a
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((oldA & 0x0F) < (cpu.r.af.a & 0x0F))
-	cpu.r.setFlagC(oldA < cpu.r.af.a)
+	adc(cpu, cpu.r.de.e)
 	return adcAECycles
 }
 func adcAH(cpu *cpu) cycleCount {
 	// Add (H+Carry) into register A.
-	oldA := cpu.r.af.a
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((oldA & 0x0F) < (cpu.r.af.a & 0x0F))
-	cpu.r.setFlagC(oldA < cpu.r.af.a)
+	adc(cpu, cpu.r.hl.h)
 	return adcAHCycles
 }
 func adcAL(cpu *cpu) cycleCount {
 	// Add (L+Carry) into register A.
-	oldA := cpu.r.af.a
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((oldA & 0x0F) < (cpu.r.af.a & 0x0F))
-	cpu.r.setFlagC(oldA < cpu.r.af.a)
+	adc(cpu, cpu.r.hl.l)
 	return adcALCycles
 }
 func adcAMemHl(cpu *cpu) cycleCount {
 	// Add (MemHl+Carry) into register A.
-	oldA := cpu.r.af.a
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((oldA & 0x0F) < (cpu.r.af.a & 0x0F))
-	cpu.r.setFlagC(oldA < cpu.r.af.a)
+	adc(cpu, cpu.mmu.ReadByte(cpu.r.hlAsAddress()))
 	return adcAMemHlCycles
 }
 func adcANn(cpu *cpu) cycleCount {
 	// Add (Nn+Carry) into register A.
-	oldA := cpu.r.af.a
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((oldA & 0x0F) < (cpu.r.af.a & 0x0F))
-	cpu.r.setFlagC(oldA < cpu.r.af.a)
+	adc(cpu, cpu.fetch())
 	return adcANnCycles
 }
 
@@ -1666,103 +1647,67 @@ func adcANn(cpu *cpu) cycleCount {
 // 		SUB				A, (HL)			96			8
 // 		SUB				A, #			D6			8
 
+// Returns A - (n + carry), setting the flags. It is shared by SUB, SBC and CP.
+func subtract(cpu *cpu, n byte, carry byte) byte {
+	result := int(cpu.r.af.a) - int(n) - int(carry)
+	cpu.r.setFlagZ(byte(result) == 0)
+	cpu.r.setFlagN(true)
+	cpu.r.setFlagH(int(lowNibble(cpu.r.af.a))-int(lowNibble(n))-int(carry) < 0)
+	cpu.r.setFlagC(result < 0)
+	return byte(result)
+}
+
 func subAA(cpu *cpu) cycleCount {
 	// Subtract the value of register A to register A
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.af.a
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA & 0xf) > (cpu.r.af.a & 0xf))
-	cpu.r.setFlagC(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.r.af.a, 0)
 	return subAACycles
 }
 
 func subAB(cpu *cpu) cycleCount {
-	// Subtract the value of register A to register B
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.bc.b
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA & 0xf) > (cpu.r.af.a & 0xf))
-	cpu.r.setFlagC(oldA > cpu.r.af.a)
+	// Subtract the value of register B to register A
+	cpu.r.af.a = subtract(cpu, cpu.r.bc.b, 0)
 	return subABCycles
 }
 
 func subAC(cpu *cpu) cycleCount {
 	// Subtract the value of register C to register A
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.bc.c
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA & 0xf) > (cpu.r.af.a & 0xf))
-	cpu.r.setFlagC(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.r.bc.c, 0)
 	return subACCycles
 }
 
 func subAD(cpu *cpu) cycleCount {
 	// Subtract the value of register D to register A
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.de.d
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA & 0xf) > (cpu.r.af.a & 0xf))
-	cpu.r.setFlagC(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.r.de.d, 0)
 	return subADCycles
 }
 
 func subAE(cpu *cpu) cycleCount {
 	// Subtract the value of register E to register A
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.de.e
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA & 0xf) > (cpu.r.af.a & 0xf))
-	cpu.r.setFlagC(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.r.de.e, 0)
 	return subAECycles
 }
 
 func subAH(cpu *cpu) cycleCount {
 	// Subtract the value of register H to register A
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.hl.h
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA & 0xf) > (cpu.r.af.a & 0xf))
-	cpu.r.setFlagC(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.r.hl.h, 0)
 	return subAHCycles
 }
 
 func subAL(cpu *cpu) cycleCount {
 	// Subtract the value of register L to register A
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.hl.l
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA & 0xf) > (cpu.r.af.a & 0xf))
-	cpu.r.setFlagC(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.r.hl.l, 0)
 	return subALCycles
 }
 
 func subAMemHl(cpu *cpu) cycleCount {
-	// Subtract the value of the memory pointed by register HL to register A
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.mmu.ReadByte(cpu.r.hlAsAddress())
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA & 0xf) > (cpu.r.af.a & 0xf))
-	cpu.r.setFlagC(oldA > cpu.r.af.a)
+	// Subtract the value of memory pointed by HL to register A
+	cpu.r.af.a = subtract(cpu, cpu.mmu.ReadByte(cpu.r.hlAsAddress()), 0)
 	return subAMemHlCycles
 }
 
 func subAN(cpu *cpu) cycleCount {
 	// Subtract the value of the immediate value NN to register A
-	n := cpu.fetch()
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= n
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA & 0xf) > (cpu.r.af.a & 0xf))
-	cpu.r.setFlagC(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.fetch(), 0)
 	return subANnCycles
 }
 
@@ -1790,110 +1735,55 @@ func subAN(cpu *cpu) cycleCount {
 
 func sbcAA(cpu *cpu) cycleCount {
 	// Subtract from register A the value of register A plus carry flag
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.af.a
-	cpu.r.af.a -= cpu.r.flagAsByte(cpu.r.af.f.c)
-	cpu.r.setFlagC(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA >> 4) > (cpu.r.af.a >> 4))
-	cpu.r.setFlagZ(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.r.af.a, cpu.r.flagAsByte(cpu.r.af.f.c))
 	return sbcAACycles
 }
 
 func sbcAB(cpu *cpu) cycleCount {
 	// Subtract from register A the value of register B plus carry flag
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.bc.b
-	cpu.r.af.a -= cpu.r.flagAsByte(cpu.r.af.f.c)
-	cpu.r.setFlagC(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA >> 4) > (cpu.r.af.a >> 4))
-	cpu.r.setFlagZ(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.r.bc.b, cpu.r.flagAsByte(cpu.r.af.f.c))
 	return sbcABCycles
 }
 
 func sbcAC(cpu *cpu) cycleCount {
 	// Subtract from register A the value of register C plus carry flag
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.bc.c
-	cpu.r.af.a -= cpu.r.flagAsByte(cpu.r.af.f.c)
-	cpu.r.setFlagC(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA >> 4) > (cpu.r.af.a >> 4))
-	cpu.r.setFlagZ(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.r.bc.c, cpu.r.flagAsByte(cpu.r.af.f.c))
 	return sbcACCycles
 }
 
 func sbcAD(cpu *cpu) cycleCount {
 	// Subtract from register A the value of register D plus carry flag
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.de.d
-	cpu.r.af.a -= cpu.r.flagAsByte(cpu.r.af.f.c)
-	cpu.r.setFlagC(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA >> 4) > (cpu.r.af.a >> 4))
-	cpu.r.setFlagZ(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.r.de.d, cpu.r.flagAsByte(cpu.r.af.f.c))
 	return sbcADCycles
 }
 
 func sbcAE(cpu *cpu) cycleCount {
 	// Subtract from register A the value of register E plus carry flag
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.de.e
-	cpu.r.af.a -= cpu.r.flagAsByte(cpu.r.af.f.c)
-	cpu.r.setFlagC(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA >> 4) > (cpu.r.af.a >> 4))
-	cpu.r.setFlagZ(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.r.de.e, cpu.r.flagAsByte(cpu.r.af.f.c))
 	return sbcAECycles
 }
 
 func sbcAH(cpu *cpu) cycleCount {
 	// Subtract from register A the value of register H plus carry flag
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.hl.h
-	cpu.r.af.a -= cpu.r.flagAsByte(cpu.r.af.f.c)
-	cpu.r.setFlagC(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA >> 4) > (cpu.r.af.a >> 4))
-	cpu.r.setFlagZ(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.r.hl.h, cpu.r.flagAsByte(cpu.r.af.f.c))
 	return sbcAHCycles
 }
 
 func sbcAL(cpu *cpu) cycleCount {
 	// Subtract from register A the value of register L plus carry flag
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.r.hl.l
-	cpu.r.af.a -= cpu.r.flagAsByte(cpu.r.af.f.c)
-	cpu.r.setFlagC(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA >> 4) > (cpu.r.af.a >> 4))
-	cpu.r.setFlagZ(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.r.hl.l, cpu.r.flagAsByte(cpu.r.af.f.c))
 	return sbcALCycles
 }
 
 func sbcAMemHl(cpu *cpu) cycleCount {
 	// Subtract from register A, the value of memory pointed by HL plus carry flag
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= cpu.mmu.ReadByte(cpu.r.hlAsAddress())
-	cpu.r.af.a -= cpu.r.flagAsByte(cpu.r.af.f.c)
-	cpu.r.setFlagC(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA >> 4) > (cpu.r.af.a >> 4))
-	cpu.r.setFlagZ(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.mmu.ReadByte(cpu.r.hlAsAddress()), cpu.r.flagAsByte(cpu.r.af.f.c))
 	return sbcAMemHlCycles
 }
 
 func sbcAN(cpu *cpu) cycleCount {
 	// Subtract from register A, the value of immediate value nn plus carry flag
-	n := cpu.fetch()
-	oldA := cpu.r.af.a
-	cpu.r.af.a -= n
-	cpu.r.af.a -= cpu.r.flagAsByte(cpu.r.af.f.c)
-	cpu.r.setFlagC(cpu.r.af.a == 0)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((oldA >> 4) > (cpu.r.af.a >> 4))
-	cpu.r.setFlagZ(oldA > cpu.r.af.a)
+	cpu.r.af.a = subtract(cpu, cpu.fetch(), cpu.r.flagAsByte(cpu.r.af.f.c))
 	return sbcANnCycles
 }
 
@@ -2238,76 +2128,47 @@ func xorAN(cpu *cpu) cycleCount {
 
 func cpAA(cpu *cpu) cycleCount {
 	// Compares A to A. The result is not stored; this function only affects flags.
-	cpu.r.setFlagZ(cpu.r.af.a == cpu.r.af.a)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((cpu.r.af.a >> 4) < (cpu.r.af.a >> 4))
-	cpu.r.setFlagC(cpu.r.af.a < cpu.r.af.a)
+	subtract(cpu, cpu.r.af.a, 0)
 	return cpAACycles
 }
 func cpAB(cpu *cpu) cycleCount {
 	// Compares A to B. The result is not stored; this function only affects flags.
-	cpu.r.setFlagZ(cpu.r.af.a == cpu.r.bc.b)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((cpu.r.af.a >> 4) < (cpu.r.bc.b >> 4))
-	cpu.r.setFlagC(cpu.r.af.a < cpu.r.bc.b)
+	subtract(cpu, cpu.r.bc.b, 0)
 	return cpABCycles
 }
 func cpAC(cpu *cpu) cycleCount {
 	// Compares A to C. The result is not stored; this function only affects flags.
-	cpu.r.setFlagZ(cpu.r.af.a == cpu.r.bc.c)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((cpu.r.af.a >> 4) < (cpu.r.bc.c >> 4))
-	cpu.r.setFlagC(cpu.r.af.a < cpu.r.bc.c)
+	subtract(cpu, cpu.r.bc.c, 0)
 	return cpACCycles
 }
 func cpAD(cpu *cpu) cycleCount {
 	// Compares A to D. The result is not stored; this function only affects flags.
-	cpu.r.setFlagZ(cpu.r.af.a == cpu.r.de.d)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((cpu.r.af.a >> 4) < (cpu.r.de.d >> 4))
-	cpu.r.setFlagC(cpu.r.af.a < cpu.r.de.d)
+	subtract(cpu, cpu.r.de.d, 0)
 	return cpADCycles
 }
 func cpAE(cpu *cpu) cycleCount {
 	// Compares A to E. The result is not stored; this function only affects flags.
-	cpu.r.setFlagZ(cpu.r.af.a == cpu.r.de.e)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((cpu.r.af.a >> 4) < (cpu.r.de.e >> 4))
-	cpu.r.setFlagC(cpu.r.af.a < cpu.r.de.e)
+	subtract(cpu, cpu.r.de.e, 0)
 	return cpAECycles
 }
 func cpAH(cpu *cpu) cycleCount {
 	// Compares A to H. The result is not stored; this function only affects flags.
-	cpu.r.setFlagZ(cpu.r.af.a == cpu.r.hl.h)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((cpu.r.af.a >> 4) < (cpu.r.hl.h >> 4))
-	cpu.r.setFlagC(cpu.r.af.a < cpu.r.hl.h)
+	subtract(cpu, cpu.r.hl.h, 0)
 	return cpAHCycles
 }
 func cpAL(cpu *cpu) cycleCount {
 	// Compares A to L. The result is not stored; this function only affects flags.
-	cpu.r.setFlagZ(cpu.r.af.a == cpu.r.hl.l)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((cpu.r.af.a >> 4) < (cpu.r.hl.l >> 4))
-	cpu.r.setFlagC(cpu.r.af.a < cpu.r.hl.l)
+	subtract(cpu, cpu.r.hl.l, 0)
 	return cpALCycles
 }
 func cpAMemHl(cpu *cpu) cycleCount {
-	// Compares A to (. The result is not stored; this function only affects flags.
-	memHl := cpu.mmu.ReadByte(cpu.r.hlAsAddress())
-	cpu.r.setFlagZ(cpu.r.af.a == memHl)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((cpu.r.af.a >> 4) < (memHl >> 4))
-	cpu.r.setFlagC(cpu.r.af.a < memHl)
+	// Compares A to (HL). The result is not stored; this function only affects flags.
+	subtract(cpu, cpu.mmu.ReadByte(cpu.r.hlAsAddress()), 0)
 	return cpAMemHlCycles
 }
 func cpAN(cpu *cpu) cycleCount {
 	// Compares A to #. The result is not stored; this function only affects flags.
-	n := cpu.fetch()
-	cpu.r.setFlagZ(cpu.r.af.a == n)
-	cpu.r.setFlagN(true)
-	cpu.r.setFlagH((cpu.r.af.a >> 4) < (n >> 4))
-	cpu.r.setFlagC(cpu.r.af.a < n)
+	subtract(cpu, cpu.fetch(), 0)
 	return cpANCycles
 }
 
@@ -2522,51 +2383,38 @@ func decMemHl(cpu *cpu) cycleCount {
 //		ADD 			HL,HL 			29 			8
 //		ADD 			HL,SP 			39 			8
 
+// Add n into register HL
+func addToHl(cpu *cpu, n types.Word) {
+	hl := cpu.r.hlAsWord()
+	result := hl + n
+	cpu.r.setFlagN(false)
+	cpu.r.setFlagH((hl&0x0FFF)+(n&0x0FFF) > 0x0FFF)
+	cpu.r.setFlagC(result < hl)
+	cpu.r.hl.h = result.High()
+	cpu.r.hl.l = result.Low()
+}
+
 func addHlBc(cpu *cpu) cycleCount {
 	// Add the value of register BC into register HL
-	carry := byte((uint16(cpu.r.hl.l) + uint16(cpu.r.bc.c)) >> 8)
-	oldH := cpu.r.hl.h
-	cpu.r.hl.l += cpu.r.bc.c
-	cpu.r.hl.h += carry + cpu.r.bc.b
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((cpu.r.hl.h & 0xf) < (oldH & 0xf))
-	cpu.r.setFlagC(cpu.r.hl.h < oldH)
+	addToHl(cpu, cpu.r.bcAsWord())
 	return addHlBcCycles
 }
 
 func addHlDe(cpu *cpu) cycleCount {
 	// Add the value of register DE into register HL
-	carry := byte((uint16(cpu.r.hl.l) + uint16(cpu.r.de.e)) >> 8)
-	oldH := cpu.r.hl.h
-	cpu.r.hl.l += cpu.r.de.e
-	cpu.r.hl.h += carry + cpu.r.de.d
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((cpu.r.hl.h & 0xf) < (oldH & 0xf))
-	cpu.r.setFlagC(cpu.r.hl.h < oldH)
+	addToHl(cpu, cpu.r.deAsWord())
 	return addHlDeCycles
 }
 
 func addHlHl(cpu *cpu) cycleCount {
 	// Add the value of register HL into register HL
-	carry := byte((uint16(cpu.r.hl.l) + uint16(cpu.r.hl.l)) >> 8)
-	oldH := cpu.r.hl.h
-	cpu.r.hl.l += cpu.r.hl.l
-	cpu.r.hl.h += carry + cpu.r.hl.h
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((cpu.r.hl.h & 0xf) < (oldH & 0xf))
-	cpu.r.setFlagC(cpu.r.hl.h < oldH)
+	addToHl(cpu, cpu.r.hlAsWord())
 	return addHlHlCycles
 }
 
 func addHlSp(cpu *cpu) cycleCount {
 	// Add the value of register SP into register HL
-	carry := byte((uint16(cpu.r.hl.l) + uint16(byte(cpu.r.sp.Low()))) >> 8)
-	oldH := cpu.r.hl.h
-	cpu.r.hl.l += cpu.r.sp.Low()
-	cpu.r.hl.h += carry + cpu.r.sp.High()
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((cpu.r.hl.h & 0xf) < (oldH & 0xf))
-	cpu.r.setFlagC(cpu.r.hl.h < oldH)
+	addToHl(cpu, cpu.r.sp)
 	return addHlSpCycles
 }
 
@@ -2586,13 +2434,7 @@ func addHlSp(cpu *cpu) cycleCount {
 
 func addSpN(cpu *cpu) cycleCount {
 	// Add the immediate value N to Stack Pointer (SP)
-	oldSp := cpu.r.sp
-	n := cpu.fetch()
-	cpu.r.sp += types.Word(n)
-	cpu.r.setFlagZ(false)
-	cpu.r.setFlagN(false)
-	cpu.r.setFlagH((cpu.r.sp.Low() & 0xf) < (oldSp.Low() & 0xf))
-	cpu.r.setFlagC(cpu.r.sp.Low() < oldSp.Low())
+	cpu.r.sp = spPlusN(cpu)
 	return addSpNCycles
 }
 
@@ -2710,58 +2552,82 @@ func decSp(cpu *cpu) cycleCount {
 func swapA(cpu *cpu) cycleCount {
 	// Swap upper & lower nibbles of register A
 	oldA := cpu.r.af.a
-	cpu.r.af.a = byte(oldA<<4) + byte(oldA<<4)
+	cpu.r.af.a = oldA<<4 | oldA>>4
 	cpu.r.setFlagZ(cpu.r.af.a == 0)
+	cpu.r.setFlagN(false)
+	cpu.r.setFlagH(false)
+	cpu.r.setFlagC(false)
 	return 8
 }
 func swapB(cpu *cpu) cycleCount {
 	// Swap upper & lower nibbles of register B
 	oldB := cpu.r.bc.b
-	cpu.r.bc.b = byte(oldB<<4) + byte(oldB<<4)
+	cpu.r.bc.b = oldB<<4 | oldB>>4
 	cpu.r.setFlagZ(cpu.r.bc.b == 0)
+	cpu.r.setFlagN(false)
+	cpu.r.setFlagH(false)
+	cpu.r.setFlagC(false)
 	return 8
 }
 func swapC(cpu *cpu) cycleCount {
 	// Swap upper & lower nibbles of register C
 	oldC := cpu.r.bc.c
-	cpu.r.bc.c = byte(oldC<<4) + byte(oldC<<4)
+	cpu.r.bc.c = oldC<<4 | oldC>>4
 	cpu.r.setFlagZ(cpu.r.bc.c == 0)
+	cpu.r.setFlagN(false)
+	cpu.r.setFlagH(false)
+	cpu.r.setFlagC(false)
 	return 8
 }
 func swapD(cpu *cpu) cycleCount {
 	// Swap upper & lower nibbles of register D
 	oldD := cpu.r.de.d
-	cpu.r.de.d = byte(oldD<<4) + byte(oldD<<4)
+	cpu.r.de.d = oldD<<4 | oldD>>4
 	cpu.r.setFlagZ(cpu.r.de.d == 0)
+	cpu.r.setFlagN(false)
+	cpu.r.setFlagH(false)
+	cpu.r.setFlagC(false)
 	return 8
 }
 func swapE(cpu *cpu) cycleCount {
 	// Swap upper & lower nibbles of register E
 	oldE := cpu.r.de.e
-	cpu.r.de.e = byte(oldE<<4) + byte(oldE<<4)
+	cpu.r.de.e = oldE<<4 | oldE>>4
 	cpu.r.setFlagZ(cpu.r.de.e == 0)
+	cpu.r.setFlagN(false)
+	cpu.r.setFlagH(false)
+	cpu.r.setFlagC(false)
 	return 8
 }
 func swapH(cpu *cpu) cycleCount {
 	// Swap upper & lower nibbles of register H
 	oldH := cpu.r.hl.h
-	cpu.r.hl.h = byte(oldH<<4) + byte(oldH<<4)
+	cpu.r.hl.h = oldH<<4 | oldH>>4
 	cpu.r.setFlagZ(cpu.r.hl.h == 0)
+	cpu.r.setFlagN(false)
+	cpu.r.setFlagH(false)
+	cpu.r.setFlagC(false)
 	return 8
 }
 func swapL(cpu *cpu) cycleCount {
 	// Swap upper & lower nibbles of register L
 	oldL := cpu.r.hl.l
-	cpu.r.hl.l = byte(oldL<<4) + byte(oldL<<4)
+	cpu.r.hl.l = oldL<<4 | oldL>>4
 	cpu.r.setFlagZ(cpu.r.hl.l == 0)
+	cpu.r.setFlagN(false)
+	cpu.r.setFlagH(false)
+	cpu.r.setFlagC(false)
 	return 8
 }
 func swapMemHl(cpu *cpu) cycleCount {
 	// Swap upper & lower nibbles of the position of memory pointed by register HL
 	memHl := cpu.mmu.ReadByte(cpu.r.hlAsAddress())
 	oldMemHl := memHl
-	memHl = byte(oldMemHl<<4) + byte(oldMemHl<<4)
+	memHl = oldMemHl<<4 | oldMemHl>>4
 	cpu.r.setFlagZ(memHl == 0)
+	cpu.r.setFlagN(false)
+	cpu.r.setFlagH(false)
+	cpu.r.setFlagC(false)
 	cpu.mmu.WriteByte(cpu.r.hlAsAddress(), memHl)
 	return 16
 }
@@ -2803,7 +2669,7 @@ func daA(cpu *cpu) cycleCount {
 
 	cpu.r.setFlagZ(a&0xFF == 0x00)
 	cpu.r.setFlagH(false)
-	cpu.r.setFlagC(a&0x100 == 0x100)
+	cpu.r.setFlagC(cpu.r.af.f.c || a&0x100 == 0x100)
 
 	cpu.r.af.a = byte(a)
 
@@ -2825,6 +2691,8 @@ func daA(cpu *cpu) cycleCount {
 func cplA(cpu *cpu) cycleCount {
 	// Revert all bits of register A (ie. bitwise XOR with 0xFF)
 	cpu.r.af.a ^= 0xFF
+	cpu.r.setFlagN(true)
+	cpu.r.setFlagH(true)
 	return cplACycles
 }
 
@@ -2889,6 +2757,12 @@ func nop(cpu *cpu) cycleCount {
 // 	HALT 			-/- 			76 			4
 func halt(cpu *cpu) cycleCount {
 	// Power down CPU until an interrupt occurs
+	// If the interrupts are disabled and there is already a pending one,
+	// the CPU doesn't halt, but the next byte is read twice (HALT bug)
+	if !cpu.interruptsEnabled && cpu.mmu.PendingInterrupts() != 0 {
+		cpu.haltBug = true
+		return haltCycles
+	}
 	cpu.halted = true
 	return haltCycles
 }
@@ -2900,9 +2774,11 @@ func halt(cpu *cpu) cycleCount {
 // 		Instruction 	Parameters 		Opcode 		Cycles
 // 		STOP 			-/- 			10 00 		4
 func stop(cpu *cpu) cycleCount {
-	// Stops the CPU until an interrupt occurs
+	// Stops the CPU until a button is pressed
+	// The divider is reset, as it would be by writing DIV
 	cpu.fetch()
-	cpu.log.Println("CPU: Stopping...")
+	cpu.mmu.WriteByte(timer.DIV_ADDRESS.AsAddress(), 0x00)
+	cpu.stopped = true
 	return stopCycles
 }
 
@@ -2918,7 +2794,9 @@ func stop(cpu *cpu) cycleCount {
 // 		DI 				-/- 			F3 			4
 func di(cpu *cpu) cycleCount {
 	// Disables Interruptions
+	// Unlike EI, it takes effect immediately (and cancels a pending EI)
 	cpu.interruptsEnabled = false
+	cpu.eiDelay = 0
 	return diCycles
 }
 
@@ -2933,8 +2811,11 @@ func di(cpu *cpu) cycleCount {
 // 		Instruction 	Parameters 		Opcode 		Cycles
 // 		EI 				-/- 			FB 			4
 func ei(cpu *cpu) cycleCount {
-	// Enables Interruptions
-	cpu.interruptsEnabled = true
+	// Enables Interruptions after the next instruction
+	// (this one and the next one are counted by updateEIDelay)
+	if !cpu.interruptsEnabled {
+		cpu.eiDelay = 2
+	}
 	return eiCycles
 }
 
@@ -2944,7 +2825,7 @@ func ei(cpu *cpu) cycleCount {
 // Description:
 // 	Rotate A left. Old bit 7 to Carry flag.
 // Flags affected:
-// 	Z - Set if result is zero.
+// 	Z - Reset.
 // 	N - Reset.
 // 	H - Reset.
 // 	C - Contains old bit 7 data.
@@ -2960,7 +2841,7 @@ func rlcA(cpu *cpu) cycleCount {
 		cpu.r.af.a |= 0x01 // set bit 0 to 1
 	}
 
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
+	cpu.r.setFlagZ(false)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(false)
 	cpu.r.setFlagC(bit7)
@@ -2971,7 +2852,7 @@ func rlcA(cpu *cpu) cycleCount {
 // Description:
 // 	Rotate A left through Carry flag.
 // Flags affected:
-// 	Z - Set if result is zero.
+// 	Z - Reset.
 // 	N - Reset.
 // 	H - Reset.
 // 	C - Contains old bit 7 data.
@@ -2988,7 +2869,7 @@ func rlA(cpu *cpu) cycleCount {
 		cpu.r.af.a |= 0x1 // set bit 0 to 1
 	}
 
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
+	cpu.r.setFlagZ(false)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(false)
 	cpu.r.setFlagC(bit7)
@@ -2999,7 +2880,7 @@ func rlA(cpu *cpu) cycleCount {
 // Description:
 // 	Rotate A right. Old bit 0 to Carry flag.
 // Flags affected:
-// 	Z - Set if result is zero.
+// 	Z - Reset.
 // 	N - Reset.
 // 	H - Reset.
 // 	C - Contains old bit 0 data.
@@ -3016,7 +2897,7 @@ func rrcA(cpu *cpu) cycleCount {
 		cpu.r.af.a |= 0x80 // set bit 7 to 1
 	}
 
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
+	cpu.r.setFlagZ(false)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(false)
 	cpu.r.setFlagC(bit0)
@@ -3027,7 +2908,7 @@ func rrcA(cpu *cpu) cycleCount {
 // Description:
 // 	Rotate A right through Carry flag.
 // Flags affected:
-// 	Z - Set if result is zero.
+// 	Z - Reset.
 // 	N - Reset.
 // 	H - Reset.
 // 	C - Contains old bit 0 data.
@@ -3044,7 +2925,7 @@ func rrA(cpu *cpu) cycleCount {
 		cpu.r.af.a |= 0x80 // set bit 7 to 1
 	}
 
-	cpu.r.setFlagZ(cpu.r.af.a == 0)
+	cpu.r.setFlagZ(false)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(false)
 	cpu.r.setFlagC(bit0)
@@ -3074,7 +2955,7 @@ func rrA(cpu *cpu) cycleCount {
 
 var rxNInstructions = map[byte]instruction{
 	// RLC
-	0x07: rlcA,
+	0x07: cbRlcA,
 	0x00: rlcB,
 	0x01: rlcC,
 	0x02: rlcD,
@@ -3083,7 +2964,7 @@ var rxNInstructions = map[byte]instruction{
 	0x05: rlcL,
 	0x06: rlcMemHl,
 	// RL
-	0x17: rlA,
+	0x17: cbRlA,
 	0x10: rlB,
 	0x11: rlC,
 	0x12: rlD,
@@ -3092,7 +2973,7 @@ var rxNInstructions = map[byte]instruction{
 	0x15: rlL,
 	0x16: rlMemHl,
 	// RRC
-	0x0F: rrcA,
+	0x0F: cbRrcA,
 	0x08: rrcB,
 	0x09: rrcC,
 	0x0A: rrcD,
@@ -3101,7 +2982,7 @@ var rxNInstructions = map[byte]instruction{
 	0x0D: rrcL,
 	0x0E: rrcMemHl,
 	// RR
-	0x1F: rrA,
+	0x1F: cbRrA,
 	0x18: rrB,
 	0x19: rrC,
 	0x1A: rrD,
@@ -3364,6 +3245,7 @@ var rxNInstructions = map[byte]instruction{
 }
 
 const (
+	cbRlcACycles   = 8
 	rlcBCycles     = 8
 	rlcCCycles     = 8
 	rlcDCycles     = 8
@@ -3384,8 +3266,12 @@ func rxN(cpu *cpu) cycleCount {
 	return cycles
 }
 
-// func rlcA(cpu *cpu) cycleCount
-// already implemented
+func cbRlcA(cpu *cpu) cycleCount {
+	// Same as RLCA, but the zero flag is set if the result is zero
+	rlcA(cpu)
+	cpu.r.setFlagZ(cpu.r.af.a == 0)
+	return cbRlcACycles
+}
 
 func rlcB(cpu *cpu) cycleCount {
 	// Rotate B left 1 bit; B[0] = pre(B)[7]
@@ -3497,6 +3383,7 @@ func rlcMemHl(cpu *cpu) cycleCount {
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(false)
 	cpu.r.setFlagC(bit7)
+	cpu.mmu.WriteByte(cpu.r.hlAsAddress(), memHl)
 	return rlcMemHlCycles
 }
 
@@ -3522,6 +3409,7 @@ func rlcMemHl(cpu *cpu) cycleCount {
 // 		RL 				(HL) 			CB 16 		16
 
 const (
+	cbRlACycles   = 8
 	rlBCycles     = 8
 	rlCCycles     = 8
 	rlDCycles     = 8
@@ -3531,8 +3419,12 @@ const (
 	rlMemHlCycles = 16
 )
 
-// func rlA(cpu *cpu) cycleCount
-// already implemented
+func cbRlA(cpu *cpu) cycleCount {
+	// Same as RLA, but the zero flag is set if the result is zero
+	rlA(cpu)
+	cpu.r.setFlagZ(cpu.r.af.a == 0)
+	return cbRlACycles
+}
 
 func rlB(cpu *cpu) cycleCount {
 	// Rotate B left 1 bit, but through Carry Flag
@@ -3676,10 +3568,15 @@ func rlMemHl(cpu *cpu) cycleCount {
 // 		RRC 			L 				CB 0D 		8
 // 		RRC 			(HL) 			CB 0E 		16
 
-// func rrcA(cpu *cpu) cycleCount
-// already implemented
+func cbRrcA(cpu *cpu) cycleCount {
+	// Same as RRCA, but the zero flag is set if the result is zero
+	rrcA(cpu)
+	cpu.r.setFlagZ(cpu.r.af.a == 0)
+	return cbRrcACycles
+}
 
 const (
+	cbRrcACycles   = 8
 	rrcBCycles     = 8
 	rrcCCycles     = 8
 	rrcDCycles     = 8
@@ -3831,10 +3728,15 @@ func rrcMemHl(cpu *cpu) cycleCount {
 // 		RR 				L 				CB 1D 		8
 // 		RR 				(HL) 			CB 1E 		16
 
-// func rrA(cpu *cpu) cycleCount
-// already implemented
+func cbRrA(cpu *cpu) cycleCount {
+	// Same as RRA, but the zero flag is set if the result is zero
+	rrA(cpu)
+	cpu.r.setFlagZ(cpu.r.af.a == 0)
+	return cbRrACycles
+}
 
 const (
+	cbRrACycles   = 8
 	rrBCycles     = 8
 	rrCCycles     = 8
 	rrDCycles     = 8
@@ -4380,43 +4282,43 @@ func bit0A(cpu *cpu) cycleCount {
 	return bitACycles
 }
 func bit1A(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.af.a & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.af.a & 0x02) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitACycles
 }
 func bit2A(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.af.a & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.af.a & 0x04) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitACycles
 }
 func bit3A(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.af.a & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.af.a & 0x08) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitACycles
 }
 func bit4A(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.af.a & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.af.a & 0x10) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitACycles
 }
 func bit5A(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.af.a & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.af.a & 0x20) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitACycles
 }
 func bit6A(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.af.a & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.af.a & 0x40) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitACycles
 }
 func bit7A(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.af.a & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.af.a & 0x80) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitACycles
@@ -4429,43 +4331,43 @@ func bit0B(cpu *cpu) cycleCount {
 	return bitBCycles
 }
 func bit1B(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.b & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.b & 0x02) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitBCycles
 }
 func bit2B(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.b & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.b & 0x04) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitBCycles
 }
 func bit3B(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.b & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.b & 0x08) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitBCycles
 }
 func bit4B(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.b & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.b & 0x10) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitBCycles
 }
 func bit5B(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.b & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.b & 0x20) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitBCycles
 }
 func bit6B(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.b & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.b & 0x40) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitBCycles
 }
 func bit7B(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.b & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.b & 0x80) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitBCycles
@@ -4478,43 +4380,43 @@ func bit0C(cpu *cpu) cycleCount {
 	return bitCCycles
 }
 func bit1C(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.c & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.c & 0x02) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitCCycles
 }
 func bit2C(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.c & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.c & 0x04) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitCCycles
 }
 func bit3C(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.c & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.c & 0x08) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitCCycles
 }
 func bit4C(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.c & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.c & 0x10) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitCCycles
 }
 func bit5C(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.c & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.c & 0x20) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitCCycles
 }
 func bit6C(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.c & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.c & 0x40) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitCCycles
 }
 func bit7C(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.bc.c & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.bc.c & 0x80) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitCCycles
@@ -4527,43 +4429,43 @@ func bit0D(cpu *cpu) cycleCount {
 	return bitDCycles
 }
 func bit1D(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.d & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.d & 0x02) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitDCycles
 }
 func bit2D(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.d & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.d & 0x04) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitDCycles
 }
 func bit3D(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.d & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.d & 0x08) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitDCycles
 }
 func bit4D(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.d & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.d & 0x10) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitDCycles
 }
 func bit5D(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.d & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.d & 0x20) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitDCycles
 }
 func bit6D(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.d & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.d & 0x40) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitDCycles
 }
 func bit7D(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.d & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.d & 0x80) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitDCycles
@@ -4576,43 +4478,43 @@ func bit0E(cpu *cpu) cycleCount {
 	return bitECycles
 }
 func bit1E(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.e & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.e & 0x02) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitECycles
 }
 func bit2E(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.e & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.e & 0x04) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitECycles
 }
 func bit3E(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.e & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.e & 0x08) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitECycles
 }
 func bit4E(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.e & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.e & 0x10) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitECycles
 }
 func bit5E(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.e & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.e & 0x20) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitECycles
 }
 func bit6E(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.e & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.e & 0x40) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitECycles
 }
 func bit7E(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.de.e & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.de.e & 0x80) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitECycles
@@ -4625,43 +4527,43 @@ func bit0H(cpu *cpu) cycleCount {
 	return bitHCycles
 }
 func bit1H(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.h & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.h & 0x02) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitHCycles
 }
 func bit2H(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.h & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.h & 0x04) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitHCycles
 }
 func bit3H(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.h & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.h & 0x08) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitHCycles
 }
 func bit4H(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.h & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.h & 0x10) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitHCycles
 }
 func bit5H(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.h & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.h & 0x20) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitHCycles
 }
 func bit6H(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.h & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.h & 0x40) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitHCycles
 }
 func bit7H(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.h & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.h & 0x80) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitHCycles
@@ -4674,43 +4576,43 @@ func bit0L(cpu *cpu) cycleCount {
 	return bitLCycles
 }
 func bit1L(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.l & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.l & 0x02) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitLCycles
 }
 func bit2L(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.l & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.l & 0x04) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitLCycles
 }
 func bit3L(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.l & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.l & 0x08) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitLCycles
 }
 func bit4L(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.l & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.l & 0x10) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitLCycles
 }
 func bit5L(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.l & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.l & 0x20) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitLCycles
 }
 func bit6L(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.l & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.l & 0x40) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitLCycles
 }
 func bit7L(cpu *cpu) cycleCount {
-	cpu.r.setFlagZ((cpu.r.hl.l & 0x01) == 0x00)
+	cpu.r.setFlagZ((cpu.r.hl.l & 0x80) == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitLCycles
@@ -4718,56 +4620,56 @@ func bit7L(cpu *cpu) cycleCount {
 
 func bit0MemHl(cpu *cpu) cycleCount {
 	memHl := cpu.mmu.ReadByte(cpu.r.hlAsAddress())
-	cpu.r.setFlagZ(memHl&0x01 == 0x01)
+	cpu.r.setFlagZ(memHl&0x01 == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitMemHlCycles
 }
 func bit1MemHl(cpu *cpu) cycleCount {
 	memHl := cpu.mmu.ReadByte(cpu.r.hlAsAddress())
-	cpu.r.setFlagZ(memHl&0x01 == 0x01)
+	cpu.r.setFlagZ(memHl&0x02 == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitMemHlCycles
 }
 func bit2MemHl(cpu *cpu) cycleCount {
 	memHl := cpu.mmu.ReadByte(cpu.r.hlAsAddress())
-	cpu.r.setFlagZ(memHl&0x01 == 0x01)
+	cpu.r.setFlagZ(memHl&0x04 == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitMemHlCycles
 }
 func bit3MemHl(cpu *cpu) cycleCount {
 	memHl := cpu.mmu.ReadByte(cpu.r.hlAsAddress())
-	cpu.r.setFlagZ(memHl&0x01 == 0x01)
+	cpu.r.setFlagZ(memHl&0x08 == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitMemHlCycles
 }
 func bit4MemHl(cpu *cpu) cycleCount {
 	memHl := cpu.mmu.ReadByte(cpu.r.hlAsAddress())
-	cpu.r.setFlagZ(memHl&0x01 == 0x01)
+	cpu.r.setFlagZ(memHl&0x10 == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitMemHlCycles
 }
 func bit5MemHl(cpu *cpu) cycleCount {
 	memHl := cpu.mmu.ReadByte(cpu.r.hlAsAddress())
-	cpu.r.setFlagZ(memHl&0x01 == 0x01)
+	cpu.r.setFlagZ(memHl&0x20 == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitMemHlCycles
 }
 func bit6MemHl(cpu *cpu) cycleCount {
 	memHl := cpu.mmu.ReadByte(cpu.r.hlAsAddress())
-	cpu.r.setFlagZ(memHl&0x01 == 0x01)
+	cpu.r.setFlagZ(memHl&0x40 == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitMemHlCycles
 }
 func bit7MemHl(cpu *cpu) cycleCount {
 	memHl := cpu.mmu.ReadByte(cpu.r.hlAsAddress())
-	cpu.r.setFlagZ(memHl&0x01 == 0x01)
+	cpu.r.setFlagZ(memHl&0x80 == 0x00)
 	cpu.r.setFlagN(false)
 	cpu.r.setFlagH(true)
 	return bitMemHlCycles
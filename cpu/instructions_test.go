@@ -0,0 +1,403 @@
+package cpu
+
+import (
+	"fmt"
+	"github.com/lbarrios/yesSGMB/types"
+	"testing"
+)
+
+// Values used as inputs, chosen to hit the nibble and byte boundaries
+var testValues = []byte{0x00, 0x01, 0x0F, 0x10, 0x42, 0x7F, 0x80, 0x99, 0x9A, 0xF0, 0xFF}
+
+// Every combination of the four flags
+func allFlags() []Flags {
+	flags := make([]Flags, 0, 16)
+	for b := 0; b < 0x100; b += 0x10 {
+		var f Flags
+		f.loadByte(byte(b))
+		flags = append(flags, f)
+	}
+	return flags
+}
+
+// Operands are encoded as B, C, D, E, H, L, (HL), A
+const operandHl = 6
+const operandA = 7
+
+var operandNames = [8]string{"B", "C", "D", "E", "H", "L", "(HL)", "A"}
+
+func (cpu *cpu) setOperand(m *testMMU, operand byte, value byte) {
+	switch operand {
+	case 0:
+		cpu.r.bc.b = value
+	case 1:
+		cpu.r.bc.c = value
+	case 2:
+		cpu.r.de.d = value
+	case 3:
+		cpu.r.de.e = value
+	case 4:
+		cpu.r.hl.h = value
+	case 5:
+		cpu.r.hl.l = value
+	case operandHl:
+		cpu.r.hl.h = testMemHl.High()
+		cpu.r.hl.l = testMemHl.Low()
+		m.memory[testMemHl] = value
+	case operandA:
+		cpu.r.af.a = value
+	}
+}
+
+func (cpu *cpu) getOperand(m *testMMU, operand byte) byte {
+	switch operand {
+	case 0:
+		return cpu.r.bc.b
+	case 1:
+		return cpu.r.bc.c
+	case 2:
+		return cpu.r.de.d
+	case 3:
+		return cpu.r.de.e
+	case 4:
+		return cpu.r.hl.h
+	case 5:
+		return cpu.r.hl.l
+	case operandHl:
+		return m.memory[testMemHl]
+	}
+	return cpu.r.af.a
+}
+
+// Runs a single instruction and returns the cpu after it
+func runInstruction(setup func(cpu *cpu, m *testMMU), program ...byte) (*cpu, *testMMU) {
+	cpu, m := newTestCPU(program...)
+	setup(cpu, m)
+	cpu.Step()
+	return cpu, m
+}
+
+func checkResult(t *testing.T, name string, value byte, expectedValue byte, f Flags, expectedFlags Flags) {
+	t.Helper()
+	if value != expectedValue || f != expectedFlags {
+		t.Errorf("%s: result=0x%.2x f=%s, expected result=0x%.2x f=%s", name, value, f, expectedValue, expectedFlags)
+	}
+}
+
+// Reference model of the 8 bit arithmetic and logic operations, as encoded in bits 3-5 of 0x80-0xBF
+func alu(operation byte, a byte, value byte, f Flags) (byte, Flags) {
+	carry := 0
+	if f.c {
+		carry = 1
+	}
+	result := Flags{}
+	var r int
+	switch operation {
+	case 0, 1: // ADD, ADC
+		if operation == 0 {
+			carry = 0
+		}
+		r = int(a) + int(value) + carry
+		result.h = int(a&0xF)+int(value&0xF)+carry > 0xF
+		result.c = r > 0xFF
+	case 2, 3, 7: // SUB, SBC, CP
+		if operation != 3 {
+			carry = 0
+		}
+		r = int(a) - int(value) - carry
+		result.n = true
+		result.h = int(a&0xF)-int(value&0xF)-carry < 0
+		result.c = r < 0
+	case 4: // AND
+		r = int(a & value)
+		result.h = true
+	case 5: // XOR
+		r = int(a ^ value)
+	case 6: // OR
+		r = int(a | value)
+	}
+	result.z = byte(r) == 0
+	if operation == 7 {
+		return a, result
+	}
+	return byte(r), result
+}
+
+var aluNames = [8]string{"ADD", "ADC", "SUB", "SBC", "AND", "XOR", "OR", "CP"}
+
+func TestALUFlags(t *testing.T) {
+	for op := 0x80; op <= 0xBF; op++ {
+		operation := byte(op>>3) & 7
+		operand := byte(op) & 7
+		for _, a := range testValues {
+			for _, value := range testValues {
+				if operand == operandA {
+					value = a
+				}
+				for _, f := range allFlags() {
+					cpu, _ := runInstruction(func(cpu *cpu, m *testMMU) {
+						cpu.setOperand(m, operand, value)
+						cpu.r.af.a = a
+						cpu.r.af.f = f
+					}, byte(op))
+					expected, expectedFlags := alu(operation, a, value, f)
+					name := fmt.Sprintf("%s A,%s (0x%.2x) A=0x%.2x value=0x%.2x f=%s", aluNames[operation], operandNames[operand], op, a, value, f)
+					checkResult(t, name, cpu.r.af.a, expected, cpu.r.af.f, expectedFlags)
+				}
+			}
+		}
+	}
+}
+
+func TestALUImmediateFlags(t *testing.T) {
+	for operation := byte(0); operation < 8; operation++ {
+		op := 0xC6 | operation<<3
+		for _, a := range testValues {
+			for _, value := range testValues {
+				for _, f := range allFlags() {
+					cpu, _ := runInstruction(func(cpu *cpu, m *testMMU) {
+						cpu.r.af.a = a
+						cpu.r.af.f = f
+					}, op, value)
+					expected, expectedFlags := alu(operation, a, value, f)
+					name := fmt.Sprintf("%s A,n (0x%.2x) A=0x%.2x n=0x%.2x f=%s", aluNames[operation], op, a, value, f)
+					checkResult(t, name, cpu.r.af.a, expected, cpu.r.af.f, expectedFlags)
+				}
+			}
+		}
+	}
+}
+
+func TestIncDecFlags(t *testing.T) {
+	for operand := byte(0); operand < 8; operand++ {
+		for _, value := range testValues {
+			for _, f := range allFlags() {
+				setup := func(cpu *cpu, m *testMMU) {
+					cpu.setOperand(m, operand, value)
+					cpu.r.af.f = f
+				}
+
+				cpu, m := runInstruction(setup, 0x04+operand<<3)
+				expected := value + 1
+				name := fmt.Sprintf("INC %s value=0x%.2x f=%s", operandNames[operand], value, f)
+				checkResult(t, name, cpu.getOperand(m, operand), expected, cpu.r.af.f,
+					Flags{z: expected == 0, n: false, h: value&0xF == 0xF, c: f.c})
+
+				cpu, m = runInstruction(setup, 0x05+operand<<3)
+				expected = value - 1
+				name = fmt.Sprintf("DEC %s value=0x%.2x f=%s", operandNames[operand], value, f)
+				checkResult(t, name, cpu.getOperand(m, operand), expected, cpu.r.af.f,
+					Flags{z: expected == 0, n: true, h: value&0xF == 0, c: f.c})
+			}
+		}
+	}
+}
+
+// Reference model of the rotations and shifts, as encoded in bits 3-5 of 0xCB 0x00-0x3F
+func shift(operation byte, value byte, f Flags) (byte, bool) {
+	carry := byte(0)
+	if f.c {
+		carry = 1
+	}
+	switch operation {
+	case 0: // RLC
+		return value<<1 | value>>7, value&0x80 != 0
+	case 1: // RRC
+		return value>>1 | value<<7, value&0x01 != 0
+	case 2: // RL
+		return value<<1 | carry, value&0x80 != 0
+	case 3: // RR
+		return value>>1 | carry<<7, value&0x01 != 0
+	case 4: // SLA
+		return value << 1, value&0x80 != 0
+	case 5: // SRA
+		return value>>1 | value&0x80, value&0x01 != 0
+	case 6: // SWAP
+		return value<<4 | value>>4, false
+	}
+	// SRL
+	return value >> 1, value&0x01 != 0
+}
+
+var shiftNames = [8]string{"RLC", "RRC", "RL", "RR", "SLA", "SRA", "SWAP", "SRL"}
+
+func TestAccumulatorRotationFlags(t *testing.T) {
+	// RLCA, RRCA, RLA, RRA always reset the zero flag
+	for operation := byte(0); operation < 4; operation++ {
+		op := operation<<3 | 0x07
+		for _, value := range testValues {
+			for _, f := range allFlags() {
+				cpu, _ := runInstruction(func(cpu *cpu, m *testMMU) {
+					cpu.r.af.a = value
+					cpu.r.af.f = f
+				}, op)
+				expected, carry := shift(operation, value, f)
+				name := fmt.Sprintf("%sA (0x%.2x) A=0x%.2x f=%s", shiftNames[operation], op, value, f)
+				checkResult(t, name, cpu.r.af.a, expected, cpu.r.af.f, Flags{c: carry})
+			}
+		}
+	}
+}
+
+func TestCBShiftFlags(t *testing.T) {
+	for op := 0x00; op <= 0x3F; op++ {
+		operation := byte(op>>3) & 7
+		operand := byte(op) & 7
+		for _, value := range testValues {
+			for _, f := range allFlags() {
+				cpu, m := runInstruction(func(cpu *cpu, m *testMMU) {
+					cpu.setOperand(m, operand, value)
+					cpu.r.af.f = f
+				}, 0xCB, byte(op))
+				expected, carry := shift(operation, value, f)
+				name := fmt.Sprintf("%s %s (0xcb 0x%.2x) value=0x%.2x f=%s", shiftNames[operation], operandNames[operand], op, value, f)
+				checkResult(t, name, cpu.getOperand(m, operand), expected, cpu.r.af.f, Flags{z: expected == 0, c: carry})
+			}
+		}
+	}
+}
+
+func TestCBBitFlags(t *testing.T) {
+	for op := 0x40; op <= 0x7F; op++ {
+		bit := uint(op>>3) & 7
+		operand := byte(op) & 7
+		for _, value := range testValues {
+			for _, f := range allFlags() {
+				cpu, m := runInstruction(func(cpu *cpu, m *testMMU) {
+					cpu.setOperand(m, operand, value)
+					cpu.r.af.f = f
+				}, 0xCB, byte(op))
+				name := fmt.Sprintf("BIT %d,%s (0xcb 0x%.2x) value=0x%.2x f=%s", bit, operandNames[operand], op, value, f)
+				checkResult(t, name, cpu.getOperand(m, operand), value, cpu.r.af.f,
+					Flags{z: !types.BitIsSet(value, bit), n: false, h: true, c: f.c})
+			}
+		}
+	}
+}
+
+// Reference model of DAA
+func daa(a byte, f Flags) (byte, Flags) {
+	result := f
+	if !f.n {
+		if f.c || a > 0x99 {
+			a += 0x60
+			result.c = true
+		}
+		if f.h || a&0x0F > 0x09 {
+			a += 0x06
+		}
+	} else {
+		if f.c {
+			a -= 0x60
+		}
+		if f.h {
+			a -= 0x06
+		}
+	}
+	result.z = a == 0
+	result.h = false
+	return a, result
+}
+
+func TestDAAFlags(t *testing.T) {
+	for a := 0; a <= 0xFF; a++ {
+		for _, f := range allFlags() {
+			cpu, _ := runInstruction(func(cpu *cpu, m *testMMU) {
+				cpu.r.af.a = byte(a)
+				cpu.r.af.f = f
+			}, 0x27)
+			expected, expectedFlags := daa(byte(a), f)
+			name := fmt.Sprintf("DAA A=0x%.2x f=%s", a, f)
+			checkResult(t, name, cpu.r.af.a, expected, cpu.r.af.f, expectedFlags)
+		}
+	}
+}
+
+func TestCPLSCFCCFFlags(t *testing.T) {
+	for _, value := range testValues {
+		for _, f := range allFlags() {
+			setup := func(cpu *cpu, m *testMMU) {
+				cpu.r.af.a = value
+				cpu.r.af.f = f
+			}
+
+			cpu, _ := runInstruction(setup, 0x2F)
+			name := fmt.Sprintf("CPL A=0x%.2x f=%s", value, f)
+			checkResult(t, name, cpu.r.af.a, ^value, cpu.r.af.f, Flags{z: f.z, n: true, h: true, c: f.c})
+
+			cpu, _ = runInstruction(setup, 0x37)
+			name = fmt.Sprintf("SCF A=0x%.2x f=%s", value, f)
+			checkResult(t, name, cpu.r.af.a, value, cpu.r.af.f, Flags{z: f.z, c: true})
+
+			cpu, _ = runInstruction(setup, 0x3F)
+			name = fmt.Sprintf("CCF A=0x%.2x f=%s", value, f)
+			checkResult(t, name, cpu.r.af.a, value, cpu.r.af.f, Flags{z: f.z, c: !f.c})
+		}
+	}
+}
+
+var testWords = []types.Word{0x0000, 0x0001, 0x00FF, 0x0F00, 0x0FFF, 0x1000, 0x7FFF, 0x8000, 0x8FFF, 0xFF00, 0xFFFF}
+
+func TestAddHLFlags(t *testing.T) {
+	names := [4]string{"BC", "DE", "HL", "SP"}
+	for operand := byte(0); operand < 4; operand++ {
+		op := 0x09 | operand<<4
+		for _, hl := range testWords {
+			for _, value := range testWords {
+				if operand == 2 {
+					value = hl
+				}
+				for _, f := range allFlags() {
+					cpu, _ := runInstruction(func(cpu *cpu, m *testMMU) {
+						cpu.r.bc.b, cpu.r.bc.c = value.High(), value.Low()
+						cpu.r.de.d, cpu.r.de.e = value.High(), value.Low()
+						cpu.r.sp = value
+						cpu.r.hl.h, cpu.r.hl.l = hl.High(), hl.Low()
+						cpu.r.af.f = f
+					}, op)
+					expected := hl + value
+					expectedFlags := Flags{
+						z: f.z,
+						h: hl&0x0FFF+value&0x0FFF > 0x0FFF,
+						c: uint32(hl)+uint32(value) > 0xFFFF,
+					}
+					name := fmt.Sprintf("ADD HL,%s HL=0x%.4x value=0x%.4x f=%s", names[operand], hl, value, f)
+					if result := cpu.r.hlAsWord(); result != expected || cpu.r.af.f != expectedFlags {
+						t.Errorf("%s: result=0x%.4x f=%s, expected result=0x%.4x f=%s", name, result, cpu.r.af.f, expected, expectedFlags)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSPOffsetFlags(t *testing.T) {
+	offsets := []byte{0x00, 0x01, 0x0F, 0x7F, 0x80, 0xF0, 0xFF}
+	for _, sp := range testWords {
+		for _, offset := range offsets {
+			for _, f := range allFlags() {
+				setup := func(cpu *cpu, m *testMMU) {
+					cpu.r.sp = sp
+					cpu.r.af.f = f
+				}
+				expected := sp + types.Word(int8(offset))
+				expectedFlags := Flags{
+					h: sp&0x0F+types.Word(offset&0x0F) > 0x0F,
+					c: sp&0xFF+types.Word(offset) > 0xFF,
+				}
+
+				cpu, _ := runInstruction(setup, 0xE8, offset)
+				if cpu.r.sp != expected || cpu.r.af.f != expectedFlags {
+					t.Errorf("ADD SP,0x%.2x SP=0x%.4x f=%s: result=0x%.4x f=%s, expected result=0x%.4x f=%s",
+						offset, sp, f, cpu.r.sp, cpu.r.af.f, expected, expectedFlags)
+				}
+
+				cpu, _ = runInstruction(setup, 0xF8, offset)
+				if result := cpu.r.hlAsWord(); result != expected || cpu.r.sp != sp || cpu.r.af.f != expectedFlags {
+					t.Errorf("LD HL,SP+0x%.2x SP=0x%.4x f=%s: result=0x%.4x f=%s, expected result=0x%.4x f=%s",
+						offset, sp, f, result, cpu.r.af.f, expected, expectedFlags)
+				}
+			}
+		}
+	}
+}
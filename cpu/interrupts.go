@@ -1,19 +1,65 @@
 package cpu
 
-import "github.com/lbarrios/yesSGMB/types"
+import (
+	"github.com/lbarrios/yesSGMB/mmu"
+	"github.com/lbarrios/yesSGMB/types"
+)
 
-//interrupt handler addresses
+// interrupt handler addresses
 const (
 	V_BLANK_IR_ADDR        types.Word = 0x40
 	LCD_IR_ADDR            types.Word = 0x48
 	TIMER_OVERFLOW_IR_ADDR types.Word = 0x50
+	SERIAL_IR_ADDR         types.Word = 0x58
 	JOYP_HILO_IR_ADDR      types.Word = 0x60
 )
 
+// Servicing an interrupt takes 5 machine cycles:
+// 2 wait states, 2 to push the PC and 1 to jump to the handler
+const INTERRUPT_DISPATCH_CYCLES = 20
+
+// The interrupts in priority order, with their handler addresses
+var interruptHandlers = []struct {
+	interrupt byte
+	address   types.Word
+}{
+	{mmu.VBLANK_INTERRUPT, V_BLANK_IR_ADDR},
+	{mmu.LCD_STAT_INTERRUPT, LCD_IR_ADDR},
+	{mmu.TIMER_INTERRUPT, TIMER_OVERFLOW_IR_ADDR},
+	{mmu.SERIAL_INTERRUPT, SERIAL_IR_ADDR},
+	{mmu.JOYPAD_INTERRUPT, JOYP_HILO_IR_ADDR},
+}
+
+// Services the pending interrupt with the highest priority, if the interrupts are enabled.
+// Returns true if an interrupt was serviced.
+func (cpu *cpu) checkInterrupts() bool {
+	if !cpu.interruptsEnabled {
+		return false
+	}
+
+	pending := cpu.mmu.PendingInterrupts()
+	if pending == 0x00 {
+		return false
+	}
+
+	// Disable the interrupts and acknowledge the serviced one,
+	// then push the current PC to stack and jump to the corresponding interruption handler
+	for _, handler := range interruptHandlers {
+		if pending&handler.interrupt != 0 {
+			cpu.interruptsEnabled = false
+			cpu.mmu.AcknowledgeInterrupt(handler.interrupt)
+			cpu.jumpToInterruptHandler(handler.address)
+			cpu.clock.Cycles += INTERRUPT_DISPATCH_CYCLES
+			return true
+		}
+	}
+	return false
+}
+
 func (cpu *cpu) jumpToInterruptHandler(address types.Word) {
 	cpu.r.sp--
 	cpu.mmu.WriteByte(cpu.r.spAsAddress(), cpu.r.pc.High())
 	cpu.r.sp--
 	cpu.mmu.WriteByte(cpu.r.spAsAddress(), cpu.r.pc.Low())
 	cpu.r.pc = types.Address{High: address.High(), Low: address.Low()}.AsWord()
-}
\ No newline at end of file
+}
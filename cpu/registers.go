@@ -5,39 +5,50 @@ import (
 	"github.com/lbarrios/yesSGMB/types"
 )
 
+// Flags register (F), the lower byte of AF
+//
+//	Bit 7 - Z: zero flag
+//	Bit 6 - N: subtract flag
+//	Bit 5 - H: half carry flag
+//	Bit 4 - C: carry flag
+//	Bit 3-0 - Not used (always zero)
+const (
+	flagZBit = 7
+	flagNBit = 6
+	flagHBit = 5
+	flagCBit = 4
+)
+
 type Flags struct {
 	z bool // zero flag
 	n bool // subtract flag
 	h bool // half carry flag
 	c bool // carry flag
-	_ bool // to complete 1 byte
-	_ bool // to complete 1 byte
-	_ bool // to complete 1 byte
-	_ bool // to complete 1 byte
 }
 
 func (f *Flags) asByte() byte {
 	var r byte
 	if f.z {
-		r += 1 >> 8
+		r |= 1 << flagZBit
 	}
 	if f.n {
-		r += 1 >> 7
+		r |= 1 << flagNBit
 	}
 	if f.h {
-		r += 1 >> 6
+		r |= 1 << flagHBit
 	}
 	if f.c {
-		r += 1 >> 5
+		r |= 1 << flagCBit
 	}
 	return r
 }
 
+// The lower nibble is discarded, as those bits always read as zero
 func (f *Flags) loadByte(b byte) {
-	f.z = types.BitIsSet(b, 8)
-	f.n = types.BitIsSet(b, 7)
-	f.h = types.BitIsSet(b, 6)
-	f.c = types.BitIsSet(b, 5)
+	f.z = types.BitIsSet(b, flagZBit)
+	f.n = types.BitIsSet(b, flagNBit)
+	f.h = types.BitIsSet(b, flagHBit)
+	f.c = types.BitIsSet(b, flagCBit)
 }
 
 func (f Flags) String() string {
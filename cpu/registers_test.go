@@ -0,0 +1,80 @@
+package cpu
+
+import (
+	"testing"
+)
+
+func TestFlagsRoundTrip(t *testing.T) {
+	tests := []struct {
+		value    byte
+		expected Flags
+	}{
+		{0x00, Flags{}},
+		{0x80, Flags{z: true}},
+		{0x40, Flags{n: true}},
+		{0x20, Flags{h: true}},
+		{0x10, Flags{c: true}},
+		{0xF0, Flags{z: true, n: true, h: true, c: true}},
+		{0xA0, Flags{z: true, h: true}},
+		{0x50, Flags{n: true, c: true}},
+		// The lower nibble doesn't exist, it is always read as 0
+		{0x0F, Flags{}},
+		{0xFF, Flags{z: true, n: true, h: true, c: true}},
+		{0x9A, Flags{z: true, c: true}},
+	}
+	for _, test := range tests {
+		var f Flags
+		f.loadByte(test.value)
+		if f != test.expected {
+			t.Errorf("loadByte(0x%.2x) = %s, expected %s", test.value, f, test.expected)
+		}
+		if b := f.asByte(); b != test.value&0xF0 {
+			t.Errorf("asByte() after loadByte(0x%.2x) = 0x%.2x, expected 0x%.2x", test.value, b, test.value&0xF0)
+		}
+	}
+}
+
+func TestFlagsRoundTripAllValues(t *testing.T) {
+	for value := 0; value <= 0xFF; value++ {
+		var f Flags
+		f.loadByte(byte(value))
+		if b := f.asByte(); b != byte(value)&0xF0 {
+			t.Errorf("asByte() after loadByte(0x%.2x) = 0x%.2x, expected 0x%.2x", value, b, value&0xF0)
+		}
+	}
+}
+
+func TestPushPopAF(t *testing.T) {
+	tests := []struct {
+		name      string
+		a, f      byte // values in the stack
+		expectedF byte
+	}{
+		{"all flags", 0x12, 0xF0, 0xF0},
+		{"no flags", 0x34, 0x00, 0x00},
+		{"lower nibble is discarded", 0x56, 0xFF, 0xF0},
+		{"only lower nibble", 0x78, 0x0F, 0x00},
+		{"z and c", 0x9A, 0x90, 0x90},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// POP AF; PUSH AF
+			cpu, m := newTestCPU(0xF1, 0xF5)
+			cpu.r.sp = 0xD000
+			m.memory[0xD000] = test.f
+			m.memory[0xD001] = test.a
+
+			cpu.Step()
+			if cpu.r.af.a != test.a || cpu.r.af.f.asByte() != test.expectedF {
+				t.Errorf("after POP AF: A=0x%.2x F=0x%.2x, expected A=0x%.2x F=0x%.2x",
+					cpu.r.af.a, cpu.r.af.f.asByte(), test.a, test.expectedF)
+			}
+
+			cpu.Step()
+			if cpu.r.sp != 0xD000 || m.memory[0xD000] != test.expectedF || m.memory[0xD001] != test.a {
+				t.Errorf("after PUSH AF: SP=0x%.4x stack=[0x%.2x 0x%.2x], expected SP=0xd000 stack=[0x%.2x 0x%.2x]",
+					cpu.r.sp, m.memory[0xD000], m.memory[0xD001], test.expectedF, test.a)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package display
 
 import (
+	"github.com/lbarrios/yesSGMB/joypad"
 	"github.com/veandco/go-sdl2/sdl"
 	"sync"
 )
@@ -11,12 +12,30 @@ const (
 	PIXEL_SIZE = 4
 )
 
+const (
+	EVENT_POLL_DELAY_MS = 1 // time to wait when there are no pending events
+	WINDOW_TITLE        = "yesSGMB"
+	RUMBLE_TITLE        = "RUMBLE" // shown in the title while the rumble motor is on
+	COLOR_SCHEME_KEY    = sdl.K_F1 // cycles the color schemes
+)
+
 type Display struct {
-	data     []byte
-	window   *sdl.Window
-	renderer *sdl.Renderer
-	texture  *sdl.Texture
-	cycle    uint64
+	data        []byte
+	window      *sdl.Window
+	renderer    *sdl.Renderer
+	texture     *sdl.Texture
+	cycle       uint64
+	pixels      [HEIGHT * WIDTH]byte // last presented frame
+	frames      chan [HEIGHT * WIDTH]byte
+	schemes     []ColorScheme
+	scheme      int // index of the current color scheme
+	rumble      chan bool
+	rumbleOn    bool
+	stop        chan struct{}
+	stopOnce    sync.Once
+	keymap      Keymap
+	joypad      joypad.Joypad
+	quitHandler func()
 }
 
 func (d *Display) Init() {
@@ -24,7 +43,7 @@ func (d *Display) Init() {
 		panic(err)
 	}
 
-	window, err := sdl.CreateWindow("yesSGMB", sdl.WINDOWPOS_UNDEFINED, sdl.WINDOWPOS_UNDEFINED,
+	window, err := sdl.CreateWindow(WINDOW_TITLE, sdl.WINDOWPOS_UNDEFINED, sdl.WINDOWPOS_UNDEFINED,
 		256, 256, sdl.WINDOW_SHOWN)
 	if err != nil {
 		panic(err)
@@ -46,42 +65,115 @@ func (d *Display) Init() {
 	d.texture = texture
 
 	d.data = make([]byte, HEIGHT*WIDTH*PIXEL_SIZE)
+	d.frames = make(chan [HEIGHT * WIDTH]byte, 1)
+	d.rumble = make(chan bool, 1)
+	d.stop = make(chan struct{})
+	if d.keymap == nil {
+		d.keymap = DefaultKeymap()
+	}
+	if d.schemes == nil {
+		d.SetColorScheme(BuiltinColorSchemes[0])
+	}
+}
+
+// ConnectJoypad sets the joypad that receives the keys pressed in the window.
+func (d *Display) ConnectJoypad(j joypad.Joypad) {
+	d.joypad = j
+}
+
+// SetKeymap replaces the mapping between keyboard keys and GameBoy buttons.
+func (d *Display) SetKeymap(keymap Keymap) {
+	d.keymap = keymap
+}
+
+// SetColorScheme selects the colors used to present the frames. The color schemes
+// can be cycled at runtime with COLOR_SCHEME_KEY, among the built in ones and this one.
+func (d *Display) SetColorScheme(scheme ColorScheme) {
+	d.schemes = append([]ColorScheme{}, BuiltinColorSchemes...)
+	d.scheme = -1
+	for i, builtin := range d.schemes {
+		if builtin == scheme {
+			d.scheme = i
+		}
+	}
+	if d.scheme == -1 {
+		d.schemes = append([]ColorScheme{scheme}, d.schemes...)
+		d.scheme = 0
+	}
+}
+
+func (d *Display) nextColorScheme() {
+	d.scheme = (d.scheme + 1) % len(d.schemes)
+	d.updateTitle()
+	d.present(d.pixels)
+}
+
+// SetRumble shows whether the rumble motor of the cartridge is on.
+// It can be called from any goroutine, as long as it is always the same one.
+func (d *Display) SetRumble(on bool) {
+	// Only the last state matters, so the one not shown yet is replaced
+	select {
+	case <-d.rumble:
+	default:
+	}
+	d.rumble <- on
+}
+
+func (d *Display) updateTitle() {
+	title := WINDOW_TITLE + " - " + d.schemes[d.scheme].Name
+	if d.rumbleOn {
+		title += " - " + RUMBLE_TITLE
+	}
+	d.window.SetTitle(title)
+}
+
+// SetQuitHandler sets the function called when the window is closed,
+// which is expected to shut down the emulator.
+func (d *Display) SetQuitHandler(handler func()) {
+	d.quitHandler = handler
 }
 
-func (d *Display) Disconnect(wg *sync.WaitGroup) {
-	defer d.renderer.Destroy()
-	defer d.window.Destroy()
-	wg.Done()
+// Stop makes Run return, it can be called from any goroutine.
+func (d *Display) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
 }
 
+func (d *Display) Destroy() {
+	d.texture.Destroy()
+	d.renderer.Destroy()
+	d.window.Destroy()
+	sdl.Quit()
+}
+
+// Refresh queues the pixels to be presented.
+// Each pixel is a shade from 0 (lightest) to 3 (darkest), with the palettes already applied,
+// and the layer it belongs to (see PIXEL_LAYER_SHIFT).
+// It can be called from any goroutine, the frame is dropped if the previous one was not presented yet.
 func (d *Display) Refresh(pixelsGrid [HEIGHT * WIDTH]byte) {
-	for i := 0; i < HEIGHT; i++ {
-		for j := 0; j < WIDTH; j++ {
-			baseIndex := i*WIDTH + j
-			pixel := pixelsGrid[baseIndex]
-			var color byte
-			switch pixel {
-			case 0:
-				color = 196
-			case 1:
-				color = 128
-			case 2:
-				color = 64
-			case 3:
-				color = 0
-			default:
-				panic("can't recognize the pixel value")
-			}
-			outputIndex := PIXEL_SIZE * baseIndex
-			r_index := outputIndex + 0
-			g_index := outputIndex + 1
-			b_index := outputIndex + 2
-			a_index := outputIndex + 3
-			d.data[r_index] = 64
-			d.data[g_index] = color
-			d.data[b_index] = color
-			d.data[a_index] = byte(255)
+	select {
+	case d.frames <- pixelsGrid:
+	default:
+	}
+}
+
+// Converts the pixels to the display format with the current color scheme
+func (d *Display) present(pixelsGrid [HEIGHT * WIDTH]byte) {
+	d.pixels = pixelsGrid
+	scheme := &d.schemes[d.scheme]
+	for i, pixel := range pixelsGrid {
+		layer := int(pixel >> PIXEL_LAYER_SHIFT)
+		if layer >= LAYER_COUNT {
+			panic("can't recognize the pixel layer")
 		}
+		color := scheme.Layers[layer][pixel&PIXEL_SHADE_MASK]
+		// ARGB8888 is stored as BGRA in little endian
+		outputIndex := PIXEL_SIZE * i
+		d.data[outputIndex+0] = color.B
+		d.data[outputIndex+1] = color.G
+		d.data[outputIndex+2] = color.R
+		d.data[outputIndex+3] = byte(255)
 	}
 	d.texture.Update(nil, d.data, WIDTH*4)
 	d.renderer.Copy(d.texture, nil, nil)
@@ -89,7 +181,52 @@ func (d *Display) Refresh(pixelsGrid [HEIGHT * WIDTH]byte) {
 	d.cycle++
 }
 
-func (d *Display) Run(wg *sync.WaitGroup) {
+// Run is the SDL event loop, it must be called from the main goroutine.
+// It presents the frames sent by Refresh, and handles the window and keyboard events
+// until the window is closed or Stop is called.
+func (d *Display) Run() {
 	d.renderer.Present()
-	return
+	for {
+		select {
+		case <-d.stop:
+			return
+		case pixels := <-d.frames:
+			d.present(pixels)
+		case on := <-d.rumble:
+			d.rumbleOn = on
+			d.updateTitle()
+		default:
+		}
+
+		event := sdl.PollEvent()
+		if event == nil {
+			sdl.Delay(EVENT_POLL_DELAY_MS)
+			continue
+		}
+		for ; event != nil; event = sdl.PollEvent() {
+			d.handleEvent(event)
+		}
+	}
+}
+
+func (d *Display) handleEvent(event sdl.Event) {
+	switch e := event.(type) {
+	case *sdl.QuitEvent:
+		if d.quitHandler != nil {
+			d.quitHandler()
+		} else {
+			d.Stop()
+		}
+	case *sdl.KeyboardEvent:
+		if e.Repeat != 0 {
+			return
+		}
+		if button, ok := d.keymap[e.Keysym.Sym]; ok {
+			if d.joypad != nil {
+				d.joypad.SetButton(button, e.Type == sdl.KEYDOWN)
+			}
+		} else if e.Keysym.Sym == COLOR_SCHEME_KEY && e.Type == sdl.KEYDOWN {
+			d.nextColorScheme()
+		}
+	}
 }
@@ -0,0 +1,56 @@
+package display
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lbarrios/yesSGMB/joypad"
+	"github.com/veandco/go-sdl2/sdl"
+	"strings"
+)
+
+// Keymap maps the keyboard keys to the GameBoy buttons.
+type Keymap map[sdl.Keycode]joypad.Button
+
+func DefaultKeymap() Keymap {
+	return Keymap{
+		sdl.K_RIGHT:     joypad.BUTTON_RIGHT,
+		sdl.K_LEFT:      joypad.BUTTON_LEFT,
+		sdl.K_UP:        joypad.BUTTON_UP,
+		sdl.K_DOWN:      joypad.BUTTON_DOWN,
+		sdl.K_x:         joypad.BUTTON_A,
+		sdl.K_z:         joypad.BUTTON_B,
+		sdl.K_BACKSPACE: joypad.BUTTON_SELECT,
+		sdl.K_RETURN:    joypad.BUTTON_START,
+	}
+}
+
+// ParseKeymap overrides the default keymap with a list of button=key pairs separated by commas,
+// where the keys are SDL key names, for example: "a=s,b=a,start=Return,select=Right Shift".
+func ParseKeymap(definition string) (Keymap, error) {
+	keymap := DefaultKeymap()
+	if strings.TrimSpace(definition) == "" {
+		return keymap, nil
+	}
+	for _, pair := range strings.Split(definition, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New(fmt.Sprintf("Invalid keymap entry %q, expected button=key", pair))
+		}
+		button, ok := joypad.ButtonByName(strings.ToLower(strings.TrimSpace(parts[0])))
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Unknown button %q in keymap", parts[0]))
+		}
+		key := sdl.GetKeyFromName(strings.TrimSpace(parts[1]))
+		if key == sdl.K_UNKNOWN {
+			return nil, errors.New(fmt.Sprintf("Unknown key %q in keymap", parts[1]))
+		}
+		// A button is bound to a single key, so the default one is removed
+		for k, b := range keymap {
+			if b == button {
+				delete(keymap, k)
+			}
+		}
+		keymap[key] = button
+	}
+	return keymap, nil
+}
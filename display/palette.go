@@ -0,0 +1,156 @@
+package display
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The pixels sent to Refresh hold the shade in the lower 2 bits,
+// and the layer they belong to in the upper ones, so each layer can use its own palette.
+const (
+	PIXEL_SHADE_MASK  = 0x03
+	PIXEL_LAYER_SHIFT = 2
+	LAYER_BACKGROUND  = 0 // background and window
+	LAYER_OBJ0        = 1 // sprites with OBP0
+	LAYER_OBJ1        = 2 // sprites with OBP1
+	LAYER_COUNT       = 3
+	SHADE_COUNT       = 4
+)
+
+const (
+	jascPaletteHeader = "JASC-PAL"
+	paletteComment    = ";"
+)
+
+type Color struct {
+	R, G, B byte
+}
+
+// Palette holds the colors of the 4 shades, from the lightest to the darkest.
+type Palette [SHADE_COUNT]Color
+
+// ColorScheme holds a palette for each layer.
+type ColorScheme struct {
+	Name   string
+	Layers [LAYER_COUNT]Palette
+}
+
+func newColorScheme(name string, palette Palette) ColorScheme {
+	return ColorScheme{Name: name, Layers: [LAYER_COUNT]Palette{palette, palette, palette}}
+}
+
+// Built in color schemes, the first one is the default
+var BuiltinColorSchemes = []ColorScheme{
+	newColorScheme("green", Palette{{0x9B, 0xBC, 0x0F}, {0x8B, 0xAC, 0x0F}, {0x30, 0x62, 0x30}, {0x0F, 0x38, 0x0F}}),
+	newColorScheme("pocket", Palette{{0xE8, 0xE8, 0xE8}, {0xA0, 0xA0, 0xA0}, {0x58, 0x58, 0x58}, {0x10, 0x10, 0x10}}),
+	newColorScheme("light", Palette{{0x00, 0xB5, 0x81}, {0x00, 0x9A, 0x71}, {0x00, 0x69, 0x4A}, {0x00, 0x4F, 0x3B}}),
+	newColorScheme("contrast", Palette{{0xFF, 0xFF, 0xFF}, {0xAA, 0xAA, 0xAA}, {0x55, 0x55, 0x55}, {0x00, 0x00, 0x00}}),
+}
+
+// LoadColorScheme returns the built in scheme with the given name, or else the scheme defined
+// in the given file or list of hex colors. The file can be a JASC .pal file, or a list of hex colors.
+// The lists have 4 colors, used for every layer, or 12 colors, for BG, OBJ0 and OBJ1.
+func LoadColorScheme(definition string) (ColorScheme, error) {
+	for _, scheme := range BuiltinColorSchemes {
+		if strings.EqualFold(scheme.Name, definition) {
+			return scheme, nil
+		}
+	}
+
+	name := "custom"
+	if _, err := os.Stat(definition); err == nil {
+		data, err := ioutil.ReadFile(definition)
+		if err != nil {
+			return ColorScheme{}, err
+		}
+		name = strings.TrimSuffix(filepath.Base(definition), filepath.Ext(definition))
+		definition = string(data)
+	}
+
+	var colors []Color
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(definition), jascPaletteHeader) {
+		colors, err = parseJascPalette(definition)
+	} else {
+		colors, err = parseHexColors(definition)
+	}
+	if err != nil {
+		return ColorScheme{}, err
+	}
+
+	scheme := ColorScheme{Name: name}
+	switch len(colors) {
+	case SHADE_COUNT:
+		scheme = newColorScheme(name, Palette{colors[0], colors[1], colors[2], colors[3]})
+	case SHADE_COUNT * LAYER_COUNT:
+		for layer := 0; layer < LAYER_COUNT; layer++ {
+			copy(scheme.Layers[layer][:], colors[layer*SHADE_COUNT:])
+		}
+	default:
+		return ColorScheme{}, errors.New(fmt.Sprintf("Invalid palette with %d colors, expected %d or %d", len(colors), SHADE_COUNT, SHADE_COUNT*LAYER_COUNT))
+	}
+	return scheme, nil
+}
+
+// Parses a list of colors as #RRGGBB, 0xRRGGBB or RRGGBB, separated by commas or spaces.
+// The text after a ; is a comment.
+func parseHexColors(definition string) ([]Color, error) {
+	var colors []Color
+	for _, line := range strings.Split(definition, "\n") {
+		if i := strings.Index(line, paletteComment); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r'
+		})
+		for _, field := range fields {
+			hex := strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(field), "#"), "0x")
+			value, err := strconv.ParseUint(hex, 16, 32)
+			if len(hex) != 6 || err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid palette color %q, expected #RRGGBB", field))
+			}
+			colors = append(colors, Color{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	return colors, nil
+}
+
+// Parses a JASC palette file:
+//
+//	JASC-PAL
+//	0100
+//	<number of colors>
+//	<R> <G> <B>
+//	...
+func parseJascPalette(definition string) ([]Color, error) {
+	lines := strings.Split(strings.TrimSpace(definition), "\n")
+	if len(lines) < 3 {
+		return nil, errors.New("Invalid JASC palette, the header is incomplete")
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(lines[2]))
+	if err != nil || count != len(lines)-3 {
+		return nil, errors.New(fmt.Sprintf("Invalid JASC palette, expected %d colors", len(lines)-3))
+	}
+	var colors []Color
+	for _, line := range lines[3:] {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errors.New(fmt.Sprintf("Invalid JASC palette color %q, expected R G B", line))
+		}
+		var rgb [3]byte
+		for i, field := range fields {
+			value, err := strconv.ParseUint(field, 10, 8)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid JASC palette color %q, expected R G B", line))
+			}
+			rgb[i] = byte(value)
+		}
+		colors = append(colors, Color{rgb[0], rgb[1], rgb[2]})
+	}
+	return colors, nil
+}
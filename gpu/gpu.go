@@ -7,6 +7,7 @@ import (
 	"github.com/lbarrios/yesSGMB/logger"
 	"github.com/lbarrios/yesSGMB/mmu"
 	"github.com/lbarrios/yesSGMB/types"
+	"sort"
 	"sync"
 )
 
@@ -31,6 +32,11 @@ const ( // Memory Mapped
 	SCX_ADDRESS  types.Word = 0xFF43
 	LY_ADDRESS   types.Word = 0xFF44
 	LYC_ADDRESS  types.Word = 0xFF45
+	BGP_ADDRESS  types.Word = 0xFF47
+	OBP0_ADDRESS types.Word = 0xFF48
+	OBP1_ADDRESS types.Word = 0xFF49
+	WY_ADDRESS   types.Word = 0xFF4A
+	WX_ADDRESS   types.Word = 0xFF4B
 )
 
 const (
@@ -41,6 +47,22 @@ const (
 	TILE_HEIGHT_PIXELS = 8
 	TILE_HEIGHT_BYTES  = 2
 	LINE_COUNT         = 256
+	WINDOW_X_OFFSET    = 7   // the window is drawn starting at WX-7
+	WINDOW_MAX_X       = 166 // the window is not visible with a greater WX
+)
+
+const ( // Sprites
+	SPRITE_COUNT          = 40 // sprites in the OAM
+	SPRITE_SIZE_BYTES     = 4  // y, x, tile index and attributes
+	MAX_SPRITES_PER_LINE  = 10
+	SPRITE_Y_OFFSET       = 16 // the sprite y position is stored plus 16
+	SPRITE_X_OFFSET       = 8  // the sprite x position is stored plus 8
+	SPRITE_HEIGHT_PIXELS  = 8
+	SPRITE_HEIGHT_LARGE   = 16 // 8x16 mode
+	SPRITE_BG_PRIORITY    = 7  // attribute bit 7: the sprite is drawn behind the background colors 1-3
+	SPRITE_Y_FLIP         = 6  // attribute bit 6
+	SPRITE_X_FLIP         = 5  // attribute bit 5
+	SPRITE_PALETTE_NUMBER = 4  // attribute bit 4: 0 = OBP0, 1 = OBP1
 )
 
 const ( // Video modes
@@ -59,13 +81,14 @@ const ( // Video modes cycles
 )
 
 const ( // Interruptions
-	VBLANK_IRQ = 0x01 // bit 1
-	LCD_IRQ    = 0x02 // bit 2
+	VBLANK_IRQ = mmu.VBLANK_INTERRUPT   // bit 0
+	LCD_IRQ    = mmu.LCD_STAT_INTERRUPT // bit 1
 )
 
 type gpu struct {
 	clock       clock.ClockCounter
 	irqHandler  mmu.IRQHandler
+	dma         mmu.DMAState
 	display     *display.Display
 	log         logger.Logger
 	lcdControl  *byte // lcdc = 0xFF40
@@ -74,6 +97,11 @@ type gpu struct {
 	scrollX     *byte // scx = 0xFF43
 	currentLine *byte // ly = 0xFF44
 	lyc         *byte // lyc = 0xFF45
+	bgp         *byte // bgp = 0xFF47
+	obp0        *byte // obp0 = 0xFF48
+	obp1        *byte // obp1 = 0xFF49
+	windowY     *byte // wy = 0xFF4A
+	windowX     *byte // wx = 0xFF4B
 	videoRam    [1 + VIDEO_RAM_END - VIDEO_RAM_START]*byte
 	oam         [1 + OAM_END - OAM_START]*byte
 	tileMap0    [TILEMAP_SIZE]*byte
@@ -81,12 +109,16 @@ type gpu struct {
 	tileData0   [TILEDATA_SIZE]*byte
 	tileData1   [TILEDATA_SIZE]*byte
 
-	internalData [LINE_WIDTH_PIXELS][LINE_COUNT]byte
+	internalData [display.WIDTH][display.HEIGHT]byte // shades, after applying the palettes, and display layers
+	lineIndexes  [display.WIDTH]byte                 // background and window color indexes of the current line, before applying BGP
 
 	displayOn    bool
 	backgroundOn bool
 	windowOn     bool
 	spritesOn    bool
+
+	windowTriggered bool // LY has reached WY in the current frame
+	windowLine      byte // internal line counter, it only advances on the lines where the window is drawn
 }
 
 func NewGpu(mmu mmu.IRQHandler, l *logger.Logger) *gpu {
@@ -102,6 +134,11 @@ func (gpu *gpu) ConnectClock(clockWg *sync.WaitGroup, clock clock.Clock) chan ui
 	return gpu.clock.Channel
 }
 
+// ConnectDMA lets the GPU know when the OAM is being written by a DMA transfer.
+func (gpu *gpu) ConnectDMA(dma mmu.DMAState) {
+	gpu.dma = dma
+}
+
 func (gpu *gpu) ConnectDisplay(d *display.Display) {
 	gpu.display = d
 }
@@ -125,6 +162,16 @@ func (gpu *gpu) MapByte(logical_address types.Address, physical_address *byte) {
 		gpu.currentLine = physical_address
 	case addr == LYC_ADDRESS:
 		gpu.lyc = physical_address
+	case addr == BGP_ADDRESS:
+		gpu.bgp = physical_address
+	case addr == OBP0_ADDRESS:
+		gpu.obp0 = physical_address
+	case addr == OBP1_ADDRESS:
+		gpu.obp1 = physical_address
+	case addr == WY_ADDRESS:
+		gpu.windowY = physical_address
+	case addr == WX_ADDRESS:
+		gpu.windowX = physical_address
 	case addr >= VIDEO_RAM_START && addr <= VIDEO_RAM_END:
 		gpu.videoRam[addr-VIDEO_RAM_START] = physical_address
 		if addr >= TILEDATA1_START && addr < TILEDATA1_START+TILEDATA_SIZE {
@@ -180,16 +227,7 @@ func (gpu *gpu) step() {
 	switch {
 	case gpu.mode() == HBLANK_MODE:
 		//gpu.log.Println("HBLANK")
-		// render the current line
-		if gpu.backgroundOn {
-			gpu.renderBackgroundOnLine()
-		}
-		if gpu.windowOn {
-
-		}
-		if gpu.spritesOn {
-
-		}
+		gpu.renderLine()
 
 		// go to the next line
 		gpu.clock.Cycles += HBLANK_MODE_CYCLES
@@ -206,6 +244,8 @@ func (gpu *gpu) step() {
 		if *gpu.currentLine == 153 {
 			//gpu.log.Println("END OF VBLANK")
 			*gpu.currentLine = 0
+			gpu.windowTriggered = false
+			gpu.windowLine = 0
 			gpu.setMode(OAM_MODE)
 		}
 
@@ -219,6 +259,25 @@ func (gpu *gpu) step() {
 	}
 }
 
+// Renders the current line with all the layers
+func (gpu *gpu) renderLine() {
+	gpu.readLcdControl()
+	if *gpu.currentLine == *gpu.windowY {
+		gpu.windowTriggered = true
+	}
+	if gpu.backgroundOn {
+		gpu.renderBackgroundOnLine()
+		if gpu.windowOn {
+			gpu.renderWindowOnLine()
+		}
+	} else {
+		gpu.clearLine()
+	}
+	if gpu.spritesOn {
+		gpu.renderSpritesOnLine()
+	}
+}
+
 func (gpu *gpu) currentViewportData() [display.WIDTH * display.HEIGHT]byte {
 	var result [display.WIDTH * display.HEIGHT]byte
 	for line := 0; line < display.HEIGHT; line++ {
@@ -231,40 +290,195 @@ func (gpu *gpu) currentViewportData() [display.WIDTH * display.HEIGHT]byte {
 
 func (gpu *gpu) renderBackgroundOnLine() {
 	backgroundTileMap := gpu.getBackgroundTileMap()
-	baseTileIndex := int(*gpu.currentLine/TILE_HEIGHT_PIXELS) * TILES_PER_LINE
-	// Render all the tiles for the current line
-	for i := 0; i < TILES_PER_LINE; i++ {
-		tileIndex := byte(*backgroundTileMap[baseTileIndex+i])
-		tileData := gpu.getTileDataForCurrentLine(tileIndex)
-		for j := 0; j < TILE_WIDTH_PIXELS; j++ {
-			gpu.internalData[i*TILE_WIDTH_PIXELS+j][*gpu.currentLine] = tileData[j]
+	// The viewport is placed at (SCX, SCY) over the 256x256 background,
+	// wrapping around its edges (the byte arithmetic does the wrapping)
+	y := *gpu.currentLine + *gpu.scrollY
+	baseTileIndex := int(y/TILE_HEIGHT_PIXELS) * TILES_PER_LINE
+	var tileData [TILE_WIDTH_PIXELS]byte
+	for column := 0; column < display.WIDTH; column++ {
+		x := byte(column) + *gpu.scrollX
+		// Fetch a new tile at the start of the line and at each tile boundary
+		if column == 0 || x%TILE_WIDTH_PIXELS == 0 {
+			tileIndex := byte(*backgroundTileMap[baseTileIndex+int(x/TILE_WIDTH_PIXELS)])
+			tileData = gpu.getTileDataForLine(tileIndex, y%TILE_HEIGHT_PIXELS)
 		}
+		gpu.setBackgroundPixel(column, tileData[x%TILE_WIDTH_PIXELS])
+	}
+}
+
+func (gpu *gpu) readLcdControl() {
+	// lcdControl (LCDC - 0xFF40)
+	// Bit 7: LCD Display Enable
+	// Bit 5: Window Display Enable
+	// Bit 1: OBJ (Sprite) Display Enable
+	// Bit 0: BG and Window Display Enable
+	gpu.displayOn = types.BitIsSet(*gpu.lcdControl, 7)
+	gpu.windowOn = types.BitIsSet(*gpu.lcdControl, 5)
+	gpu.spritesOn = types.BitIsSet(*gpu.lcdControl, 1)
+	gpu.backgroundOn = types.BitIsSet(*gpu.lcdControl, 0)
+}
+
+// With the background disabled, the line is blank (white), regardless of BGP
+func (gpu *gpu) clearLine() {
+	for column := 0; column < display.WIDTH; column++ {
+		gpu.lineIndexes[column] = 0
+		gpu.internalData[column][*gpu.currentLine] = 0
 	}
 }
 
+// Returns the shade of the color index in the palette register.
+//
+//	Bit 7-6 - Shade for Color Number 3
+//	Bit 5-4 - Shade for Color Number 2
+//	Bit 3-2 - Shade for Color Number 1
+//	Bit 1-0 - Shade for Color Number 0
+func applyPalette(palette byte, color byte) byte {
+	return (palette >> (color * 2)) & 0x03
+}
+
+// Draws a background or window pixel in the current line, keeping
+// its color index for the sprite priority.
+func (gpu *gpu) setBackgroundPixel(column int, color byte) {
+	gpu.lineIndexes[column] = color
+	gpu.internalData[column][*gpu.currentLine] = applyPalette(*gpu.bgp, color)
+}
+
 func (gpu *gpu) renderWindowOnLine() {
+	// The window is drawn from the line where LY reached WY, and from the column WX-7
+	if !gpu.windowTriggered || *gpu.windowX > WINDOW_MAX_X {
+		return
+	}
+	windowTileMap := gpu.getWindowTileMap()
+	y := gpu.windowLine
+	baseTileIndex := int(y/TILE_HEIGHT_PIXELS) * TILES_PER_LINE
+	// With WX < 7 the window starts at the left border, but its first columns are hidden
+	start := int(*gpu.windowX) - WINDOW_X_OFFSET
+	firstColumn := 0
+	if start > 0 {
+		firstColumn = start
+	}
+	var tileData [TILE_WIDTH_PIXELS]byte
+	for column := firstColumn; column < display.WIDTH; column++ {
+		x := column - start
+		// Fetch a new tile at the start of the window and at each tile boundary
+		if column == firstColumn || x%TILE_WIDTH_PIXELS == 0 {
+			tileIndex := byte(*windowTileMap[baseTileIndex+x/TILE_WIDTH_PIXELS])
+			tileData = gpu.getTileDataForLine(tileIndex, y%TILE_HEIGHT_PIXELS)
+		}
+		gpu.setBackgroundPixel(column, tileData[x%TILE_WIDTH_PIXELS])
+	}
+	gpu.windowLine++
+}
 
+type sprite struct {
+	index      int // position in the OAM
+	y          int // screen position of the top left corner
+	x          int
+	tile       byte
+	attributes byte
+}
+
+// Returns the sprites in the current line in priority order. At most 10 sprites are selected,
+// the first ones in the OAM, even if they are outside of the screen horizontally.
+func (gpu *gpu) scanOAM(height int) []sprite {
+	// The OAM can't be read while a DMA transfer is writing it
+	if gpu.dma != nil && gpu.dma.DMAActive() {
+		return nil
+	}
+	line := int(*gpu.currentLine)
+	sprites := make([]sprite, 0, MAX_SPRITES_PER_LINE)
+	for i := 0; i < SPRITE_COUNT && len(sprites) < MAX_SPRITES_PER_LINE; i++ {
+		base := i * SPRITE_SIZE_BYTES
+		y := int(*gpu.oam[base]) - SPRITE_Y_OFFSET
+		if line < y || line >= y+height {
+			continue
+		}
+		sprites = append(sprites, sprite{
+			index:      i,
+			y:          y,
+			x:          int(*gpu.oam[base+1]) - SPRITE_X_OFFSET,
+			tile:       *gpu.oam[base+2],
+			attributes: *gpu.oam[base+3],
+		})
+	}
+	// On the DMG, the sprite with the smaller x has priority, and then the first one in the OAM
+	sort.SliceStable(sprites, func(i, j int) bool {
+		return sprites[i].x < sprites[j].x
+	})
+	return sprites
 }
 
 func (gpu *gpu) renderSpritesOnLine() {
+	// lcdControl (LCDC - 0xFF40)
+	// Bit 2: OBJ (Sprite) Size
+	// 0: 8x8
+	// 1: 8x16
+	height := SPRITE_HEIGHT_PIXELS
+	if types.BitIsSet(*gpu.lcdControl, 2) {
+		height = SPRITE_HEIGHT_LARGE
+	}
 
+	// The pixels already taken by a sprite with more priority, even if it is behind the background
+	var taken [display.WIDTH]bool
+	for _, s := range gpu.scanOAM(height) {
+		line := int(*gpu.currentLine) - s.y
+		if types.BitIsSet(s.attributes, SPRITE_Y_FLIP) {
+			line = height - 1 - line
+		}
+		tile := s.tile
+		if height == SPRITE_HEIGHT_LARGE {
+			// In 8x16 mode, the lower bit of the tile index is ignored
+			tile &= 0xFE
+			if line >= TILE_HEIGHT_PIXELS {
+				tile |= 0x01
+			}
+		}
+		tileData := gpu.getSpriteTileDataForLine(tile, byte(line%TILE_HEIGHT_PIXELS))
+		palette, layer := *gpu.obp0, byte(display.LAYER_OBJ0)
+		if types.BitIsSet(s.attributes, SPRITE_PALETTE_NUMBER) {
+			palette, layer = *gpu.obp1, byte(display.LAYER_OBJ1)
+		}
+
+		for i := 0; i < TILE_WIDTH_PIXELS; i++ {
+			column := s.x + i
+			if column < 0 || column >= display.WIDTH || taken[column] {
+				continue
+			}
+			pixel := i
+			if types.BitIsSet(s.attributes, SPRITE_X_FLIP) {
+				pixel = TILE_WIDTH_PIXELS - 1 - i
+			}
+			color := tileData[pixel]
+			// The color 0 is transparent
+			if color == 0 {
+				continue
+			}
+			taken[column] = true
+			// The background priority depends on the color index, not on the shade
+			if types.BitIsSet(s.attributes, SPRITE_BG_PRIORITY) && gpu.lineIndexes[column] != 0 {
+				continue
+			}
+			// The display uses a different color scheme for each sprite palette
+			gpu.internalData[column][*gpu.currentLine] = applyPalette(palette, color) | layer<<display.PIXEL_LAYER_SHIFT
+		}
+	}
 }
 
-func (gpu *gpu) getWindowTileMap() [TILEMAP_SIZE]*byte {
+func (gpu *gpu) getWindowTileMap() *[TILEMAP_SIZE]*byte {
 	// lcdControl (LCDC - 0xFF40)
 	// Bit 6: Window Tile Map Display Select
 	// 0: tilemap0 ( 0x9800 to 0x9BFF )
 	// 1: tilemap1 ( 0x9C00 to 0x9FFF )
 	if types.BitIsSet(*gpu.lcdControl, 6) {
-		return gpu.tileMap1
+		return &gpu.tileMap1
 	} else {
-		return gpu.tileMap0
+		return &gpu.tileMap0
 	}
 }
 
 // Returns the data (2 bytes) corresponding to
-// the parameter tile at the GPU current line
-func (gpu *gpu) getTileDataForCurrentLine(tileIndexByte byte) [TILE_WIDTH_PIXELS]byte {
+// the parameter tile at the parameter line (0 to 7) of the tile
+func (gpu *gpu) getTileDataForLine(tileIndexByte byte, line byte) [TILE_WIDTH_PIXELS]byte {
 	// The indexes are used as follow.
 	// tileData 0: indexes from -128 to 127
 	// tileData 1: indexes from 0 to 255
@@ -273,8 +487,6 @@ func (gpu *gpu) getTileDataForCurrentLine(tileIndexByte byte) [TILE_WIDTH_PIXELS
 	// Bit 4: BG & Window Tile Data Select
 	// 0: tiledata0 ( $8800 to $97FF )
 	// 1: tiledata1 ( $8000 to $8FFF ) (Same area as OBJ)
-	var result [TILE_WIDTH_PIXELS]byte
-
 	var tileIndex int
 	var tileData *[TILEDATA_SIZE]*byte
 	if !types.BitIsSet(*gpu.lcdControl, 4) {
@@ -292,20 +504,30 @@ func (gpu *gpu) getTileDataForCurrentLine(tileIndexByte byte) [TILE_WIDTH_PIXELS
 	}
 
 	tileIndex *= TILE_WIDTH_BYTES*8
-	tileLine := int(TILE_HEIGHT_BYTES * (*gpu.currentLine % TILE_HEIGHT_PIXELS))
+	tileLine := int(TILE_HEIGHT_BYTES * (line % TILE_HEIGHT_PIXELS))
 
 	if tileIndex+tileLine < 0 || tileIndex+tileLine+1 >= 0x1000 {
 		gpu.log.Fatalf("Tile index %d not valid", tileIndex)
 	}
 
-	lowBits := *(tileData[tileIndex+tileLine])
-	highBits := *(tileData[tileIndex+tileLine+1])
+	return decodeTileLine(*(tileData[tileIndex+tileLine]), *(tileData[tileIndex+tileLine+1]))
+}
+
+// Returns the data corresponding to the parameter sprite tile at the parameter line (0 to 7) of the tile.
+// The sprites always use tiledata1 ( $8000 to $8FFF ) with indexes from 0 to 255.
+func (gpu *gpu) getSpriteTileDataForLine(tileIndex byte, line byte) [TILE_WIDTH_PIXELS]byte {
+	offset := int(tileIndex)*TILE_WIDTH_BYTES*8 + int(TILE_HEIGHT_BYTES*line)
+	return decodeTileLine(*(gpu.tileData1[offset]), *(gpu.tileData1[offset+1]))
+}
+
+// Returns the color index of each pixel in a line of a tile, from its two bytes
+func decodeTileLine(lowBits byte, highBits byte) [TILE_WIDTH_PIXELS]byte {
+	var result [TILE_WIDTH_PIXELS]byte
 	for i := uint(0); i < TILE_WIDTH_PIXELS; i++ {
 		lowBit := byte((lowBits & (1 << i)) >> i)
 		highBit := byte((highBits & (1 << i)) >> i)
 		result[TILE_WIDTH_PIXELS-1-i] = highBit<<1 | lowBit // result = 0000 00HL
 	}
-
 	return result
 }
 
@@ -337,17 +559,12 @@ func (gpu *gpu) Run(wg *sync.WaitGroup) {
 	gpu.log.Println("GPU started.")
 
 	for {
-		gpu.clock.WaitNextCycle()
-
-		if *gpu.lcdControl == 0xff {
-			gpu.log.Println("lcdc=0xff, stopping GPU.")
-			gpu.clock.Disconnect(gpu)
+		if !gpu.clock.WaitNextCycle() {
 			break
 		}
 
 		gpu.step()
 	}
 
-	gpu.display.Disconnect(wg)
 	wg.Done()
 }
@@ -0,0 +1,206 @@
+package gpu
+
+import (
+	"github.com/lbarrios/yesSGMB/display"
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/mmu"
+	"github.com/lbarrios/yesSGMB/types"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func newTestLogger() *logger.Logger {
+	l := new(logger.Logger)
+	l.Init()
+	l.Log = log.New(ioutil.Discard, "", 0)
+	return l
+}
+
+// Returns a GPU mapped to the memory in the same way as the emulator does
+func newTestGpu() (*gpu, mmu.MMU) {
+	l := newTestLogger()
+	MMU := mmu.NewMMU(l)
+	GPU := NewGpu(MMU, l)
+	MMU.MapMemoryRegion(GPU, VIDEO_RAM_START.AsAddress(), VIDEO_RAM_END.AsAddress())
+	MMU.MapMemoryRegion(GPU, OAM_START.AsAddress(), OAM_END.AsAddress())
+	for _, address := range []types.Word{LCDC_ADDRESS, STAT_ADDRESS, SCY_ADDRESS, SCX_ADDRESS, LY_ADDRESS, LYC_ADDRESS,
+		BGP_ADDRESS, OBP0_ADDRESS, OBP1_ADDRESS, WY_ADDRESS, WX_ADDRESS} {
+		MMU.MapMemoryAdress(GPU, address.AsAddress())
+	}
+	GPU.Reset()
+	return GPU, MMU
+}
+
+func writeByte(m mmu.MMU, address types.Word, value byte) {
+	m.WriteByte(address.AsAddress(), value)
+}
+
+// Writes the 16 bytes of a tile in tiledata1 ( $8000 to $8FFF )
+func writeTile(m mmu.MMU, tile int, data [16]byte) {
+	for i, b := range data {
+		writeByte(m, TILEDATA1_START+types.Word(tile*16+i), b)
+	}
+}
+
+func solidTile(color byte) [16]byte {
+	var data [16]byte
+	for line := 0; line < 8; line++ {
+		if color&0x01 != 0 {
+			data[line*2] = 0xFF
+		}
+		if color&0x02 != 0 {
+			data[line*2+1] = 0xFF
+		}
+	}
+	return data
+}
+
+func TestBackgroundScrollWrapsAroundTheLastTileMapEntry(t *testing.T) {
+	GPU, m := newTestGpu()
+	writeByte(m, LCDC_ADDRESS, 0x99) // display, tiledata1, tilemap1, background
+	writeByte(m, BGP_ADDRESS, 0xE4)
+	writeTile(m, 1, solidTile(3))
+	// The last entry of tilemap1 (0x9FFF) is the bottom right tile of the background
+	writeByte(m, TILEMAP1_START+TILEMAP_SIZE-1, 1)
+	writeByte(m, SCX_ADDRESS, 0xFC)
+	writeByte(m, SCY_ADDRESS, 0xFC)
+
+	for line := byte(0); line < 8; line++ {
+		writeByte(m, LY_ADDRESS, line)
+		GPU.renderBackgroundOnLine()
+	}
+
+	// The viewport starts 4 pixels before the right and bottom edges, and wraps around to the tile 0
+	for line := 0; line < 8; line++ {
+		for column := 0; column < 8; column++ {
+			expected := byte(0)
+			if line < 4 && column < 4 {
+				expected = 3
+			}
+			if shade := GPU.internalData[column][line]; shade != expected {
+				t.Errorf("pixel (%d, %d) = %d, expected %d", column, line, shade, expected)
+			}
+		}
+	}
+}
+
+// Writes the y, x, tile and attributes of a sprite in the OAM, with the screen coordinates
+func writeSprite(m mmu.MMU, index int, x int, y int, tile byte, attributes byte) {
+	base := OAM_START + types.Word(index*SPRITE_SIZE_BYTES)
+	writeByte(m, base, byte(y+SPRITE_Y_OFFSET))
+	writeByte(m, base+1, byte(x+SPRITE_X_OFFSET))
+	writeByte(m, base+2, tile)
+	writeByte(m, base+3, attributes)
+}
+
+func renderLines(GPU *gpu, m mmu.MMU, lines int) {
+	for line := 0; line < lines; line++ {
+		writeByte(m, LY_ADDRESS, byte(line))
+		GPU.renderLine()
+	}
+}
+
+func TestLastSpriteInOAM(t *testing.T) {
+	GPU, m := newTestGpu()
+	writeByte(m, LCDC_ADDRESS, 0x93) // display, tiledata1, sprites, background
+	writeByte(m, BGP_ADDRESS, 0xE4)
+	writeByte(m, OBP0_ADDRESS, 0xE4)
+	writeTile(m, 1, solidTile(2))
+	writeSprite(m, SPRITE_COUNT-1, 0, 0, 1, 0x00)
+
+	renderLines(GPU, m, 8)
+
+	if shade := GPU.internalData[0][0] & display.PIXEL_SHADE_MASK; shade != 2 {
+		t.Errorf("pixel (0, 0) = %d, expected the sprite shade 2", shade)
+	}
+}
+
+// A reference image in the spirit of dmg-acid2: each 8 pixels column group
+// of the first 16 lines tests one feature of the sprites, in 8x16 mode.
+//
+//	0-7   no flip                     8-15  x flip
+//	16-23 y flip                      24-31 x and y flip
+//	32-39 OBP1                        40-47 behind the background (colors 1-3 on top, 0 below)
+//	48-59 two overlapping sprites, the one with the smaller x is drawn on top even if it is later in the OAM
+//	64-71 two sprites with the same x, the first in the OAM is drawn on top
+//	80-87 an 11th sprite in the line, which is not drawn
+var spritesReference = []string{
+	"1000000000000001222222222222222211111111333333333333333300000000133333330000000000000000",
+	"0100000000000010222222222222222211111111333333333333333300000000313333330000000000000000",
+	"0010000000000100222222222222222211111111333333333333333300000000331333330000000000000000",
+	"0001000000001000222222222222222211111111333333333333333300000000333133330000000000000000",
+	"0000100000010000222222222222222211111111333333333333333310000000333313330000000000000000",
+	"0000010000100000222222222222222211111111333333333333333301000000333331330000000000000000",
+	"0000001001000000222222222222222211111111333333333333333300100000333333130000000000000000",
+	"0000000110000000222222222222222211111111333333333333333300010000333333310000000000000000",
+	"2222222222222222000000011000000033333333222222221111111122220000222222220000000000000000",
+	"2222222222222222000000100100000033333333222222221111111122220000222222220000000000000000",
+	"2222222222222222000001000010000033333333222222221111111122220000222222220000000000000000",
+	"2222222222222222000010000001000033333333222222221111111122220000222222220000000000000000",
+	"2222222222222222000100000000100033333333222222221111111122220000222222220000000000000000",
+	"2222222222222222001000000000010033333333222222221111111122220000222222220000000000000000",
+	"2222222222222222010000000000001033333333222222221111111122220000222222220000000000000000",
+	"2222222222222222100000000000000133333333222222221111111122220000222222220000000000000000",
+}
+
+func TestSpritesReferenceImage(t *testing.T) {
+	GPU, m := newTestGpu()
+	writeByte(m, LCDC_ADDRESS, 0x97) // display, tiledata1, tilemap0, 8x16 sprites, sprites, background
+	writeByte(m, BGP_ADDRESS, 0xE4)
+	writeByte(m, OBP0_ADDRESS, 0xE4)
+	writeByte(m, OBP1_ADDRESS, 0x6C) // colors 1 and 3 swapped, as shades 3 and 1
+
+	// Tile 2 is a diagonal line of color 1, and tiles 3, 4 and 5 are solid colors 2, 3 and 1.
+	// In 8x16 mode, the sprites with tile 2 use tiles 2 and 3, and the sprites with tile 4 use tiles 4 and 5.
+	var diagonal [16]byte
+	for line := 0; line < 8; line++ {
+		diagonal[line*2] = 0x80 >> uint(line)
+	}
+	writeTile(m, 2, diagonal)
+	writeTile(m, 3, solidTile(2))
+	writeTile(m, 4, solidTile(3))
+	writeTile(m, 5, solidTile(1))
+	// The background is color 3 behind the upper half of the sprite with background priority
+	writeByte(m, TILEMAP0_START+5, 4)
+
+	writeSprite(m, 0, 0, 0, 2, 0x00)
+	writeSprite(m, 1, 8, 0, 2, 1<<SPRITE_X_FLIP)
+	writeSprite(m, 2, 16, 0, 2, 1<<SPRITE_Y_FLIP)
+	writeSprite(m, 3, 24, 0, 2, 1<<SPRITE_X_FLIP|1<<SPRITE_Y_FLIP)
+	writeSprite(m, 4, 32, 0, 4, 1<<SPRITE_PALETTE_NUMBER)
+	writeSprite(m, 5, 40, 0, 2, 1<<SPRITE_BG_PRIORITY)
+	writeSprite(m, 6, 52, 0, 2, 0x00)
+	writeSprite(m, 7, 48, 0, 4, 0x00)
+	writeSprite(m, 8, 64, 0, 2, 0x00)
+	writeSprite(m, 9, 64, 0, 4, 0x00)
+	writeSprite(m, 10, 80, 0, 4, 0x00)
+
+	renderLines(GPU, m, len(spritesReference))
+
+	for line, expected := range spritesReference {
+		actual := make([]byte, len(expected))
+		for column := range expected {
+			actual[column] = '0' + GPU.internalData[column][line]&display.PIXEL_SHADE_MASK
+		}
+		if string(actual) != expected {
+			t.Errorf("line %2d: %s\n expected: %s", line, actual, expected)
+		}
+	}
+
+	// Each sprite palette is drawn in its own display layer
+	layers := []struct {
+		column, line int
+		layer        byte
+	}{
+		{0, 8, display.LAYER_OBJ0},
+		{32, 0, display.LAYER_OBJ1},
+		{40, 0, display.LAYER_BACKGROUND},
+		{40, 8, display.LAYER_OBJ0},
+	}
+	for _, test := range layers {
+		if layer := GPU.internalData[test.column][test.line] >> display.PIXEL_LAYER_SHIFT; layer != test.layer {
+			t.Errorf("pixel (%d, %d) layer = %d, expected %d", test.column, test.line, layer, test.layer)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/lbarrios/yesSGMB/cartridge"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type infoResult struct {
+	*cartridge.Info
+	Error string `json:"error,omitempty"`
+}
+
+// runInfo implements the info subcommand, that prints the cartridge header
+// of a rom file (or of all the rom files in a directory) without running the emulator.
+func runInfo(args []string) {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	romPath := flags.String("rom", "", "Path to rom file, or to a directory of rom files")
+	asJSON := flags.Bool("json", false, "Print the cartridge info as JSON")
+	romEntry := flags.String("entry", "", "Name of the rom inside a .zip archive (default: the first .gb or .gbc file)")
+	validation := flags.String("validation", "warn", "Cartridge header validation policy: strict, warn or ignore")
+	flags.Parse(args)
+
+	if *romPath == "" && flags.NArg() > 0 {
+		*romPath = flags.Arg(0)
+	}
+	if *romPath == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	// The cartridge logs go to stderr, so the output can be piped
+	log.Init()
+	log.Log.SetOutput(os.Stderr)
+
+	validationPolicy, err := cartridge.ParseValidationPolicy(*validation)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	// The header of the rom file is shown as is, without the patches next to it
+	options := cartridge.Options{Validation: validationPolicy, ArchiveEntry: *romEntry, DisableAutoPatch: true}
+
+	filenames, batch, err := romFilenames(*romPath)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+
+	results := make([]infoResult, 0, len(filenames))
+	failed := false
+	for _, filename := range filenames {
+		result := infoResult{}
+		// Only the header is parsed, so the cartridge types that are not emulated are also shown
+		if cart, err := cartridge.ReadHeader(filename, options, log); err != nil {
+			result.Info = &cartridge.Info{Filename: filename}
+			result.Error = err.Error()
+			failed = true
+		} else {
+			info := cart.Info()
+			result.Info = &info
+		}
+		results = append(results, result)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if batch {
+			encoder.Encode(results)
+		} else {
+			encoder.Encode(results[0])
+		}
+	} else {
+		for i, result := range results {
+			if i > 0 {
+				fmt.Println()
+			}
+			printInfo(result)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Returns the rom files to inspect, and whether the path is a directory.
+func romFilenames(path string) ([]string, bool, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if !stat.IsDir() {
+		return []string{path}, false, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, true, err
+	}
+	var filenames []string
+	for _, entry := range entries {
+		if !entry.IsDir() && cartridge.IsRomFile(entry.Name()) {
+			filenames = append(filenames, filepath.Join(path, entry.Name()))
+		}
+	}
+	return filenames, true, nil
+}
+
+func printInfo(result infoResult) {
+	info := result.Info
+	fmt.Printf("File:             %s\n", info.Filename)
+	if info.EntryName != "" {
+		fmt.Printf("Entry:            %s\n", info.EntryName)
+	}
+	if result.Error != "" {
+		fmt.Printf("Error:            %s\n", result.Error)
+		return
+	}
+	fmt.Printf("Title:            %s\n", info.Title)
+	fmt.Printf("Manufacturer:     %s\n", info.ManufacturerCode)
+	fmt.Printf("Licensee:         %s (%s)\n", info.Licensee, info.LicenseeDescription)
+	fmt.Printf("CGB:              %.2X (%s)\n", info.CGBFlag, info.CGBSupport)
+	fmt.Printf("SGB:              %.2X (%t)\n", info.SGBFlag, info.SGBSupport)
+	fmt.Printf("Type:             %.2X (%s)\n", info.Type, info.TypeDescription)
+	fmt.Printf("ROM:              %d KB (%d banks)\n", info.ROMSize/1024, info.ROMBanks)
+	fmt.Printf("RAM:              %d KB\n", info.RAMSize/1024)
+	fmt.Printf("Destination:      %.2X (japanese: %t)\n", info.DestinationCode, info.Japanese)
+	fmt.Printf("Version:          %d\n", info.Version)
+	fmt.Printf("Nintendo logo:    valid: %t\n", info.NintendoLogoValid)
+	fmt.Printf("Header checksum:  %.2X (valid: %t)\n", info.HeaderChecksum, info.HeaderChecksumValid)
+	fmt.Printf("Global checksum:  %.4X (valid: %t)\n", info.GlobalChecksum, info.GlobalChecksumValid)
+}
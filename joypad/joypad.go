@@ -0,0 +1,167 @@
+// Package joypad implements the GameBoy buttons and the P1 register (0xFF00),
+// through which the games read them.
+package joypad
+
+import (
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/mmu"
+	"github.com/lbarrios/yesSGMB/types"
+	"sync"
+)
+
+const (
+	P1_ADDRESS = types.Word(0xFF00)
+)
+
+const ( // Interruptions
+	JOYPAD_IRQ = mmu.JOYPAD_INTERRUPT // bit 4
+)
+
+// P1 register
+//
+//	Bit 7-6 - Not used (always 1)
+//	Bit 5   - P15 Select Button Keys      (0=Select)
+//	Bit 4   - P14 Select Direction Keys   (0=Select)
+//	Bit 3   - P13 Input Down  or Start    (0=Pressed) (Read Only)
+//	Bit 2   - P12 Input Up    or Select   (0=Pressed) (Read Only)
+//	Bit 1   - P11 Input Left  or Button B (0=Pressed) (Read Only)
+//	Bit 0   - P10 Input Right or Button A (0=Pressed) (Read Only)
+const (
+	P1_UNUSED_MASK       = 0xC0
+	P1_SELECT_MASK       = 0x30
+	P1_INPUT_MASK        = 0x0F
+	P1_SELECT_DIRECTIONS = 4
+	P1_SELECT_BUTTONS    = 5
+)
+
+type Button int
+
+// The buttons are ordered so that the lower 4 bits are the direction keys
+// and the upper 4 bits are the button keys, each one in the position of its P1 input line.
+const (
+	BUTTON_RIGHT Button = iota
+	BUTTON_LEFT
+	BUTTON_UP
+	BUTTON_DOWN
+	BUTTON_A
+	BUTTON_B
+	BUTTON_SELECT
+	BUTTON_START
+)
+
+var buttonNames = map[Button]string{
+	BUTTON_RIGHT:  "right",
+	BUTTON_LEFT:   "left",
+	BUTTON_UP:     "up",
+	BUTTON_DOWN:   "down",
+	BUTTON_A:      "a",
+	BUTTON_B:      "b",
+	BUTTON_SELECT: "select",
+	BUTTON_START:  "start",
+}
+
+func (b Button) String() string {
+	return buttonNames[b]
+}
+
+// ButtonByName returns the button with the given name (right, left, up, down, a, b, select or start).
+func ButtonByName(name string) (Button, bool) {
+	for button, buttonName := range buttonNames {
+		if buttonName == name {
+			return button, true
+		}
+	}
+	return 0, false
+}
+
+type joypad struct {
+	irqHandler mmu.IRQHandler
+	log        logger.Logger
+	mutex      sync.Mutex
+	pressed    byte // bit n is set when the button n is pressed
+	selection  byte // P14 and P15 as written by the game
+	interrupts byte // interrupts requested while writing the register, taken by the MMU
+}
+
+type Joypad interface {
+	SetButton(button Button, pressed bool)
+}
+
+func NewJoypad(irqHandler mmu.IRQHandler, l *logger.Logger) *joypad {
+	j := new(joypad)
+	j.irqHandler = irqHandler
+	j.log = *l
+	j.log.SetPrefix("\033[0;36mJOYPAD: ")
+	return j
+}
+
+func (j *joypad) Reset() {
+	j.log.Println("Joypad reset triggered.")
+	j.mutex.Lock()
+	j.pressed = 0
+	j.selection = P1_SELECT_MASK
+	j.interrupts = 0
+	j.mutex.Unlock()
+}
+
+// SetButton updates the state of a button. Pressing a button on a selected line
+// (a high to low transition of P10-P13) requests the joypad interrupt.
+// Selecting a group with a pressed button also requests it, see WriteRegister.
+func (j *joypad) SetButton(button Button, pressed bool) {
+	j.mutex.Lock()
+	before := j.inputLines()
+	if pressed {
+		j.pressed |= 1 << uint(button)
+	} else {
+		j.pressed &^= 1 << uint(button)
+	}
+	after := j.inputLines()
+	j.mutex.Unlock()
+
+	// The interrupt is requested without holding the lock, as it accesses the memory
+	if before&^after != 0 {
+		j.irqHandler.RequestInterrupt(JOYPAD_IRQ)
+	}
+}
+
+// Returns the P10-P13 lines, with a 0 for each pressed button of the selected groups.
+func (j *joypad) inputLines() byte {
+	lines := byte(P1_INPUT_MASK)
+	if !types.BitIsSet(j.selection, P1_SELECT_DIRECTIONS) {
+		lines &^= j.pressed & P1_INPUT_MASK
+	}
+	if !types.BitIsSet(j.selection, P1_SELECT_BUTTONS) {
+		lines &^= j.pressed >> 4
+	}
+	return lines
+}
+
+// Called with the memory locked
+func (j *joypad) ReadRegister(address types.Address) byte {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return P1_UNUSED_MASK | j.selection | j.inputLines()
+}
+
+// Called with the memory locked
+func (j *joypad) WriteRegister(address types.Address, value byte) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	before := j.inputLines()
+	// Only the select lines are writable
+	j.selection = value & P1_SELECT_MASK
+	// Selecting a group while one of its buttons is held also pulls an input line low
+	if before&^j.inputLines() != 0 {
+		j.interrupts |= JOYPAD_IRQ
+	}
+}
+
+// TakeInterrupts returns the interrupts requested by the last writes, for the MMU.
+// Called with the memory locked
+func (j *joypad) TakeInterrupts() byte {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	interrupts := j.interrupts
+	j.interrupts = 0
+	return interrupts
+}
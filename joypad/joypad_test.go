@@ -0,0 +1,115 @@
+package joypad
+
+import (
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/mmu"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func newTestLogger() *logger.Logger {
+	l := new(logger.Logger)
+	l.Init()
+	l.Log = log.New(ioutil.Discard, "", 0)
+	return l
+}
+
+// Returns a joypad mapped in a MMU, so the interrupts requested end up in the IF register
+func newTestJoypad() (*joypad, mmu.MMU) {
+	m := mmu.NewMMU(newTestLogger())
+	j := NewJoypad(m, newTestLogger())
+	m.MapRegister(j, P1_ADDRESS.AsAddress())
+	j.Reset()
+	return j, m
+}
+
+// Reports whether the joypad interrupt was requested, and clears it
+func takeJoypadInterrupt(m mmu.MMU) bool {
+	requested := m.ReadByte(mmu.INTERRUPT_FLAG_ADDR.AsAddress())&JOYPAD_IRQ != 0
+	m.AcknowledgeInterrupt(JOYPAD_IRQ)
+	return requested
+}
+
+func TestJoypadSelectLines(t *testing.T) {
+	tests := []struct {
+		name      string
+		pressed   []Button
+		selection byte // value written to P1
+		expected  byte
+	}{
+		{"nothing selected", []Button{BUTTON_A, BUTTON_DOWN}, 0x30, 0xFF},
+		{"directions", []Button{BUTTON_A, BUTTON_DOWN}, 0x20, 0xE7},
+		{"buttons", []Button{BUTTON_A, BUTTON_DOWN}, 0x10, 0xDE},
+		{"both groups", []Button{BUTTON_A, BUTTON_DOWN}, 0x00, 0xC6},
+		{"start and select", []Button{BUTTON_START, BUTTON_SELECT}, 0x10, 0xD3},
+		{"right and left", []Button{BUTTON_RIGHT, BUTTON_LEFT}, 0x20, 0xEC},
+		{"no buttons pressed", nil, 0x00, 0xCF},
+		// The input lines are read only
+		{"input lines written", nil, 0x2F, 0xEF},
+	}
+	for _, test := range tests {
+		j, m := newTestJoypad()
+		for _, button := range test.pressed {
+			j.SetButton(button, true)
+		}
+		m.WriteByte(P1_ADDRESS.AsAddress(), test.selection)
+		if got := m.ReadByte(P1_ADDRESS.AsAddress()); got != test.expected {
+			t.Errorf("%s: P1 reads %.2X, expected %.2X", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestJoypadInterrupt(t *testing.T) {
+	type action func(j *joypad, m mmu.MMU)
+	press := func(button Button) action {
+		return func(j *joypad, m mmu.MMU) { j.SetButton(button, true) }
+	}
+	release := func(button Button) action {
+		return func(j *joypad, m mmu.MMU) { j.SetButton(button, false) }
+	}
+	write := func(value byte) action {
+		return func(j *joypad, m mmu.MMU) { m.WriteByte(P1_ADDRESS.AsAddress(), value) }
+	}
+	tests := []struct {
+		name      string
+		setup     []action
+		action    action
+		interrupt bool
+	}{
+		{"pressing a selected button", []action{write(0x10)}, press(BUTTON_A), true},
+		{"pressing a selected direction", []action{write(0x20)}, press(BUTTON_UP), true},
+		{"pressing an unselected button", []action{write(0x20)}, press(BUTTON_A), false},
+		{"pressing with nothing selected", []action{write(0x30)}, press(BUTTON_A), false},
+		{"releasing a selected button", []action{write(0x10), press(BUTTON_A)}, release(BUTTON_A), false},
+		{"pressing a button on a line already low", []action{write(0x00), press(BUTTON_A)}, press(BUTTON_RIGHT), false},
+		{"selecting the group of a held button", []action{write(0x30), press(BUTTON_START)}, write(0x10), true},
+		{"selecting the other group of a held button", []action{write(0x30), press(BUTTON_START)}, write(0x20), false},
+		{"selecting a group without held buttons", []action{write(0x30)}, write(0x10), false},
+		{"switching groups with held buttons on different lines", []action{write(0x20), press(BUTTON_DOWN), press(BUTTON_A)}, write(0x10), true},
+		{"switching groups with held buttons on the same line", []action{write(0x20), press(BUTTON_RIGHT), press(BUTTON_A)}, write(0x10), false},
+		{"selecting the same group again", []action{write(0x10), press(BUTTON_A)}, write(0x10), false},
+		{"deselecting the group of a held button", []action{write(0x10), press(BUTTON_A)}, write(0x30), false},
+	}
+	for _, test := range tests {
+		j, m := newTestJoypad()
+		for _, setup := range test.setup {
+			setup(j, m)
+		}
+		takeJoypadInterrupt(m)
+		test.action(j, m)
+		if got := takeJoypadInterrupt(m); got != test.interrupt {
+			t.Errorf("%s: interrupt requested = %t, expected %t", test.name, got, test.interrupt)
+		}
+	}
+}
+
+func TestJoypadResetClearsPendingInterrupts(t *testing.T) {
+	j, _ := newTestJoypad()
+	j.SetButton(BUTTON_B, true)
+	j.WriteRegister(P1_ADDRESS.AsAddress(), 0x10)
+	j.Reset()
+	if interrupts := j.TakeInterrupts(); interrupts != 0 {
+		t.Errorf("interrupts %.2X pending after the reset, expected none", interrupts)
+	}
+}
@@ -7,19 +7,61 @@ import (
 	"github.com/lbarrios/yesSGMB/cpu"
 	"github.com/lbarrios/yesSGMB/display"
 	"github.com/lbarrios/yesSGMB/gpu"
+	"github.com/lbarrios/yesSGMB/joypad"
 	"github.com/lbarrios/yesSGMB/logger"
 	"github.com/lbarrios/yesSGMB/mmu"
+	"github.com/lbarrios/yesSGMB/serial"
 	"github.com/lbarrios/yesSGMB/timer"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
 	"sync"
 )
 
 var (
-	romFile = flag.String("rom", "test.gb", "Path to rom file")
-	log     = new(logger.Logger)
-	wg      sync.WaitGroup
+	romFile     = flag.String("rom", "test.gb", "Path to rom file")
+	saveFile    = flag.String("save", "", "Path to battery save file (default: rom file with .sav extension)")
+	validation  = flag.String("validation", "strict", "Cartridge header validation policy: strict, warn or ignore")
+	romEntry    = flag.String("entry", "", "Name of the rom inside a .zip archive (default: the first .gb or .gbc file)")
+	bootROMFile = flag.String("bootrom", "", "Path to DMG boot rom file (default: start directly at the cartridge entry point)")
+	noAutoPatch = flag.Bool("noautopatch", false, "Don't apply the patches found next to the rom file (<rom>.ips, .ups, .bps)")
+	keys        = flag.String("keymap", "", "Keyboard mapping as button=key pairs, e.g. \"a=s,b=a,start=Return\" (default: arrows, x, z, Backspace, Return)")
+	linkMode    = flag.String("link", "none", "Link cable connection: none, capture (write the sent bytes to -linkout), loopback, listen or connect (to another emulator at -linkaddr), or printer (saving to -printdir)")
+	linkAddress = flag.String("linkaddr", "localhost:5555", "TCP address to listen or connect to, in listen and connect link modes")
+	linkOutput  = flag.String("linkout", "serial.log", "Output file for the captured link cable bytes (\"-\" for the standard output)")
+	printDir    = flag.String("printdir", "prints", "Directory where the GameBoy Printer saves the printed images, in printer link mode")
+	palette     = flag.String("palette", "green", "Color scheme: green, pocket, light, contrast, a .pal or hex colors file, or a list of hex colors (4, or 12 for BG, OBJ0 and OBJ1). F1 cycles the schemes")
+	patchFiles  stringList
+	log         = new(logger.Logger)
+	wg          sync.WaitGroup
 )
 
+func init() {
+	// SDL must be used from the main thread
+	runtime.LockOSThread()
+	flag.Var(&patchFiles, "patch", "Path to an IPS, UPS or BPS patch file (can be repeated)")
+}
+
+// stringList is a flag that can be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "info" {
+		runInfo(os.Args[2:])
+		return
+	}
+
 	// Parsing the parameters
 	flag.Parse()
 
@@ -27,14 +69,41 @@ func main() {
 	log.Init()
 
 	// Loading the cartridge data
-	cart, err := cartridge.NewCartridge(*romFile, log)
+	validationPolicy, err := cartridge.ParseValidationPolicy(*validation)
 	if err != nil {
 		log.Fatalf("ERROR: %s", err)
 	}
+	cart, err := cartridge.NewCartridge(*romFile, cartridge.Options{
+		Validation:       validationPolicy,
+		ArchiveEntry:     *romEntry,
+		Patches:          patchFiles,
+		DisableAutoPatch: *noAutoPatch,
+	}, log)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+
+	// Loading the battery backed RAM
+	if *saveFile == "" {
+		*saveFile = cart.DefaultSaveFilename()
+	}
+	if err := cart.LoadSaveFile(*saveFile); err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	cart.StartAutoSave()
 
 	// Initialize the Memory Management Unit
 	MMU := mmu.NewMMU(log)
 	MMU.LoadCartridge(cart)
+	if *bootROMFile != "" {
+		bootROM, err := ioutil.ReadFile(*bootROMFile)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		if err := MMU.LoadBootROM(bootROM); err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+	}
 
 	// Initialize the Central Processing Unit
 	CPU := cpu.NewCPU(MMU, log)
@@ -49,35 +118,100 @@ func main() {
 	MMU.MapMemoryAdress(GPU, gpu.SCX_ADDRESS.AsAddress())
 	MMU.MapMemoryAdress(GPU, gpu.LY_ADDRESS.AsAddress())
 	MMU.MapMemoryAdress(GPU, gpu.LYC_ADDRESS.AsAddress())
+	MMU.MapMemoryAdress(GPU, gpu.BGP_ADDRESS.AsAddress())
+	MMU.MapMemoryAdress(GPU, gpu.OBP0_ADDRESS.AsAddress())
+	MMU.MapMemoryAdress(GPU, gpu.OBP1_ADDRESS.AsAddress())
+	MMU.MapMemoryAdress(GPU, gpu.WY_ADDRESS.AsAddress())
+	MMU.MapMemoryAdress(GPU, gpu.WX_ADDRESS.AsAddress())
+	GPU.ConnectDMA(MMU)
 	GPU.Reset()
 
 	// Initialize the Timer
-	Timer := timer.NewTimer(log)
-	MMU.MapMemoryAdress(Timer, timer.DIV_ADDRESS.AsAddress())
-	MMU.MapMemoryAdress(Timer, timer.TIMA_ADDRESS.AsAddress())
-	MMU.MapMemoryAdress(Timer, timer.TMA_ADDRESS.AsAddress())
-	MMU.MapMemoryAdress(Timer, timer.TAC_ADDRESS.AsAddress())
-	Timer.Reset()
+	Timer := timer.NewTimer(MMU, log)
+	MMU.MapRegister(Timer, timer.DIV_ADDRESS.AsAddress())
+	MMU.MapRegister(Timer, timer.TIMA_ADDRESS.AsAddress())
+	MMU.MapRegister(Timer, timer.TMA_ADDRESS.AsAddress())
+	MMU.MapRegister(Timer, timer.TAC_ADDRESS.AsAddress())
+	Timer.Reset(MMU.BootROMEnabled())
+
+	// Initialize the Joypad
+	Joypad := joypad.NewJoypad(MMU, log)
+	MMU.MapRegister(Joypad, joypad.P1_ADDRESS.AsAddress())
+	Joypad.Reset()
+
+	// Initialize the Serial port
+	link, err := serial.OpenLinkPort(serial.LinkOptions{
+		Mode:           *linkMode,
+		Output:         *linkOutput,
+		Address:        *linkAddress,
+		PrintDirectory: *printDir,
+	}, log)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	Serial := serial.NewSerial(MMU, log)
+	MMU.MapRegister(Serial, serial.SB_ADDRESS.AsAddress())
+	MMU.MapRegister(Serial, serial.SC_ADDRESS.AsAddress())
+	Serial.ConnectLink(link)
+	Serial.Reset()
 
 	// Initialize the Clock
 	Clock := clock.NewClock(log)
 	Clock.ConnectPeripheral(CPU)
 	Clock.ConnectPeripheral(Timer)
+	Clock.ConnectPeripheral(Serial)
 	Clock.ConnectPeripheral(GPU)
+	Clock.ConnectPeripheral(MMU.DMA())
 
 	// Initialize the Display
+	keymap, err := display.ParseKeymap(*keys)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
+	colorScheme, err := display.LoadColorScheme(*palette)
+	if err != nil {
+		log.Fatalf("ERROR: %s", err)
+	}
 	Display := display.Display{}
 	Display.Init()
+	Display.SetKeymap(keymap)
+	Display.SetColorScheme(colorScheme)
+	Display.ConnectJoypad(Joypad)
+	Display.SetQuitHandler(Clock.Stop)
 	GPU.ConnectDisplay(&Display)
+	if cart.HasRumble() {
+		log.Println("The cartridge has a rumble motor, its state is shown in the window title.")
+		cart.SetRumbleHandler(Display.SetRumble)
+	}
 
 	// Run all the components
-	wg.Add(5)
+	wg.Add(6)
 	go CPU.Run(&wg)
 	go GPU.Run(&wg)
 	go Timer.Run(&wg)
+	go Serial.Run(&wg)
+	go MMU.DMA().Run(&wg)
 	go Clock.Run(&wg)
-	go Display.Run(&wg)
+
+	// The display event loop runs in the main goroutine until the window is closed,
+	// or until all the components have finished
+	go func() {
+		wg.Wait()
+		Display.Stop()
+	}()
+	Display.Run()
+
+	// Disconnect the link cable, as the serial port may be waiting for the other end
+	if err := link.Close(); err != nil {
+		log.Printf("ERROR: %s", err)
+	}
 
 	// Wait to exit the program
 	wg.Wait()
+	Display.Destroy()
+
+	// Flush the battery backed RAM
+	if err := cart.Close(); err != nil {
+		log.Printf("ERROR: %s", err)
+	}
 }
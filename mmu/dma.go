@@ -0,0 +1,111 @@
+package mmu
+
+import (
+	"github.com/lbarrios/yesSGMB/clock"
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/types"
+	"sync"
+)
+
+const (
+	DMA_ADDRESS         = types.Word(0xFF46)
+	DMA_LENGTH          = 0xA0 // 160 bytes, the whole OAM
+	DMA_CYCLES_PER_BYTE = 4    // one byte is transferred per machine cycle
+)
+
+// DMAState is implemented by the MMU, so the other peripherals
+// can know when the OAM is being written by a DMA transfer.
+type DMAState interface {
+	DMAActive() bool
+}
+
+// dma implements the OAM DMA transfer. Writing XX to 0xFF46 copies
+// XX00-XX9F to FE00-FE9F, one byte per machine cycle.
+// While the transfer is active, the CPU can only access the IO ports and the high RAM.
+type dma struct {
+	mmu    *mmu
+	clock  clock.ClockCounter
+	log    logger.Logger
+	value  byte // last value written to 0xFF46
+	source types.Word
+	index  types.Word
+	active bool
+}
+
+func newDMA(mmu *mmu, l *logger.Logger) *dma {
+	d := new(dma)
+	d.mmu = mmu
+	d.log = *l
+	d.log.SetPrefix("\033[0;33mDMA: ")
+	return d
+}
+
+// DMA returns the OAM DMA controller, which must be connected to the clock.
+func (mmu *mmu) DMA() *dma {
+	return mmu.dma
+}
+
+func (mmu *mmu) DMAActive() bool {
+	mmu.memoryLock.Lock()
+	defer mmu.memoryLock.Unlock()
+	return mmu.dma.active
+}
+
+func (d *dma) ConnectClock(clockWg *sync.WaitGroup, clock clock.Clock) chan uint64 {
+	d.clock.Init(clockWg, make(chan uint64), clock)
+	return d.clock.Channel
+}
+
+func (d *dma) GetName() string {
+	return "dma"
+}
+
+// Called with the memory locked
+func (d *dma) ReadRegister(address types.Address) byte {
+	return d.value
+}
+
+// Called with the memory locked. Writing while a transfer is active restarts it.
+func (d *dma) WriteRegister(address types.Address, value byte) {
+	d.value = value
+	d.source = types.WordFromBytes(value, 0x00)
+	d.index = 0
+	d.active = true
+}
+
+// Reports whether the CPU can't access the address because of an active transfer.
+// Called with the memory locked.
+func (d *dma) blocksAddress(address types.Address) bool {
+	return d.active && address.AsWord() < IO_PORTS
+}
+
+func (d *dma) step() {
+	d.mmu.memoryLock.Lock()
+	if d.active {
+		address := d.source + d.index
+		if address >= ECHO_8KB_INTERNAL_RAM {
+			// The DMA sees everything from E000 upwards as the echo of the internal RAM,
+			// so the sources FE and FF copy DE00-DF9F instead of the OAM and the IO ports.
+			address -= ECHO_8KB_INTERNAL_RAM - INTERNAL_RAM_8KB
+		}
+		value := d.mmu.readByte(address.AsAddress())
+		d.mmu.memory[SPRITE_ATTRIB_MEMORY_OAM+d.index] = value
+		d.index++
+		if d.index == DMA_LENGTH {
+			d.active = false
+		}
+	}
+	d.mmu.memoryLock.Unlock()
+}
+
+func (d *dma) Run(wg *sync.WaitGroup) {
+	d.log.Println("DMA started.")
+	for {
+		if !d.clock.WaitNextCycle() {
+			break
+		}
+		d.step()
+		d.clock.Cycles += DMA_CYCLES_PER_BYTE
+	}
+	wg.Done()
+}
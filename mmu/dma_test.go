@@ -0,0 +1,130 @@
+package mmu
+
+import (
+	"github.com/lbarrios/yesSGMB/types"
+	"testing"
+)
+
+// Fills the source of a DMA transfer with a pattern that differs from any other page
+func fillDMASource(mmu *mmu, source types.Word) {
+	for i := types.Word(0); i < DMA_LENGTH; i++ {
+		mmu.memory[source+i] = byte(i) ^ 0x5A
+	}
+}
+
+func TestDMACopiesTheWholeOAM(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  byte       // value written to 0xFF46
+		source types.Word // where the bytes are actually read from
+	}{
+		{"video ram", 0x80, 0x8000},
+		{"internal ram", 0xC0, 0xC000},
+		{"last internal ram page", 0xDF, 0xDF00},
+		{"echo ram", 0xE1, 0xC100},
+		{"oam page reads the echo ram", 0xFE, 0xDE00},
+		{"io page reads the echo ram", 0xFF, 0xDF00},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mmu := NewMMU(newTestLogger())
+			fillDMASource(mmu, test.source)
+			mmu.WriteByte(DMA_ADDRESS.AsAddress(), test.value)
+			for i := 0; i < DMA_LENGTH; i++ {
+				mmu.dma.step()
+			}
+			for i := types.Word(0); i < DMA_LENGTH; i++ {
+				if got, expected := mmu.memory[SPRITE_ATTRIB_MEMORY_OAM+i], byte(i)^0x5A; got != expected {
+					t.Fatalf("OAM byte %.2X = %.2X, expected %.2X", i, got, expected)
+				}
+			}
+			if got := mmu.ReadByte(DMA_ADDRESS.AsAddress()); got != test.value {
+				t.Errorf("DMA register reads %.2X, expected %.2X", got, test.value)
+			}
+		})
+	}
+}
+
+func TestDMATiming(t *testing.T) {
+	mmu := NewMMU(newTestLogger())
+	fillDMASource(mmu, 0xC000)
+	mmu.WriteByte(DMA_ADDRESS.AsAddress(), 0xC0)
+
+	// One byte is copied on each machine cycle, and the transfer lasts 160 of them
+	for i := 0; i < DMA_LENGTH; i++ {
+		if !mmu.DMAActive() {
+			t.Fatalf("the transfer finished after %d bytes, expected %d", i, DMA_LENGTH)
+		}
+		if got := mmu.dma.index; got != types.Word(i) {
+			t.Fatalf("%d bytes copied after %d machine cycles", got, i)
+		}
+		mmu.dma.step()
+	}
+	if mmu.DMAActive() {
+		t.Errorf("the transfer is still active after %d machine cycles", DMA_LENGTH)
+	}
+
+	// Writing the register while a transfer is active restarts it
+	mmu.WriteByte(DMA_ADDRESS.AsAddress(), 0xC0)
+	for i := 0; i < 10; i++ {
+		mmu.dma.step()
+	}
+	mmu.WriteByte(DMA_ADDRESS.AsAddress(), 0xC0)
+	if mmu.dma.index != 0 || !mmu.DMAActive() {
+		t.Errorf("writing the register during a transfer should restart it")
+	}
+}
+
+func TestDMABlocksTheCPU(t *testing.T) {
+	tests := []struct {
+		name    string
+		address types.Word
+		blocked bool
+	}{
+		{"rom", 0x0150, true},
+		{"video ram", 0x8000, true},
+		{"internal ram", 0xC123, true},
+		{"echo ram", 0xE123, true},
+		{"oam", 0xFE10, true},
+		{"unusable", 0xFEA0, true},
+		{"high ram", 0xFF80, false},
+		{"last high ram", 0xFFFE, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mmu := NewMMU(newTestLogger())
+			mmu.memory[test.address] = 0x42
+			mmu.WriteByte(DMA_ADDRESS.AsAddress(), 0xC0)
+
+			read := mmu.ReadByte(test.address.AsAddress())
+			mmu.WriteByte(test.address.AsAddress(), 0x24)
+			written := mmu.memory[test.address]
+			if test.blocked {
+				if read != 0xFF {
+					t.Errorf("read %.2X during the transfer, expected FF", read)
+				}
+				if written != 0x42 {
+					t.Errorf("the write went through during the transfer")
+				}
+			} else {
+				if read != 0x42 {
+					t.Errorf("read %.2X during the transfer, expected 42", read)
+				}
+				if written != 0x24 {
+					t.Errorf("the write was ignored during the transfer")
+				}
+			}
+		})
+	}
+
+	// Once the transfer ends the CPU can access the memory again
+	mmu := NewMMU(newTestLogger())
+	mmu.memory[0xC123] = 0x42
+	mmu.WriteByte(DMA_ADDRESS.AsAddress(), 0xC0)
+	for i := 0; i < DMA_LENGTH; i++ {
+		mmu.dma.step()
+	}
+	if got := mmu.ReadByte(types.Word(0xC123).AsAddress()); got != 0x42 {
+		t.Errorf("read %.2X after the transfer, expected 42", got)
+	}
+}
@@ -0,0 +1,53 @@
+package mmu
+
+import (
+	"github.com/lbarrios/yesSGMB/types"
+)
+
+// Interrupt flags, in the IF (0xFF0F) and IE (0xFFFF) registers.
+// The bit number is also the priority, lower bits are serviced first.
+const (
+	VBLANK_INTERRUPT   = 0x01 // bit 0
+	LCD_STAT_INTERRUPT = 0x02 // bit 1
+	TIMER_INTERRUPT    = 0x04 // bit 2
+	SERIAL_INTERRUPT   = 0x08 // bit 3
+	JOYPAD_INTERRUPT   = 0x10 // bit 4
+	INTERRUPTS_MASK    = 0x1F
+)
+
+// interruptFlag implements the IF register. Only the lower 5 bits exist,
+// the upper ones always read as 1.
+type interruptFlag struct {
+	value byte
+}
+
+// Called with the memory locked
+func (f *interruptFlag) ReadRegister(address types.Address) byte {
+	return f.value | ^byte(INTERRUPTS_MASK)
+}
+
+// Called with the memory locked
+func (f *interruptFlag) WriteRegister(address types.Address, value byte) {
+	f.value = value & INTERRUPTS_MASK
+}
+
+// RequestInterrupt sets the interrupt bits in the IF register.
+func (mmu *mmu) RequestInterrupt(interrupt byte) {
+	mmu.memoryLock.Lock()
+	mmu.iflag.value |= interrupt & INTERRUPTS_MASK
+	mmu.memoryLock.Unlock()
+}
+
+// PendingInterrupts returns the interrupts that are both requested (IF) and enabled (IE).
+func (mmu *mmu) PendingInterrupts() byte {
+	mmu.memoryLock.Lock()
+	defer mmu.memoryLock.Unlock()
+	return mmu.iflag.value & mmu.memory[INTERRUPT_ENABLE_REGISTER] & INTERRUPTS_MASK
+}
+
+// AcknowledgeInterrupt clears the interrupt bit in the IF register, when the CPU services it.
+func (mmu *mmu) AcknowledgeInterrupt(interrupt byte) {
+	mmu.memoryLock.Lock()
+	mmu.iflag.value &^= interrupt
+	mmu.memoryLock.Unlock()
+}
@@ -0,0 +1,20 @@
+package mmu
+
+import (
+	"github.com/lbarrios/yesSGMB/types"
+)
+
+// IORegister is implemented by the peripherals whose registers can't be plain memory,
+// because their value must be computed when read or they react when written.
+// These methods are called with the memory locked, so they must not access the MMU.
+type IORegister interface {
+	ReadRegister(address types.Address) byte
+	WriteRegister(address types.Address, value byte)
+}
+
+// InterruptRequester is implemented by the IORegisters whose writes can request interrupts.
+// As they are written with the memory locked they can't use the IRQHandler,
+// so the MMU takes the requested interrupts right after each write.
+type InterruptRequester interface {
+	TakeInterrupts() byte
+}
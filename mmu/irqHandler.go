@@ -1,5 +1,7 @@
 package mmu
 
+// IRQHandler is used by the peripherals to request interrupts,
+// using the *_INTERRUPT flags.
 type IRQHandler interface {
 	RequestInterrupt(interrupt byte)
 }
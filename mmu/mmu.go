@@ -2,11 +2,12 @@
 package mmu
 
 import (
+	"errors"
+	"fmt"
 	"github.com/lbarrios/yesSGMB/cartridge"
 	"github.com/lbarrios/yesSGMB/logger"
 	"github.com/lbarrios/yesSGMB/types"
 	"sync"
-	"os"
 )
 
 const (
@@ -14,33 +15,38 @@ const (
 	MAX_ADDRESS               = 0xFFFF
 	INTERRUPT_FLAG_ADDR       = types.Word(0xFF0F)
 	INTERRUPT_ENABLE_REGISTER = types.Word(0xFFFF)
+	BOOT_ROM_DISABLE_ADDR     = types.Word(0xFF50)
+	BOOT_ROM_SIZE             = 0x100
 )
 
 type mmu struct {
-	bios       [0x100]byte
+	bios       [BOOT_ROM_SIZE]byte
+	biosActive bool // the boot rom is overlaid at 0x0000-0x00FF until 0xFF50 is written
 	cartridge  *cartridge.Cartridge
 	memory     [MAX_ADDRESS + 1]byte
 	memoryLock sync.Mutex
+	registers  map[types.Word]IORegister
+	dma        *dma
+	iflag      interruptFlag
 	log        logger.Logger
-	console struct {
-		f *os.File
-	}
 }
 
 type MMU interface {
 	ReadByte(address types.Address) byte
 	WriteByte(address types.Address, value byte)
+	BootROMEnabled() bool
+	PendingInterrupts() byte
+	AcknowledgeInterrupt(interrupt byte)
 }
 
 func NewMMU(l *logger.Logger) *mmu {
 	mmu := new(mmu)
 	mmu.log = *l
 	mmu.log.SetPrefix("\033[0;33mMMU: ")
-	fo, err := os.Create("console.log")
-	if err != nil {
-		panic("Can't create file for console")
-	}
-	mmu.console.f = fo
+	mmu.registers = make(map[types.Word]IORegister)
+	mmu.dma = newDMA(mmu, l)
+	mmu.registers[DMA_ADDRESS] = mmu.dma
+	mmu.registers[INTERRUPT_FLAG_ADDR] = &mmu.iflag
 	return mmu
 }
 
@@ -48,6 +54,25 @@ func (mmu *mmu) LoadCartridge(cart *cartridge.Cartridge) {
 	mmu.cartridge = cart
 }
 
+// LoadBootROM overlays the boot rom over the first 256 bytes of the cartridge,
+// until the boot procedure disables it by writing to 0xFF50.
+func (mmu *mmu) LoadBootROM(data []byte) error {
+	if len(data) != BOOT_ROM_SIZE {
+		return errors.New(fmt.Sprintf("Invalid boot rom size: %d bytes, expected %d.", len(data), BOOT_ROM_SIZE))
+	}
+	mmu.memoryLock.Lock()
+	copy(mmu.bios[:], data)
+	mmu.biosActive = true
+	mmu.memoryLock.Unlock()
+	return nil
+}
+
+func (mmu *mmu) BootROMEnabled() bool {
+	mmu.memoryLock.Lock()
+	defer mmu.memoryLock.Unlock()
+	return mmu.biosActive
+}
+
 const (
 	//ROM_BANK_0_16KB             = 0x0000
 	SWITCHABLE_ROM_BANK_16KB    = 0x4000
@@ -64,16 +89,28 @@ const (
 
 func (mmu *mmu) ReadByte(address types.Address) byte {
 	mmu.memoryLock.Lock()
+	defer mmu.memoryLock.Unlock()
+	if mmu.dma.blocksAddress(address) {
+		return 0xFF
+	}
+	return mmu.readByte(address)
+}
+
+func (mmu *mmu) readByte(address types.Address) byte {
 	var ret byte
 
 	switch {
+	case mmu.biosActive && address.AsWord() < BOOT_ROM_SIZE:
+		// BOOT_ROM
+		ret = mmu.bios[address.AsWord()]
+
 	case address.AsWord() < SWITCHABLE_ROM_BANK_16KB:
 		// ROM_BANK_0_16KB
-		ret = mmu.cartridge.MBC.Read(address)
+		ret = mmu.cartridge.Read(address)
 
 	case address.AsWord() >= SWITCHABLE_ROM_BANK_16KB && address.AsWord() < VIDEO_RAM_8KB:
 		// SWITCHABLE_ROM_BANK_16KB
-		ret = mmu.cartridge.MBC.Read(address)
+		ret = mmu.cartridge.Read(address)
 
 	case address.AsWord() >= VIDEO_RAM_8KB && address.AsWord() < SWITCHABLE_RAM_BANK_8KB:
 		// VIDEO_RAM_8KB
@@ -83,7 +120,7 @@ func (mmu *mmu) ReadByte(address types.Address) byte {
 
 	case address.AsWord() >= SWITCHABLE_RAM_BANK_8KB && address.AsWord() < INTERNAL_RAM_8KB:
 		// SWITCHABLE_RAM_BANK_8KB
-		ret = mmu.cartridge.MBC.Read(address)
+		ret = mmu.cartridge.Read(address)
 
 	case address.AsWord() >= INTERNAL_RAM_8KB && address.AsWord() < ECHO_8KB_INTERNAL_RAM:
 		// INTERNAL_RAM_8KB
@@ -108,10 +145,9 @@ func (mmu *mmu) ReadByte(address types.Address) byte {
 
 	case address.AsWord() >= IO_PORTS && address.AsWord() < EMPTY_BUT_UNUSABLE_FOR_IO_2:
 		// IO_PORTS, this case write to memory that is mapped to peripherals
-		switch address.AsWord() {
-		case 0xff00:   // joypad
-			ret = 0xff // for now, hardcoding no buttons pressed
-		default:
+		if register, ok := mmu.registers[address.AsWord()]; ok {
+			ret = register.ReadRegister(address)
+		} else {
 			ret = mmu.memory[address.AsWord()]
 		}
 
@@ -134,21 +170,27 @@ func (mmu *mmu) ReadByte(address types.Address) byte {
 		ret = mmu.memory[address.AsWord()]
 	}
 
-	mmu.memoryLock.Unlock()
 	return ret
 }
 
 func (mmu *mmu) WriteByte(address types.Address, value byte) {
 	mmu.memoryLock.Lock()
+	defer mmu.memoryLock.Unlock()
+	if mmu.dma.blocksAddress(address) {
+		return
+	}
+	mmu.writeByte(address, value)
+}
 
+func (mmu *mmu) writeByte(address types.Address, value byte) {
 	switch {
 	case address.AsWord() < SWITCHABLE_ROM_BANK_16KB:
 		// ROM_BANK_0_16KB
-		mmu.cartridge.MBC.Write(address, value)
+		mmu.cartridge.Write(address, value)
 
 	case address.AsWord() >= SWITCHABLE_ROM_BANK_16KB && address.AsWord() < VIDEO_RAM_8KB:
 		// SWITCHABLE_ROM_BANK_16KB
-		mmu.cartridge.MBC.Write(address, value)
+		mmu.cartridge.Write(address, value)
 
 	case address.AsWord() >= VIDEO_RAM_8KB && address.AsWord() < SWITCHABLE_RAM_BANK_8KB:
 		// VIDEO_RAM_8KB
@@ -158,7 +200,7 @@ func (mmu *mmu) WriteByte(address types.Address, value byte) {
 
 	case address.AsWord() >= SWITCHABLE_RAM_BANK_8KB && address.AsWord() < INTERNAL_RAM_8KB:
 		// SWITCHABLE_RAM_BANK_8KB
-		mmu.cartridge.MBC.Write(address, value)
+		mmu.cartridge.Write(address, value)
 
 	case address.AsWord() >= INTERNAL_RAM_8KB && address.AsWord() < ECHO_8KB_INTERNAL_RAM:
 		// INTERNAL_RAM_8KB
@@ -183,19 +225,21 @@ func (mmu *mmu) WriteByte(address types.Address, value byte) {
 
 	case address.AsWord() >= IO_PORTS && address.AsWord() < EMPTY_BUT_UNUSABLE_FOR_IO_2:
 		// IO_PORTS, this case write to memory that is mapped to peripherals
-		switch address.AsWord() {
-		case 0xFF02:
-			if value == 0x81 {
-				buffer := append(make([]byte,1), mmu.memory[0xFF01])
-				mmu.console.f.Write(buffer)
+		if register, ok := mmu.registers[address.AsWord()]; ok {
+			register.WriteRegister(address, value)
+			if requester, ok := register.(InterruptRequester); ok {
+				mmu.iflag.value |= requester.TakeInterrupts() & INTERRUPTS_MASK
 			}
-			fallthrough
-		default:
+		} else {
 			mmu.memory[address.AsWord()] = value
 		}
 
 	case address.AsWord() >= EMPTY_BUT_UNUSABLE_FOR_IO_2 && address.AsWord() < HIGH_RAM:
 		// EMPTY_BUT_UNUSABLE_FOR_IO_2
+		if address.AsWord() == BOOT_ROM_DISABLE_ADDR && value != 0 {
+			// Any non-zero value unmaps the boot rom, and it cannot be mapped again
+			mmu.biosActive = false
+		}
 		mmu.memory[address.AsWord()] = value
 		// TODO: To check
 		//mmu.log.Fatalf("Attemping to write to unimplemented address %x (EMPTY_BUT_UNUSABLE_FOR_IO_2)", address.AsWord())
@@ -213,16 +257,9 @@ func (mmu *mmu) WriteByte(address types.Address, value byte) {
 		mmu.log.Fatalf("Attemping to write to invalid address %x", address.AsWord())
 		mmu.memory[address.AsWord()] = value
 	}
-
-	mmu.memoryLock.Unlock()
-}
-
-func (mmu *mmu) RequestInterrupt(interrupt byte) {
-	iflag := mmu.ReadByte(INTERRUPT_FLAG_ADDR.AsAddress())
-	iflag |= interrupt
-	mmu.WriteByte(INTERRUPT_FLAG_ADDR.AsAddress(), iflag)
 }
 
+// MapMemoryRegion maps every address from begin to end, both included, to the peripheral.
 func (mmu *mmu) MapMemoryRegion(p Peripheral, begin types.Address, end types.Address) {
 	if end.AsWord() < begin.AsWord() {
 		mmu.log.Fatalf("MapMemoryRegion expects a non-negative lenght interval")
@@ -230,11 +267,26 @@ func (mmu *mmu) MapMemoryRegion(p Peripheral, begin types.Address, end types.Add
 	if begin.AsWord() < MIN_ADDRESS || end.AsWord() > MAX_ADDRESS {
 		mmu.log.Fatalf("MapMemoryRegion parameters are out-o-range")
 	}
-	for i := begin.AsWord(); i < end.AsWord(); i++ {
+	// Both ends are mapped. The loop can't compare i <= end, as it would overflow with end = MAX_ADDRESS
+	for i := begin.AsWord(); ; i++ {
 		mmu.MapMemoryAdress(p, i.AsAddress())
+		if i == end.AsWord() {
+			break
+		}
 	}
 }
 
+// MapRegister makes the reads and writes of an IO port go through the peripheral,
+// instead of accessing the memory.
+func (mmu *mmu) MapRegister(r IORegister, address types.Address) {
+	if address.AsWord() < IO_PORTS || address.AsWord() >= EMPTY_BUT_UNUSABLE_FOR_IO_2 {
+		mmu.log.Fatalf("MapRegister expects an IO port address, got %.4x", address.AsWord())
+	}
+	mmu.memoryLock.Lock()
+	mmu.registers[address.AsWord()] = r
+	mmu.memoryLock.Unlock()
+}
+
 func (mmu *mmu) MapMemoryAdress(p Peripheral, address types.Address) {
 	mmu.memoryLock.Lock()
 	p.MapByte(address, &mmu.memory[address.AsWord()])
@@ -0,0 +1,157 @@
+package mmu
+
+import (
+	"github.com/lbarrios/yesSGMB/cartridge"
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestLogger() *logger.Logger {
+	l := new(logger.Logger)
+	l.Init()
+	l.Log = log.New(ioutil.Discard, "", 0)
+	return l
+}
+
+type mappedAddresses map[types.Word]*byte
+
+func (m mappedAddresses) MapByte(logical_address types.Address, physical_address *byte) {
+	m[logical_address.AsWord()] = physical_address
+}
+
+func TestMapMemoryRegionIncludesBothEnds(t *testing.T) {
+	tests := []struct {
+		name       string
+		begin, end types.Word
+	}{
+		{"video ram", 0x8000, 0x9FFF},
+		{"oam", 0xFE00, 0xFE9F},
+		{"single address", 0xFF40, 0xFF40},
+		{"last address", 0xFFFE, 0xFFFF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mmu := NewMMU(newTestLogger())
+			mapped := make(mappedAddresses)
+			mmu.MapMemoryRegion(mapped, test.begin.AsAddress(), test.end.AsAddress())
+			if expected := int(test.end-test.begin) + 1; len(mapped) != expected {
+				t.Errorf("mapped %d addresses, expected %d", len(mapped), expected)
+			}
+			for _, address := range []types.Word{test.begin, test.end} {
+				if mapped[address] != &mmu.memory[address] {
+					t.Errorf("address 0x%.4x is not mapped to the memory", address)
+				}
+			}
+		})
+	}
+}
+
+// Returns a MMU with a 32KB ROM only cartridge, and the content of the cartridge
+func newTestMMUWithCartridge(t *testing.T) (*mmu, []byte) {
+	dir, err := ioutil.TempDir("", "mmu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rom := make([]byte, 0x8000)
+	for i := range rom {
+		rom[i] = byte(i)
+	}
+	rom[0x0147] = 0x00 // ROM ONLY
+	filename := filepath.Join(dir, "test.gb")
+	if err := ioutil.WriteFile(filename, rom, 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := cartridge.Options{Validation: cartridge.ValidationIgnore, DisableAutoPatch: true}
+	cart, err := cartridge.NewCartridge(filename, options, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mmu := NewMMU(newTestLogger())
+	mmu.LoadCartridge(cart)
+	return mmu, rom
+}
+
+func testBootROM() []byte {
+	bootROM := make([]byte, BOOT_ROM_SIZE)
+	for i := range bootROM {
+		bootROM[i] = ^byte(i)
+	}
+	return bootROM
+}
+
+func TestBootROMOverlay(t *testing.T) {
+	mmu, rom := newTestMMUWithCartridge(t)
+	if mmu.BootROMEnabled() {
+		t.Errorf("the boot rom is enabled without loading it")
+	}
+	if err := mmu.LoadBootROM(testBootROM()); err != nil {
+		t.Fatal(err)
+	}
+	if !mmu.BootROMEnabled() {
+		t.Errorf("the boot rom is not enabled after loading it")
+	}
+
+	// At reset the boot rom is overlaid on the first 256 bytes only
+	for address := types.Word(0x0000); address < 0x0200; address++ {
+		expected := rom[address]
+		if address < BOOT_ROM_SIZE {
+			expected = ^byte(address)
+		}
+		if got := mmu.ReadByte(address.AsAddress()); got != expected {
+			t.Fatalf("address 0x%.4x reads %.2X, expected %.2X", address, got, expected)
+		}
+	}
+
+	// Writing 0 to 0xFF50 doesn't unmap it
+	mmu.WriteByte(BOOT_ROM_DISABLE_ADDR.AsAddress(), 0x00)
+	if !mmu.BootROMEnabled() || mmu.ReadByte(types.Word(0x0042).AsAddress()) != ^byte(0x42) {
+		t.Errorf("the boot rom was unmapped by writing 0 to 0xFF50")
+	}
+
+	// Any other value unmaps it, and it can't be mapped again
+	mmu.WriteByte(BOOT_ROM_DISABLE_ADDR.AsAddress(), 0x01)
+	if mmu.BootROMEnabled() {
+		t.Errorf("the boot rom is still enabled after writing to 0xFF50")
+	}
+	for address := types.Word(0x0000); address < BOOT_ROM_SIZE; address++ {
+		if got := mmu.ReadByte(address.AsAddress()); got != rom[address] {
+			t.Fatalf("address 0x%.4x reads %.2X after unmapping the boot rom, expected %.2X", address, got, rom[address])
+		}
+	}
+	mmu.WriteByte(BOOT_ROM_DISABLE_ADDR.AsAddress(), 0x00)
+	if mmu.BootROMEnabled() {
+		t.Errorf("the boot rom was mapped again by writing to 0xFF50")
+	}
+}
+
+func TestLoadBootROMSize(t *testing.T) {
+	tests := []struct {
+		size  int
+		valid bool
+	}{
+		{0, false},
+		{BOOT_ROM_SIZE - 1, false},
+		{BOOT_ROM_SIZE, true},
+		{BOOT_ROM_SIZE + 1, false},
+		{0x900, false}, // CGB boot rom
+	}
+	for _, test := range tests {
+		mmu := NewMMU(newTestLogger())
+		err := mmu.LoadBootROM(make([]byte, test.size))
+		if test.valid && err != nil {
+			t.Errorf("LoadBootROM of %d bytes: %v", test.size, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("LoadBootROM of %d bytes: expected an error", test.size)
+		}
+		if mmu.BootROMEnabled() != test.valid {
+			t.Errorf("LoadBootROM of %d bytes: boot rom enabled = %t, expected %t", test.size, mmu.BootROMEnabled(), test.valid)
+		}
+	}
+}
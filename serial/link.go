@@ -0,0 +1,140 @@
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lbarrios/yesSGMB/logger"
+	"io"
+	"os"
+)
+
+// LinkPort is the other end of the link cable.
+type LinkPort interface {
+	// Exchange is called when the GameBoy starts a transfer with the internal clock.
+	// It sends the byte that is shifted out, and returns the byte that is shifted in.
+	Exchange(out byte) byte
+	// Connect attaches the serial port, so the other end can start transfers
+	// with its own clock through Device.ExternalTransfer.
+	Connect(device Device)
+	Close() error
+}
+
+// LockstepLink is a link port that keeps the other end synchronized with the emulation,
+// so the transfers happen at the same cycles on every run. Sync is called on every
+// cycle of the serial port, before updating it.
+type LockstepLink interface {
+	LinkPort
+	Sync(cycles uint64)
+}
+
+// Device is the GameBoy side of the link cable.
+type Device interface {
+	ExternalTransfer(in byte) byte
+}
+
+// Link modes, selectable from the command line
+const (
+	LINK_DISCONNECTED = "none"
+	LINK_CAPTURE      = "capture"
+	LINK_LOOPBACK     = "loopback"
+	LINK_LISTEN       = "listen"
+	LINK_CONNECT      = "connect"
+	LINK_PRINTER      = "printer"
+)
+
+// disconnectedLink is an empty link port, everything sent is lost
+// and the input line always reads as 1.
+type disconnectedLink struct{}
+
+func NewDisconnectedLink() *disconnectedLink {
+	return new(disconnectedLink)
+}
+
+func (l *disconnectedLink) Exchange(out byte) byte {
+	return DISCONNECTED_INPUT
+}
+
+func (l *disconnectedLink) Connect(device Device) {}
+
+func (l *disconnectedLink) Close() error {
+	return nil
+}
+
+// captureLink writes every byte sent by the GameBoy, which is useful
+// for the test roms that print their results through the serial port.
+type captureLink struct {
+	w io.Writer
+}
+
+func NewCaptureLink(w io.Writer) *captureLink {
+	l := new(captureLink)
+	l.w = w
+	return l
+}
+
+func (l *captureLink) Exchange(out byte) byte {
+	l.w.Write([]byte{out})
+	return DISCONNECTED_INPUT
+}
+
+func (l *captureLink) Connect(device Device) {}
+
+func (l *captureLink) Close() error {
+	if c, ok := l.w.(io.Closer); ok && l.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// loopbackLink connects the output line to the input line,
+// so the GameBoy receives the same bytes it sends.
+type loopbackLink struct{}
+
+func NewLoopbackLink() *loopbackLink {
+	return new(loopbackLink)
+}
+
+func (l *loopbackLink) Exchange(out byte) byte {
+	return out
+}
+
+func (l *loopbackLink) Connect(device Device) {}
+
+func (l *loopbackLink) Close() error {
+	return nil
+}
+
+// LinkOptions selects what is connected to the link port
+type LinkOptions struct {
+	Mode           string
+	Output         string // in capture mode, the file where the bytes are written, or "-" for the standard output
+	Address        string // in listen and connect modes, the TCP address of the other emulator
+	PrintDirectory string // in printer mode, the directory where the printed images are saved
+}
+
+// OpenLinkPort creates the link port for the given options.
+func OpenLinkPort(options LinkOptions, l *logger.Logger) (LinkPort, error) {
+	switch options.Mode {
+	case LINK_DISCONNECTED, "":
+		return NewDisconnectedLink(), nil
+	case LINK_CAPTURE:
+		if options.Output == "-" {
+			return NewCaptureLink(os.Stdout), nil
+		}
+		f, err := os.Create(options.Output)
+		if err != nil {
+			return nil, err
+		}
+		return NewCaptureLink(f), nil
+	case LINK_LOOPBACK:
+		return NewLoopbackLink(), nil
+	case LINK_LISTEN:
+		return ListenTCPLink(options.Address, l)
+	case LINK_CONNECT:
+		return DialTCPLink(options.Address, l)
+	case LINK_PRINTER:
+		return NewPrinter(options.PrintDirectory, l), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown link mode: %s, expected %s, %s, %s, %s, %s or %s.", options.Mode, LINK_DISCONNECTED, LINK_CAPTURE, LINK_LOOPBACK, LINK_LISTEN, LINK_CONNECT, LINK_PRINTER))
+	}
+}
@@ -0,0 +1,328 @@
+package serial
+
+import (
+	"fmt"
+	"github.com/lbarrios/yesSGMB/logger"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+)
+
+// The GameBoy Printer receives packets through the link cable, always with the GameBoy as clock master.
+//
+//	Bytes    Content
+//	2        Magic bytes (0x88, 0x33)
+//	1        Command
+//	1        Compression (0x01 if the data is RLE compressed)
+//	2        Data length (little endian)
+//	N        Data
+//	2        Checksum (sum of command, compression, length and data, little endian)
+//	1        Alive response, the printer answers 0x81
+//	1        Status response, the printer answers its status
+//
+// The printer answers 0x00 to every byte of the packet itself.
+const (
+	PRINTER_MAGIC_1 = 0x88
+	PRINTER_MAGIC_2 = 0x33
+	PRINTER_ALIVE   = 0x81
+)
+
+const ( // Commands
+	PRINTER_COMMAND_INIT   = 0x01
+	PRINTER_COMMAND_PRINT  = 0x02
+	PRINTER_COMMAND_DATA   = 0x04
+	PRINTER_COMMAND_STATUS = 0x0F
+)
+
+// Status byte
+//
+//	Bit 7 - Low battery
+//	Bit 6 - Other error
+//	Bit 5 - Paper jam
+//	Bit 4 - Packet error
+//	Bit 3 - Unprocessed data
+//	Bit 2 - Image data full
+//	Bit 1 - Printer busy
+//	Bit 0 - Checksum error
+const (
+	PRINTER_STATUS_CHECKSUM_ERROR   = 0x01
+	PRINTER_STATUS_BUSY             = 0x02
+	PRINTER_STATUS_FULL             = 0x04
+	PRINTER_STATUS_UNPROCESSED_DATA = 0x08
+	PRINTER_STATUS_PACKET_ERROR     = 0x10
+)
+
+const (
+	PRINTER_WIDTH           = 160                   // pixels
+	PRINTER_BAND_SIZE       = 640                   // bytes, 40 tiles of 16 bytes
+	PRINTER_BUFFER_SIZE     = 9 * PRINTER_BAND_SIZE // bytes, the printer memory holds 9 bands
+	PRINTER_MAX_DATA        = PRINTER_BAND_SIZE     // bytes of uncompressed data in a packet
+	PRINTER_MARGIN_LINES    = 8                     // blank pixel lines fed for each margin unit
+	PRINTER_BUSY_INQUIRIES  = 4                     // status inquiries answered as busy after printing
+	PRINTER_DEFAULT_PALETTE = 0xE4                  // the palette 0x00 is treated as the usual BGP value
+	printerTilesPerRow      = PRINTER_WIDTH / 8
+	printerTileSize         = 16
+	printerRleRunFlag       = 0x80
+	printerRleLengthMask    = 0x7F
+	printerFilePattern      = "print-%04d.png"
+	printerHeaderLength     = 4 // command, compression and data length
+)
+
+// Packet reception states
+const (
+	printerWaitingMagic1 = iota
+	printerWaitingMagic2
+	printerReceivingHeader
+	printerReceivingData
+	printerReceivingChecksum
+	printerSendingAlive
+	printerSendingStatus
+)
+
+// Shades of gray of each of the 4 colors of the print palette
+var printerShades = [4]uint8{0xFF, 0xAA, 0x55, 0x00}
+
+// printer is a GameBoy Printer connected to the link port,
+// which saves each printed image as a PNG file in the output directory.
+type printer struct {
+	log       logger.Logger
+	directory string
+	state     int
+	header    []byte
+	data      []byte
+	length    int
+	checksum  []byte
+	buffer    []byte // decompressed image data, waiting to be printed
+	status    byte
+	busy      int // status inquiries left until the printing finishes
+	prints    int // number of the last saved file
+}
+
+func NewPrinter(directory string, l *logger.Logger) *printer {
+	p := new(printer)
+	p.log = *l
+	p.log.SetPrefix("\033[0;36mPRINTER: ")
+	p.directory = directory
+	return p
+}
+
+// The GameBoy is always the clock master
+func (p *printer) Connect(device Device) {}
+
+func (p *printer) Close() error {
+	return nil
+}
+
+// Exchange receives a byte of the packet, and returns the printer answer.
+func (p *printer) Exchange(out byte) byte {
+	switch p.state {
+	case printerWaitingMagic1:
+		if out == PRINTER_MAGIC_1 {
+			p.state = printerWaitingMagic2
+		}
+	case printerWaitingMagic2:
+		p.state = printerWaitingMagic1
+		if out == PRINTER_MAGIC_2 {
+			p.header = p.header[:0]
+			p.state = printerReceivingHeader
+		} else if out == PRINTER_MAGIC_1 {
+			p.state = printerWaitingMagic2
+		}
+	case printerReceivingHeader:
+		p.header = append(p.header, out)
+		if len(p.header) == printerHeaderLength {
+			p.length = int(p.header[2]) | int(p.header[3])<<8
+			p.data = p.data[:0]
+			p.checksum = p.checksum[:0]
+			p.state = printerReceivingData
+			if p.length == 0 {
+				p.state = printerReceivingChecksum
+			}
+		}
+	case printerReceivingData:
+		p.data = append(p.data, out)
+		if len(p.data) == p.length {
+			p.state = printerReceivingChecksum
+		}
+	case printerReceivingChecksum:
+		p.checksum = append(p.checksum, out)
+		if len(p.checksum) == 2 {
+			p.state = printerSendingAlive
+		}
+	case printerSendingAlive:
+		p.state = printerSendingStatus
+		return PRINTER_ALIVE
+	case printerSendingStatus:
+		// The packet is processed once it has been completely received
+		status := p.processPacket()
+		p.state = printerWaitingMagic1
+		return status
+	}
+	return 0x00
+}
+
+// Executes the received command, and returns the status to answer
+func (p *printer) processPacket() byte {
+	var sum uint16
+	for _, b := range p.header {
+		sum += uint16(b)
+	}
+	for _, b := range p.data {
+		sum += uint16(b)
+	}
+	if sum != uint16(p.checksum[0])|uint16(p.checksum[1])<<8 {
+		p.log.Printf("Checksum error in packet 0x%.2x: 0x%.4x, expected 0x%.2x%.2x.", p.header[0], sum, p.checksum[1], p.checksum[0])
+		return p.status | PRINTER_STATUS_CHECKSUM_ERROR
+	}
+
+	switch p.header[0] {
+	case PRINTER_COMMAND_INIT:
+		p.buffer = p.buffer[:0]
+		p.status = 0x00
+		p.busy = 0
+	case PRINTER_COMMAND_DATA:
+		p.receiveData()
+	case PRINTER_COMMAND_PRINT:
+		p.print()
+	case PRINTER_COMMAND_STATUS:
+		if p.busy > 0 {
+			p.busy--
+			if p.busy == 0 {
+				p.status &^= PRINTER_STATUS_BUSY
+			}
+		}
+	default:
+		p.log.Printf("Unknown command: 0x%.2x", p.header[0])
+		return p.status | PRINTER_STATUS_PACKET_ERROR
+	}
+	return p.status
+}
+
+// Stores the data of the packet in the printer memory. An empty data packet marks the end of the image.
+func (p *printer) receiveData() {
+	data := p.data
+	if p.header[1] != 0x00 {
+		data = decompressPrinterData(p.data)
+	}
+	if len(data) > PRINTER_MAX_DATA {
+		p.log.Printf("Data packet too long: %d bytes, expected %d.", len(data), PRINTER_MAX_DATA)
+		data = data[:PRINTER_MAX_DATA]
+	}
+	free := PRINTER_BUFFER_SIZE - len(p.buffer)
+	if len(data) > free {
+		data = data[:free]
+	}
+	p.buffer = append(p.buffer, data...)
+	if len(p.buffer) > 0 {
+		p.status |= PRINTER_STATUS_UNPROCESSED_DATA
+	}
+	if len(p.buffer) == PRINTER_BUFFER_SIZE {
+		p.status |= PRINTER_STATUS_FULL
+	}
+}
+
+// RLE compression. Each block starts with a control byte:
+// if bit 7 is set, the next byte is repeated (bits 0-6) + 2 times,
+// otherwise the next (bits 0-6) + 1 bytes are copied.
+func decompressPrinterData(data []byte) []byte {
+	var result []byte
+	for i := 0; i < len(data); {
+		control := data[i]
+		i++
+		if control&printerRleRunFlag != 0 {
+			if i >= len(data) {
+				break
+			}
+			for n := int(control&printerRleLengthMask) + 2; n > 0; n-- {
+				result = append(result, data[i])
+			}
+			i++
+		} else {
+			n := int(control&printerRleLengthMask) + 1
+			if i+n > len(data) {
+				n = len(data) - i
+			}
+			result = append(result, data[i:i+n]...)
+			i += n
+		}
+	}
+	return result
+}
+
+// Print command data
+//
+//	Byte 0 - Number of sheets (0 only feeds the paper)
+//	Byte 1 - Margins, bits 7-4 before and bits 3-0 after the image
+//	Byte 2 - Palette, as the BGP register (0x00 means the default palette)
+//	Byte 3 - Exposure (ignored)
+func (p *printer) print() {
+	if len(p.data) < 4 {
+		p.log.Printf("Print packet too short: %d bytes, expected 4.", len(p.data))
+		p.status |= PRINTER_STATUS_PACKET_ERROR
+		return
+	}
+	sheets, margins, palette := p.data[0], p.data[1], p.data[2]
+	if palette == 0x00 {
+		palette = PRINTER_DEFAULT_PALETTE
+	}
+	if sheets > 0 && len(p.buffer) > 0 {
+		if err := p.save(p.render(int(margins>>4), int(margins&0x0F), palette)); err != nil {
+			p.log.Printf("ERROR: %s", err)
+		}
+	}
+	p.buffer = p.buffer[:0]
+	p.status = PRINTER_STATUS_BUSY
+	p.busy = PRINTER_BUSY_INQUIRIES
+}
+
+// Decodes the tiles in the printer memory, adding the blank margins before and after the image
+func (p *printer) render(marginBefore int, marginAfter int, palette byte) *image.Gray {
+	rows := len(p.buffer) / (printerTilesPerRow * printerTileSize)
+	top := marginBefore * PRINTER_MARGIN_LINES
+	height := top + rows*8 + marginAfter*PRINTER_MARGIN_LINES
+	img := image.NewGray(image.Rect(0, 0, PRINTER_WIDTH, height))
+	for i := range img.Pix {
+		img.Pix[i] = printerShades[0]
+	}
+	for tile := 0; tile < rows*printerTilesPerRow; tile++ {
+		tileX, tileY := tile%printerTilesPerRow*8, tile/printerTilesPerRow*8
+		for line := 0; line < 8; line++ {
+			low := p.buffer[tile*printerTileSize+line*2]
+			high := p.buffer[tile*printerTileSize+line*2+1]
+			for x := 0; x < 8; x++ {
+				bit := uint(7 - x)
+				index := (high>>bit&0x01)<<1 | low>>bit&0x01
+				shade := palette >> (index * 2) & 0x03
+				img.SetGray(tileX+x, top+tileY+line, color.Gray{printerShades[shade]})
+			}
+		}
+	}
+	return img
+}
+
+// Saves the image in the next free file of the output directory
+func (p *printer) save(img *image.Gray) error {
+	if err := os.MkdirAll(p.directory, 0755); err != nil {
+		return err
+	}
+	var filename string
+	for {
+		p.prints++
+		filename = filepath.Join(p.directory, fmt.Sprintf(printerFilePattern, p.prints))
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			break
+		}
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	p.log.Printf("Printed %s.", filename)
+	return f.Close()
+}
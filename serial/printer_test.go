@@ -0,0 +1,267 @@
+package serial
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestPrinter(t *testing.T) (*printer, string) {
+	dir, err := ioutil.TempDir("", "printer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewPrinter(dir, newTestLogger()), dir
+}
+
+// Builds a printer packet, including the two bytes sent to read the alive and status responses
+func printerPacket(command byte, compression byte, data []byte) []byte {
+	packet := []byte{PRINTER_MAGIC_1, PRINTER_MAGIC_2, command, compression, byte(len(data)), byte(len(data) >> 8)}
+	packet = append(packet, data...)
+	var checksum uint16
+	for _, b := range packet[2:] {
+		checksum += uint16(b)
+	}
+	return append(packet, byte(checksum), byte(checksum>>8), 0x00, 0x00)
+}
+
+// Sends the bytes to the printer, and returns its answers
+func sendToPrinter(p *printer, bytes []byte) []byte {
+	var answers []byte
+	for _, b := range bytes {
+		answers = append(answers, p.Exchange(b))
+	}
+	return answers
+}
+
+// Sends a packet, checking the printer answers, and returns the status
+func sendPrinterPacket(t *testing.T, p *printer, packet []byte) byte {
+	answers := sendToPrinter(p, packet)
+	for i, answer := range answers[:len(answers)-2] {
+		if answer != 0x00 {
+			t.Errorf("the printer answered %.2X to the byte %d of the packet, expected 00", answer, i)
+		}
+	}
+	if alive := answers[len(answers)-2]; alive != PRINTER_ALIVE {
+		t.Errorf("the printer answered %.2X as alive, expected %.2X", alive, PRINTER_ALIVE)
+	}
+	return answers[len(answers)-1]
+}
+
+func TestPrinterPacketStateMachine(t *testing.T) {
+	band := make([]byte, PRINTER_BAND_SIZE)
+	tests := []struct {
+		name   string
+		bytes  []byte
+		status byte
+	}{
+		{"init", printerPacket(PRINTER_COMMAND_INIT, 0, nil), 0x00},
+		{"status", printerPacket(PRINTER_COMMAND_STATUS, 0, nil), 0x00},
+		{"data", printerPacket(PRINTER_COMMAND_DATA, 0, band), PRINTER_STATUS_UNPROCESSED_DATA},
+		{"empty data", printerPacket(PRINTER_COMMAND_DATA, 0, nil), 0x00},
+		{"unknown command", printerPacket(0x07, 0, nil), PRINTER_STATUS_PACKET_ERROR},
+		{"bytes before the magic bytes", append([]byte{0x00, 0x33, 0x12}, printerPacket(PRINTER_COMMAND_STATUS, 0, nil)...), 0x00},
+		{"repeated first magic byte", append([]byte{PRINTER_MAGIC_1}, printerPacket(PRINTER_COMMAND_STATUS, 0, nil)...), 0x00},
+	}
+	for _, test := range tests {
+		p, dir := newTestPrinter(t)
+		defer os.RemoveAll(dir)
+		if status := sendPrinterPacket(t, p, test.bytes); status != test.status {
+			t.Errorf("%s: status %.2X, expected %.2X", test.name, status, test.status)
+		}
+		if p.state != printerWaitingMagic1 {
+			t.Errorf("%s: the printer is not waiting for the next packet", test.name)
+		}
+	}
+}
+
+func TestPrinterStatus(t *testing.T) {
+	p, dir := newTestPrinter(t)
+	defer os.RemoveAll(dir)
+	band := make([]byte, PRINTER_BAND_SIZE)
+
+	sendPrinterPacket(t, p, printerPacket(PRINTER_COMMAND_INIT, 0, nil))
+	for i := 1; i <= 9; i++ {
+		status := sendPrinterPacket(t, p, printerPacket(PRINTER_COMMAND_DATA, 0, band))
+		expected := byte(PRINTER_STATUS_UNPROCESSED_DATA)
+		if i == 9 {
+			expected |= PRINTER_STATUS_FULL
+		}
+		if status != expected {
+			t.Errorf("status %.2X after %d bands, expected %.2X", status, i, expected)
+		}
+	}
+
+	// The printer is busy for some status inquiries after printing
+	if status := sendPrinterPacket(t, p, printerPacket(PRINTER_COMMAND_PRINT, 0, []byte{1, 0x00, 0xE4, 0x40})); status != PRINTER_STATUS_BUSY {
+		t.Errorf("status %.2X after printing, expected %.2X", status, PRINTER_STATUS_BUSY)
+	}
+	for i := 1; i <= PRINTER_BUSY_INQUIRIES; i++ {
+		status := sendPrinterPacket(t, p, printerPacket(PRINTER_COMMAND_STATUS, 0, nil))
+		expected := byte(PRINTER_STATUS_BUSY)
+		if i == PRINTER_BUSY_INQUIRIES {
+			expected = 0x00
+		}
+		if status != expected {
+			t.Errorf("status %.2X after %d inquiries, expected %.2X", status, i, expected)
+		}
+	}
+}
+
+func TestPrinterChecksumError(t *testing.T) {
+	p, dir := newTestPrinter(t)
+	defer os.RemoveAll(dir)
+
+	packet := printerPacket(PRINTER_COMMAND_DATA, 0, make([]byte, PRINTER_BAND_SIZE))
+	packet[len(packet)-4]++
+	if status := sendPrinterPacket(t, p, packet); status != PRINTER_STATUS_CHECKSUM_ERROR {
+		t.Errorf("status %.2X after a wrong checksum, expected %.2X", status, PRINTER_STATUS_CHECKSUM_ERROR)
+	}
+	if len(p.buffer) != 0 {
+		t.Errorf("the data of a packet with a wrong checksum was stored")
+	}
+
+	// The error is only reported for the wrong packet
+	if status := sendPrinterPacket(t, p, printerPacket(PRINTER_COMMAND_STATUS, 0, nil)); status != 0x00 {
+		t.Errorf("status %.2X after a valid packet, expected 00", status)
+	}
+}
+
+func TestDecompressPrinterData(t *testing.T) {
+	tests := []struct {
+		name       string
+		compressed []byte
+		expected   []byte
+	}{
+		{"literal", []byte{0x02, 1, 2, 3}, []byte{1, 2, 3}},
+		{"single literal", []byte{0x00, 9}, []byte{9}},
+		{"run", []byte{0x83, 0xAA}, []byte{0xAA, 0xAA, 0xAA, 0xAA, 0xAA}},
+		{"shortest run", []byte{0x80, 0x55}, []byte{0x55, 0x55}},
+		{"runs and literals", []byte{0x81, 0x11, 0x01, 0x22, 0x33, 0x80, 0x44}, []byte{0x11, 0x11, 0x11, 0x22, 0x33, 0x44, 0x44}},
+		{"longest literal", append([]byte{0x7F}, make([]byte, 128)...), make([]byte, 128)},
+		{"longest run", []byte{0xFF, 0x00}, make([]byte, 129)},
+		{"truncated literal", []byte{0x03, 1, 2}, []byte{1, 2}},
+		{"truncated run", []byte{0x00, 7, 0x85}, []byte{7}},
+		{"empty", nil, nil},
+	}
+	for _, test := range tests {
+		if got := decompressPrinterData(test.compressed); !bytes.Equal(got, test.expected) {
+			t.Errorf("%s: decompressed % x, expected % x", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestPrinterCompressedData(t *testing.T) {
+	p, dir := newTestPrinter(t)
+	defer os.RemoveAll(dir)
+
+	// A whole band of 0xFF, as 5 runs of 128 bytes
+	var compressed []byte
+	for i := 0; i < 5; i++ {
+		compressed = append(compressed, 0x80|126, 0xFF)
+	}
+	sendPrinterPacket(t, p, printerPacket(PRINTER_COMMAND_DATA, 1, compressed))
+	if !bytes.Equal(p.buffer, bytes.Repeat([]byte{0xFF}, PRINTER_BAND_SIZE)) {
+		t.Errorf("the compressed band was not stored in the printer memory")
+	}
+}
+
+// Returns a band whose first tile has the colors 0, 1, 2 and 3 in its first line
+func printerTestBand() []byte {
+	band := make([]byte, PRINTER_BAND_SIZE)
+	band[0] = 0x33 // low bits:  00110011
+	band[1] = 0x0F // high bits: 00001111
+	return band
+}
+
+func TestPrinterRender(t *testing.T) {
+	tests := []struct {
+		name                      string
+		marginBefore, marginAfter int
+		palette                   byte
+		colors                    [4]uint8 // shades of the colors 0 to 3
+	}{
+		{"usual palette", 0, 0, 0xE4, [4]uint8{0xFF, 0xAA, 0x55, 0x00}},
+		{"inverted palette", 0, 0, 0x1B, [4]uint8{0x00, 0x55, 0xAA, 0xFF}},
+		{"single shade", 0, 0, 0xFF, [4]uint8{0x00, 0x00, 0x00, 0x00}},
+		{"margins", 1, 3, 0xE4, [4]uint8{0xFF, 0xAA, 0x55, 0x00}},
+	}
+	for _, test := range tests {
+		p, dir := newTestPrinter(t)
+		defer os.RemoveAll(dir)
+		p.buffer = append(p.buffer, printerTestBand()...)
+		img := p.render(test.marginBefore, test.marginAfter, test.palette)
+
+		top := test.marginBefore * PRINTER_MARGIN_LINES
+		height := top + 2*8 + test.marginAfter*PRINTER_MARGIN_LINES
+		if bounds := img.Bounds(); bounds.Dx() != PRINTER_WIDTH || bounds.Dy() != height {
+			t.Errorf("%s: the image is %dx%d, expected %dx%d", test.name, bounds.Dx(), bounds.Dy(), PRINTER_WIDTH, height)
+			continue
+		}
+		for x := 0; x < 8; x++ {
+			color := x / 2
+			if got := img.GrayAt(x, top).Y; got != test.colors[color] {
+				t.Errorf("%s: pixel %d has the shade %.2X, expected %.2X", test.name, x, got, test.colors[color])
+			}
+		}
+		// The margins are blank, whatever the palette is
+		for _, y := range []int{0, height - 1} {
+			if y >= top && y < top+16 {
+				continue
+			}
+			if got := img.GrayAt(0, y).Y; got != printerShades[0] {
+				t.Errorf("%s: the margin line %d has the shade %.2X, expected %.2X", test.name, y, got, printerShades[0])
+			}
+		}
+	}
+}
+
+func TestPrinterPrint(t *testing.T) {
+	tests := []struct {
+		name    string
+		palette byte
+		colors  [4]uint8
+	}{
+		{"usual palette", 0xE4, [4]uint8{0xFF, 0xAA, 0x55, 0x00}},
+		{"default palette", 0x00, [4]uint8{0xFF, 0xAA, 0x55, 0x00}},
+		{"inverted palette", 0x1B, [4]uint8{0x00, 0x55, 0xAA, 0xFF}},
+	}
+	for _, test := range tests {
+		p, dir := newTestPrinter(t)
+		defer os.RemoveAll(dir)
+		sendPrinterPacket(t, p, printerPacket(PRINTER_COMMAND_INIT, 0, nil))
+		sendPrinterPacket(t, p, printerPacket(PRINTER_COMMAND_DATA, 0, printerTestBand()))
+		sendPrinterPacket(t, p, printerPacket(PRINTER_COMMAND_DATA, 0, nil))
+		sendPrinterPacket(t, p, printerPacket(PRINTER_COMMAND_PRINT, 0, []byte{1, 0x12, test.palette, 0x40}))
+
+		f, err := os.Open(filepath.Join(dir, "print-0001.png"))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		decoded, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		img, ok := decoded.(*image.Gray)
+		if !ok {
+			t.Errorf("%s: the printed image is not grayscale", test.name)
+			continue
+		}
+		top := 1 * PRINTER_MARGIN_LINES
+		if height, expected := img.Bounds().Dy(), top+2*8+2*PRINTER_MARGIN_LINES; height != expected {
+			t.Errorf("%s: the printed image is %d pixels high, expected %d", test.name, height, expected)
+		}
+		for x := 0; x < 8; x++ {
+			if got := img.GrayAt(x, top).Y; got != test.colors[x/2] {
+				t.Errorf("%s: pixel %d has the shade %.2X, expected %.2X", test.name, x, got, test.colors[x/2])
+			}
+		}
+	}
+}
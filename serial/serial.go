@@ -0,0 +1,216 @@
+// Package serial implements the GameBoy serial port (SB and SC registers),
+// which communicates with other devices through the link cable.
+package serial
+
+import (
+	"github.com/lbarrios/yesSGMB/clock"
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/mmu"
+	"github.com/lbarrios/yesSGMB/types"
+	"sync"
+)
+
+const (
+	SB_ADDRESS = types.Word(0xFF01)
+	SC_ADDRESS = types.Word(0xFF02)
+)
+
+const ( // Interruptions
+	SERIAL_IRQ = mmu.SERIAL_INTERRUPT // bit 3
+)
+
+// SC register
+//
+//	Bit 7   - Transfer Start Flag (0=No Transfer, 1=Start or Transfer in progress)
+//	Bits 6-1 - Not used (always 1)
+//	Bit 0   - Shift Clock (0=External Clock, 1=Internal Clock 8192Hz)
+const (
+	SC_TRANSFER_BIT = 7
+	SC_CLOCK_BIT    = 0
+	SC_UNUSED_MASK  = 0x7E
+)
+
+const (
+	STEP_CYCLES           = 4   // the serial port is updated every machine cycle
+	SERIAL_CYCLES_PER_BIT = 512 // 8192Hz internal clock
+	SERIAL_BITS           = 8
+	DISCONNECTED_INPUT    = 0xFF // the input line is pulled up when nothing is connected
+)
+
+type serial struct {
+	log        logger.Logger
+	clock      clock.ClockCounter
+	irqHandler mmu.IRQHandler
+	mutex      sync.Mutex
+	link       LinkPort
+	lockstep   LockstepLink // the link, if it must be synchronized with the emulation
+	sb         byte
+	sc         byte
+	incoming   byte // byte received from the link, which is shifted in one bit at a time
+	bits       int  // bits shifted in the current transfer
+	cycles     int  // cycles since the last shifted bit
+}
+
+func NewSerial(irqHandler mmu.IRQHandler, l *logger.Logger) *serial {
+	s := new(serial)
+	s.irqHandler = irqHandler
+	s.log = *l
+	s.log.SetPrefix("\033[0;36mSERIAL: ")
+	s.ConnectLink(NewDisconnectedLink())
+	return s
+}
+
+func (s *serial) ConnectClock(clockWg *sync.WaitGroup, clock clock.Clock) chan uint64 {
+	s.clock.Init(clockWg, make(chan uint64), clock)
+	return s.clock.Channel
+}
+
+func (s *serial) GetName() string {
+	return "serial"
+}
+
+// ConnectLink plugs the link cable into the serial port.
+func (s *serial) ConnectLink(link LinkPort) {
+	s.mutex.Lock()
+	s.link = link
+	s.lockstep, _ = link.(LockstepLink)
+	s.mutex.Unlock()
+	link.Connect(s)
+}
+
+func (s *serial) Reset() {
+	s.log.Println("Serial reset triggered.")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sb = 0x00
+	s.sc = 0x00
+	s.bits = 0
+	s.cycles = 0
+}
+
+// Called with the memory locked
+func (s *serial) ReadRegister(address types.Address) byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch address.AsWord() {
+	case SB_ADDRESS:
+		return s.sb
+	case SC_ADDRESS:
+		return s.sc | SC_UNUSED_MASK
+	default:
+		s.log.Fatalf("Trying to read unexpected address: 0x%.4x", address.AsWord())
+		return 0xFF
+	}
+}
+
+// Called with the memory locked
+func (s *serial) WriteRegister(address types.Address, value byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch address.AsWord() {
+	case SB_ADDRESS:
+		s.sb = value
+	case SC_ADDRESS:
+		s.sc = value &^ SC_UNUSED_MASK
+		// Setting the start flag begins a new transfer, and clearing it aborts the current one
+		s.bits = 0
+		s.cycles = 0
+	default:
+		s.log.Fatalf("Trying to write unexpected address: 0x%.4x", address.AsWord())
+	}
+}
+
+func (s *serial) transferring() bool {
+	return types.BitIsSet(s.sc, SC_TRANSFER_BIT)
+}
+
+func (s *serial) internalClock() bool {
+	return types.BitIsSet(s.sc, SC_CLOCK_BIT)
+}
+
+func (s *serial) finishTransfer() {
+	s.sc &^= 1 << SC_TRANSFER_BIT
+	s.bits = 0
+	s.cycles = 0
+}
+
+// ExternalTransfer is called by the other end of the link when it is the clock master.
+// It shifts in a whole byte and returns the byte shifted out. If the GameBoy is not waiting
+// for a transfer with the external clock, nothing is shifted and the line reads as disconnected.
+func (s *serial) ExternalTransfer(in byte) byte {
+	s.mutex.Lock()
+	if !s.transferring() || s.internalClock() {
+		s.mutex.Unlock()
+		return DISCONNECTED_INPUT
+	}
+	out := s.sb
+	s.sb = in
+	s.finishTransfer()
+	s.mutex.Unlock()
+
+	// The interrupt is requested without holding the lock, as it accesses the memory
+	s.irqHandler.RequestInterrupt(SERIAL_IRQ)
+	return out
+}
+
+// Advances the serial port one machine cycle.
+// Returns true if the serial interrupt must be requested.
+func (s *serial) step() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// With the external clock, the transfer is driven by the other end of the link
+	if !s.transferring() || !s.internalClock() {
+		return false
+	}
+
+	s.cycles += STEP_CYCLES
+	if s.cycles < SERIAL_CYCLES_PER_BIT {
+		return false
+	}
+	s.cycles = 0
+
+	// The whole byte is exchanged with the link when the first bit is shifted.
+	// The link can block (i.e. waiting the other end), so the lock is released meanwhile.
+	if s.bits == 0 {
+		out, link := s.sb, s.link
+		s.mutex.Unlock()
+		in := link.Exchange(out)
+		s.mutex.Lock()
+		if !s.transferring() || s.bits != 0 {
+			// The transfer was aborted or restarted while exchanging
+			return false
+		}
+		s.incoming = in
+	}
+
+	// The most significant bit is shifted out, and the incoming bit is shifted in
+	s.sb = s.sb<<1 | (s.incoming>>uint(SERIAL_BITS-1-s.bits))&0x01
+	s.bits++
+	if s.bits < SERIAL_BITS {
+		return false
+	}
+	s.finishTransfer()
+	return true
+}
+
+func (s *serial) Run(wg *sync.WaitGroup) {
+	s.log.Println("Serial started.")
+	for {
+		if !s.clock.WaitNextCycle() {
+			break
+		}
+
+		// Both ends of a lockstep link are synchronized before updating the serial port
+		if s.lockstep != nil {
+			s.lockstep.Sync(s.clock.Cycles)
+		}
+
+		// The interrupt is requested without holding the lock, as it accesses the memory
+		if s.step() {
+			s.irqHandler.RequestInterrupt(SERIAL_IRQ)
+		}
+		s.clock.Cycles += STEP_CYCLES
+	}
+	wg.Done()
+}
@@ -0,0 +1,152 @@
+package serial
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Cycles from the start of a transfer with the internal clock to the serial interrupt
+const transferCycles = SERIAL_BITS*SERIAL_CYCLES_PER_BIT - STEP_CYCLES
+
+func TestSerialShiftTiming(t *testing.T) {
+	gb := newTestGameBoy()
+	gb.serial.ConnectLink(NewDisconnectedLink())
+	gb.serial.WriteRegister(SB_ADDRESS.AsAddress(), 0x00)
+	gb.serial.WriteRegister(SC_ADDRESS.AsAddress(), 0x81)
+
+	// A bit is shifted every 512 cycles, the disconnected input line reads as 1
+	expected := byte(0x00)
+	for bit := 0; bit < SERIAL_BITS; bit++ {
+		gb.run(nil, uint64(bit+1)*SERIAL_CYCLES_PER_BIT-STEP_CYCLES, false)
+		if got := gb.serial.ReadRegister(SB_ADDRESS.AsAddress()); got != expected {
+			t.Errorf("SB is %.2X before shifting the bit %d, expected %.2X", got, bit, expected)
+		}
+		gb.run(nil, uint64(bit+1)*SERIAL_CYCLES_PER_BIT, false)
+		expected = expected<<1 | 0x01
+		if got := gb.serial.ReadRegister(SB_ADDRESS.AsAddress()); got != expected {
+			t.Errorf("SB is %.2X after shifting the bit %d, expected %.2X", got, bit, expected)
+		}
+	}
+}
+
+func TestSerialInterruptOnCompletion(t *testing.T) {
+	gb := newTestGameBoy()
+	gb.serial.ConnectLink(NewLoopbackLink())
+	gb.run([]registerWrite{{0, SB_ADDRESS, 0x5A}, {100, SC_ADDRESS, 0x81}}, 3*transferCycles, false)
+
+	expected := []received{{100 + transferCycles, 0x5A}}
+	if !reflect.DeepEqual(gb.received, expected) {
+		t.Errorf("received %v, expected %v", gb.received, expected)
+	}
+	if got := gb.serial.ReadRegister(SC_ADDRESS.AsAddress()); got != 0x7F {
+		t.Errorf("SC is %.2X after the transfer, expected 7F", got)
+	}
+}
+
+func TestSerialControlReadBack(t *testing.T) {
+	tests := []struct {
+		value    byte
+		expected byte
+	}{
+		{0x00, 0x7E},
+		{0x01, 0x7F},
+		{0x80, 0xFE},
+		{0x81, 0xFF},
+		{0x7E, 0x7E},
+		{0xFF, 0xFF},
+		{0x42, 0x7E},
+	}
+	for _, test := range tests {
+		gb := newTestGameBoy()
+		gb.serial.WriteRegister(SC_ADDRESS.AsAddress(), test.value)
+		if got := gb.serial.ReadRegister(SC_ADDRESS.AsAddress()); got != test.expected {
+			t.Errorf("SC reads %.2X after writing %.2X, expected %.2X", got, test.value, test.expected)
+		}
+	}
+}
+
+func TestSerialAbortTransfer(t *testing.T) {
+	gb := newTestGameBoy()
+	gb.serial.ConnectLink(NewDisconnectedLink())
+	writes := []registerWrite{
+		{0, SB_ADDRESS, 0x00},
+		{0, SC_ADDRESS, 0x81},
+		// Clearing the start flag after 3 bits aborts the transfer
+		{3 * SERIAL_CYCLES_PER_BIT, SC_ADDRESS, 0x01},
+	}
+	gb.run(writes, 3*transferCycles, false)
+
+	if len(gb.received) != 0 {
+		t.Errorf("the aborted transfer requested the interrupt: %v", gb.received)
+	}
+	if got := gb.serial.ReadRegister(SB_ADDRESS.AsAddress()); got != 0x07 {
+		t.Errorf("SB is %.2X after aborting the transfer, expected 07", got)
+	}
+
+	// A new transfer starts from the first bit
+	gb.serial.WriteRegister(SC_ADDRESS.AsAddress(), 0x81)
+	start := gb.cycles
+	gb.run(nil, start+3*transferCycles, false)
+	expected := []received{{start + transferCycles, 0xFF}}
+	if !reflect.DeepEqual(gb.received, expected) {
+		t.Errorf("received %v after restarting the transfer, expected %v", gb.received, expected)
+	}
+}
+
+func TestSerialExternalClock(t *testing.T) {
+	gb := newTestGameBoy()
+	gb.run([]registerWrite{{0, SB_ADDRESS, 0x42}, {0, SC_ADDRESS, 0x80}}, 2*transferCycles, false)
+	if len(gb.received) != 0 {
+		t.Fatalf("the transfer with the external clock finished without the other end: %v", gb.received)
+	}
+
+	if out := gb.serial.ExternalTransfer(0x99); out != 0x42 {
+		t.Errorf("ExternalTransfer shifted out %.2X, expected 42", out)
+	}
+	expected := []received{{2 * transferCycles, 0x99}}
+	if !reflect.DeepEqual(gb.received, expected) {
+		t.Errorf("received %v, expected %v", gb.received, expected)
+	}
+
+	// Without a transfer waiting for the external clock, nothing is shifted
+	if out := gb.serial.ExternalTransfer(0x11); out != DISCONNECTED_INPUT {
+		t.Errorf("ExternalTransfer without a transfer shifted out %.2X, expected FF", out)
+	}
+	if got := gb.serial.ReadRegister(SB_ADDRESS.AsAddress()); got != 0x99 {
+		t.Errorf("SB is %.2X, expected 99", got)
+	}
+}
+
+func TestSerialLinkBackends(t *testing.T) {
+	var capture bytes.Buffer
+	tests := []struct {
+		name     string
+		link     LinkPort
+		expected []received
+	}{
+		{"disconnected", NewDisconnectedLink(), []received{{transferCycles, 0xFF}, {100 + 2*transferCycles, 0xFF}}},
+		{"capture", NewCaptureLink(&capture), []received{{transferCycles, 0xFF}, {100 + 2*transferCycles, 0xFF}}},
+		{"loopback", NewLoopbackLink(), []received{{transferCycles, 'O'}, {100 + 2*transferCycles, 'K'}}},
+	}
+	for _, test := range tests {
+		gb := newTestGameBoy()
+		gb.serial.ConnectLink(test.link)
+		writes := []registerWrite{
+			{0, SB_ADDRESS, 'O'},
+			{0, SC_ADDRESS, 0x81},
+			{100 + transferCycles, SB_ADDRESS, 'K'},
+			{100 + transferCycles, SC_ADDRESS, 0x81},
+		}
+		gb.run(writes, 3*transferCycles, false)
+		if !reflect.DeepEqual(gb.received, test.expected) {
+			t.Errorf("%s link: received %v, expected %v", test.name, gb.received, test.expected)
+		}
+		if err := test.link.Close(); err != nil {
+			t.Errorf("%s link: closing: %v", test.name, err)
+		}
+	}
+	if got := capture.String(); got != "OK" {
+		t.Errorf("captured %q, expected \"OK\"", got)
+	}
+}
@@ -0,0 +1,309 @@
+package serial
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/lbarrios/yesSGMB/logger"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// The link cable over TCP connects two emulators running in lockstep.
+//
+// When connecting, both ends negotiate which one is the clock master: each one sends a random
+// number, and the highest one wins (they are sent again on a tie). A transfer is always driven
+// by the GameBoy that starts it with the internal clock: it sends a transfer message, and the
+// other end shifts it in with the external clock and answers with a reply message. If both
+// GameBoys start a transfer with the internal clock in the same period, the clock of the master
+// drives the cable: the slave shifts in the byte of the master as if it were using the external
+// clock, and answers with its own byte, so the master never sees a crossed transfer.
+//
+// Every LINK_SYNC_CYCLES both ends exchange a sync message and wait for each other, serving
+// the transfers started by the other end meanwhile. This way, a transfer is always received
+// at the same cycle, regardless of the speed of each emulator or the network. As an emulator
+// can be paused or take a while to start, the other end waits for it as long as the connection
+// is open, logging a message every LINK_TIMEOUT.
+const (
+	LINK_SYNC_CYCLES      = 4096 // the time needed to transfer a byte with the internal clock
+	LINK_TIMEOUT          = 10 * time.Second
+	LINK_CONNECT_TIMEOUT  = 10 * time.Second
+	LINK_CONNECT_RETRY    = 100 * time.Millisecond
+	LINK_SEND_QUEUE       = 64 // messages waiting to be written, so both ends can send at the same time
+	LINK_PROTOCOL_VERSION = 2
+	linkMagic             = "YSGB"
+)
+
+// Messages are two bytes long, the message kind and its value
+const (
+	linkMessageTransfer = 'T'
+	linkMessageReply    = 'R'
+	linkMessageSync     = 'S'
+)
+
+// tcpLink is a link port connected to another emulator.
+// Exchange and Sync are only called from the serial port goroutine.
+type tcpLink struct {
+	log       logger.Logger
+	conn      net.Conn
+	reader    *bufio.Reader
+	outgoing  chan []byte // messages written to the connection by the writer goroutine
+	closed    chan struct{}
+	closeOnce sync.Once
+	device    Device
+	master    bool // this end drives the cable when both GameBoys use the internal clock
+	connected bool
+	nextSync  uint64
+	syncs     uint64 // sync messages sent
+	peerSyncs uint64 // sync messages received
+}
+
+// ListenTCPLink waits for the other emulator to connect to the given address.
+func ListenTCPLink(address string, l *logger.Logger) (*tcpLink, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	l.Printf("Waiting for the other GameBoy on %s.", listener.Addr())
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPLink(conn, l)
+}
+
+// DialTCPLink connects to the emulator listening on the given address,
+// retrying until it is ready or LINK_CONNECT_TIMEOUT is reached.
+func DialTCPLink(address string, l *logger.Logger) (*tcpLink, error) {
+	deadline := time.Now().Add(LINK_CONNECT_TIMEOUT)
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			return NewTCPLink(conn, l)
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(LINK_CONNECT_RETRY)
+	}
+}
+
+// NewTCPLink creates a link port over an established connection, after checking
+// that the other end talks the same protocol and negotiating the clock master.
+func NewTCPLink(conn net.Conn, l *logger.Logger) (*tcpLink, error) {
+	link := new(tcpLink)
+	link.log = *l
+	link.log.SetPrefix("\033[0;36mLINK: ")
+	link.conn = conn
+	link.reader = bufio.NewReader(conn)
+	link.outgoing = make(chan []byte, LINK_SEND_QUEUE)
+	link.closed = make(chan struct{})
+	link.nextSync = LINK_SYNC_CYCLES
+	go link.write()
+	if err := link.handshake(); err != nil {
+		link.close()
+		return nil, err
+	}
+	link.connected = true
+	role := "slave"
+	if link.master {
+		role = "master"
+	}
+	link.log.Printf("Connected to the other GameBoy at %s, as the clock %s.", conn.RemoteAddr(), role)
+	return link, nil
+}
+
+func (link *tcpLink) handshake() error {
+	hello := append([]byte(linkMagic), LINK_PROTOCOL_VERSION)
+	link.conn.SetReadDeadline(time.Now().Add(LINK_TIMEOUT))
+	defer link.conn.SetReadDeadline(time.Time{})
+	link.queue(hello)
+	peerHello := make([]byte, len(hello))
+	if _, err := io.ReadFull(link.reader, peerHello); err != nil {
+		return err
+	}
+	if !bytes.Equal(hello, peerHello) {
+		return errors.New(fmt.Sprintf("Unexpected handshake from the other end of the link: % x, expected % x.", peerHello, hello))
+	}
+
+	// Clock master negotiation
+	for {
+		var number, peerNumber [4]byte
+		binary.BigEndian.PutUint32(number[:], rand.Uint32())
+		link.queue(number[:])
+		if _, err := io.ReadFull(link.reader, peerNumber[:]); err != nil {
+			return err
+		}
+		if order := bytes.Compare(number[:], peerNumber[:]); order != 0 {
+			link.master = order > 0
+			return nil
+		}
+	}
+}
+
+// Master reports whether this end was negotiated as the clock master.
+func (link *tcpLink) Master() bool {
+	return link.master
+}
+
+func (link *tcpLink) Connect(device Device) {
+	link.device = device
+}
+
+// Close can be called from any goroutine. It also unblocks the serial port,
+// if it is waiting for the other end.
+func (link *tcpLink) Close() error {
+	return link.close()
+}
+
+func (link *tcpLink) close() error {
+	var err error
+	link.closeOnce.Do(func() {
+		close(link.closed)
+		err = link.conn.Close()
+	})
+	return err
+}
+
+// After the connection is lost, the link behaves as disconnected
+func (link *tcpLink) disconnect(err error) {
+	link.log.Printf("Link cable disconnected: %s", err)
+	link.connected = false
+	link.close()
+}
+
+// Writes the queued messages, so sending never blocks while the other end is also sending
+func (link *tcpLink) write() {
+	for {
+		select {
+		case message := <-link.outgoing:
+			if _, err := link.conn.Write(message); err != nil {
+				// The reader finds the connection closed and disconnects the link
+				link.close()
+				return
+			}
+		case <-link.closed:
+			return
+		}
+	}
+}
+
+func (link *tcpLink) queue(message []byte) bool {
+	select {
+	case link.outgoing <- message:
+		return true
+	case <-link.closed:
+		return false
+	}
+}
+
+func (link *tcpLink) send(kind byte, value byte) bool {
+	if !link.connected {
+		return false
+	}
+	if !link.queue([]byte{kind, value}) {
+		link.disconnect(errors.New("the link was closed"))
+		return false
+	}
+	return true
+}
+
+// Waits for the next message as long as the connection is open.
+func (link *tcpLink) receive() (kind byte, value byte, ok bool) {
+	if !link.connected {
+		return 0, 0, false
+	}
+	var message [2]byte
+	for read := 0; read < len(message); {
+		link.conn.SetReadDeadline(time.Now().Add(LINK_TIMEOUT))
+		n, err := link.reader.Read(message[read:])
+		read += n
+		if err, timeout := err.(net.Error); timeout && err.Timeout() {
+			link.log.Println("Waiting for the other GameBoy...")
+			continue
+		}
+		if err != nil {
+			link.disconnect(err)
+			return 0, 0, false
+		}
+	}
+	return message[0], message[1], true
+}
+
+func (link *tcpLink) unexpectedMessage(kind byte) {
+	link.disconnect(errors.New(fmt.Sprintf("Unexpected message from the other end of the link: 0x%.2x", kind)))
+}
+
+// Serves a transfer started by the other end, shifting in its byte with the external clock.
+func (link *tcpLink) serveTransfer(in byte) {
+	reply := byte(DISCONNECTED_INPUT)
+	if link.device != nil {
+		reply = link.device.ExternalTransfer(in)
+	}
+	link.send(linkMessageReply, reply)
+}
+
+// Exchange sends the byte to the other end, and blocks until it is shifted in there.
+func (link *tcpLink) Exchange(out byte) byte {
+	if !link.send(linkMessageTransfer, out) {
+		return DISCONNECTED_INPUT
+	}
+	for {
+		kind, value, ok := link.receive()
+		if !ok {
+			return DISCONNECTED_INPUT
+		}
+		switch kind {
+		case linkMessageReply:
+			return value
+		case linkMessageTransfer:
+			// Both ends started a transfer with the internal clock in the same period.
+			// The master waits for the reply of the slave, which shifts in this byte
+			// as if it were using the external clock, and answers with its own byte.
+			if !link.master {
+				link.send(linkMessageReply, out)
+				return value
+			}
+		case linkMessageSync:
+			// The other end reached the next sync point first, it will serve our transfer while waiting
+			link.peerSyncs++
+		default:
+			link.unexpectedMessage(kind)
+			return DISCONNECTED_INPUT
+		}
+	}
+}
+
+// Sync is called every cycle. Each LINK_SYNC_CYCLES it waits for the other end
+// to reach the same cycle, serving the transfers the other end started before.
+func (link *tcpLink) Sync(cycles uint64) {
+	if !link.connected || cycles < link.nextSync {
+		return
+	}
+	link.nextSync += LINK_SYNC_CYCLES
+	link.syncs++
+	if !link.send(linkMessageSync, 0) {
+		return
+	}
+	for link.peerSyncs < link.syncs {
+		kind, value, ok := link.receive()
+		if !ok {
+			return
+		}
+		switch kind {
+		case linkMessageTransfer:
+			link.serveTransfer(value)
+		case linkMessageSync:
+			link.peerSyncs++
+		default:
+			link.unexpectedMessage(kind)
+			return
+		}
+	}
+}
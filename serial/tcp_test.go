@@ -0,0 +1,182 @@
+package serial
+
+import (
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/types"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestLogger() *logger.Logger {
+	l := new(logger.Logger)
+	l.Init()
+	l.Log = log.New(ioutil.Discard, "", 0)
+	return l
+}
+
+// A byte received by the serial port, and the cycle when the interrupt was requested
+type received struct {
+	cycle uint64
+	value byte
+}
+
+// testGameBoy has only a serial port, which is updated as the clock does it
+type testGameBoy struct {
+	serial   *serial
+	cycles   uint64
+	received []received
+}
+
+func newTestGameBoy() *testGameBoy {
+	gb := new(testGameBoy)
+	gb.serial = NewSerial(gb, newTestLogger())
+	return gb
+}
+
+func (gb *testGameBoy) RequestInterrupt(interrupt byte) {
+	gb.received = append(gb.received, received{gb.cycles, gb.serial.ReadRegister(SB_ADDRESS.AsAddress())})
+}
+
+type registerWrite struct {
+	cycle   uint64
+	address types.Word
+	value   byte
+}
+
+// Runs the GameBoy until the given cycle, writing the registers at the given cycles.
+// With jitter, it sleeps from time to time, so both ends run at different speeds.
+func (gb *testGameBoy) run(writes []registerWrite, until uint64, jitter bool) {
+	for gb.cycles < until {
+		for _, write := range writes {
+			if write.cycle == gb.cycles {
+				gb.serial.WriteRegister(write.address.AsAddress(), write.value)
+			}
+		}
+		if gb.serial.lockstep != nil {
+			gb.serial.lockstep.Sync(gb.cycles)
+		}
+		if gb.serial.step() {
+			gb.RequestInterrupt(SERIAL_IRQ)
+		}
+		gb.cycles += STEP_CYCLES
+		if jitter && rand.Intn(2000) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// Connects two links through an in-memory connection
+func newTestLinks(t *testing.T) (*tcpLink, *tcpLink) {
+	conn1, conn2 := net.Pipe()
+	links := make(chan *tcpLink)
+	for _, conn := range []net.Conn{conn1, conn2} {
+		go func(conn net.Conn) {
+			link, err := NewTCPLink(conn, newTestLogger())
+			if err != nil {
+				t.Error(err)
+			}
+			links <- link
+		}(conn)
+	}
+	link1, link2 := <-links, <-links
+	if link1 == nil || link2 == nil {
+		t.FailNow()
+	}
+	return link1, link2
+}
+
+func TestTCPLinkNegotiatesTheClockMaster(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		link1, link2 := newTestLinks(t)
+		if link1.Master() == link2.Master() {
+			t.Errorf("both ends are the clock %s", map[bool]string{true: "master", false: "slave"}[link1.Master()])
+		}
+		link1.Close()
+		link2.Close()
+	}
+}
+
+func TestTCPLinkTransfers(t *testing.T) {
+	// The other end receives a transfer in the next sync point after the first bit is shifted
+	tests := []struct {
+		name             string
+		writes1, writes2 []registerWrite
+		received1        []received
+		received2        []received
+	}{
+		{"transfer",
+			[]registerWrite{{0, SB_ADDRESS, 0x42}, {1000, SC_ADDRESS, 0x81}},
+			[]registerWrite{{0, SB_ADDRESS, 0x99}, {0, SC_ADDRESS, 0x80}},
+			[]received{{1000 + transferCycles, 0x99}},
+			[]received{{LINK_SYNC_CYCLES, 0x42}}},
+		{"transfer from both ends",
+			[]registerWrite{{0, SB_ADDRESS, 0x42}, {1000, SC_ADDRESS, 0x81}, {9000, SB_ADDRESS, 0x01}, {9000, SC_ADDRESS, 0x80}},
+			[]registerWrite{{0, SB_ADDRESS, 0x99}, {0, SC_ADDRESS, 0x80}, {10000, SB_ADDRESS, 0x02}, {10000, SC_ADDRESS, 0x81}},
+			[]received{{1000 + transferCycles, 0x99}, {3 * LINK_SYNC_CYCLES, 0x02}},
+			[]received{{LINK_SYNC_CYCLES, 0x42}, {10000 + transferCycles, 0x01}}},
+		{"no transfer at the other end",
+			[]registerWrite{{0, SB_ADDRESS, 0x42}, {1000, SC_ADDRESS, 0x81}},
+			nil,
+			[]received{{1000 + transferCycles, DISCONNECTED_INPUT}},
+			nil},
+		{"crossed transfers with the internal clock",
+			[]registerWrite{{0, SB_ADDRESS, 0x11}, {1000, SC_ADDRESS, 0x81}},
+			[]registerWrite{{0, SB_ADDRESS, 0x22}, {2000, SC_ADDRESS, 0x81}},
+			[]received{{1000 + transferCycles, 0x22}},
+			[]received{{2000 + transferCycles, 0x11}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The same transfers must be received at the same cycles on every run
+			for run := 0; run < 5; run++ {
+				link1, link2 := newTestLinks(t)
+				gb1, gb2 := newTestGameBoy(), newTestGameBoy()
+				gb1.serial.ConnectLink(link1)
+				gb2.serial.ConnectLink(link2)
+
+				done := make(chan bool)
+				go func() {
+					gb1.run(test.writes1, 5*LINK_SYNC_CYCLES, run%2 == 0)
+					done <- true
+				}()
+				go func() {
+					gb2.run(test.writes2, 5*LINK_SYNC_CYCLES, run%2 == 1)
+					done <- true
+				}()
+				<-done
+				<-done
+				link1.Close()
+				link2.Close()
+
+				if !reflect.DeepEqual(gb1.received, test.received1) {
+					t.Errorf("run %d: the first GameBoy received %v, expected %v", run, gb1.received, test.received1)
+				}
+				if !reflect.DeepEqual(gb2.received, test.received2) {
+					t.Errorf("run %d: the second GameBoy received %v, expected %v", run, gb2.received, test.received2)
+				}
+			}
+		})
+	}
+}
+
+func TestTCPLinkDisconnection(t *testing.T) {
+	link1, link2 := newTestLinks(t)
+	gb := newTestGameBoy()
+	gb.serial.ConnectLink(link1)
+	link2.Close()
+
+	// The link behaves as disconnected, instead of waiting for the other end
+	gb.run([]registerWrite{{0, SB_ADDRESS, 0x42}, {0, SC_ADDRESS, 0x81}}, 2*LINK_SYNC_CYCLES, false)
+	expected := []received{{transferCycles, DISCONNECTED_INPUT}}
+	if !reflect.DeepEqual(gb.received, expected) {
+		t.Errorf("received %v, expected %v", gb.received, expected)
+	}
+	if err := link1.Close(); err != nil {
+		t.Errorf("closing a disconnected link: %v", err)
+	}
+}
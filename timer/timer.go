@@ -5,6 +5,7 @@ package timer
 import (
 	"github.com/lbarrios/yesSGMB/clock"
 	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/mmu"
 	"github.com/lbarrios/yesSGMB/types"
 	"sync"
 )
@@ -27,17 +28,55 @@ const (
 	CYCLES_262144 = 16
 )
 
+const ( // Interruptions
+	TIMER_IRQ = mmu.TIMER_INTERRUPT // bit 2
+)
+
+// TAC register
+//
+//	Bit 2   - Timer Enable
+//	Bits 1-0 - Input Clock Select
+//	           00: CPU Clock / 1024 (4096 Hz)
+//	           01: CPU Clock / 16   (262144 Hz)
+//	           10: CPU Clock / 64   (65536 Hz)
+//	           11: CPU Clock / 256  (16384 Hz)
+//	Bits 7-3 - Not used (always 1)
+const (
+	TAC_ENABLE_BIT    = 2
+	TAC_CLOCK_MASK    = 0x03
+	TAC_UNUSED_MASK   = 0xF8
+	STEP_CYCLES       = 4 // the timer is updated every machine cycle
+	DIV_SHIFT         = 8 // DIV is the upper byte of the internal divider
+	RELOAD_DELAY      = 1 // machine cycles between the TIMA overflow and the TMA reload
+	POST_BOOT_DIVIDER = 0xABCC
+)
+
+// TIMA is incremented on the falling edge of this bit of the internal divider,
+// for each of the TAC input clocks. Each bit toggles at twice the TIMA frequency.
+var tacDividerBit = [4]uint{
+	9, // CYCLES_4096
+	3, // CYCLES_262144
+	5, // CYCLES_65536
+	7, // CYCLES_16384
+}
+
 type timer struct {
-	log   logger.Logger
-	clock clock.ClockCounter
-	div   *byte
-	tima  *byte
-	tma   *byte
-	tac   *byte
+	log        logger.Logger
+	clock      clock.ClockCounter
+	irqHandler mmu.IRQHandler
+	mutex      sync.Mutex
+	divider    types.Word // internal 16 bits counter, incremented every clock cycle
+	tima       byte
+	tma        byte
+	tac        byte
+	reloading  int  // machine cycles left until TIMA is reloaded after an overflow
+	reloaded   bool // TIMA was reloaded in the current machine cycle
+	lastSignal bool // value of the selected divider bit AND timer enable, to detect the falling edges
 }
 
-func NewTimer(l *logger.Logger) *timer {
+func NewTimer(irqHandler mmu.IRQHandler, l *logger.Logger) *timer {
 	t := new(timer)
+	t.irqHandler = irqHandler
 	t.log = *l
 	t.log.SetPrefix("\033[0;32mTIMER: ")
 	return t
@@ -52,51 +91,133 @@ func (t *timer) GetName() string {
 	return "timer"
 }
 
-func (t *timer) Reset() {
+// Reset sets the timer to its state after the boot procedure,
+// or to its power up state if a boot rom is going to be executed.
+func (t *timer) Reset(bootROM bool) {
 	t.log.Println("Timer reset triggered.")
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.divider = POST_BOOT_DIVIDER
+	if bootROM {
+		t.divider = 0
+	}
+	t.tima = 0
+	t.tma = 0
+	t.tac = 0
+	t.reloading = 0
+	t.reloaded = false
+	t.lastSignal = t.signal()
+}
+
+// Called with the memory locked
+func (t *timer) ReadRegister(address types.Address) byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch address.AsWord() {
+	case DIV_ADDRESS:
+		return byte(t.divider >> DIV_SHIFT)
+	case TIMA_ADDRESS:
+		return t.tima
+	case TMA_ADDRESS:
+		return t.tma
+	case TAC_ADDRESS:
+		return t.tac | TAC_UNUSED_MASK
+	default:
+		t.log.Fatalf("Trying to read unexpected address: 0x%.4x", address.AsWord())
+		return 0xFF
+	}
 }
 
-func (t *timer) MapByte(logical_address types.Address, physical_address *byte) {
-	addr := logical_address.AsWord()
-	switch {
-	case addr == DIV_ADDRESS:
-		t.div = physical_address
-	case addr == TIMA_ADDRESS:
-		t.tima = physical_address
-	case addr == TMA_ADDRESS:
-		t.tma = physical_address
-	case addr == TAC_ADDRESS:
-		t.tac = physical_address
+// Called with the memory locked
+func (t *timer) WriteRegister(address types.Address, value byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	switch address.AsWord() {
+	case DIV_ADDRESS:
+		// Any write resets the whole internal divider,
+		// which can produce a falling edge and increment TIMA
+		t.divider = 0
+		t.checkFallingEdge()
+	case TIMA_ADDRESS:
+		// Writing TIMA in the cycle after an overflow cancels the reload and the interrupt,
+		// but writing it in the cycle of the reload is ignored
+		if t.reloaded {
+			return
+		}
+		t.reloading = 0
+		t.tima = value
+	case TMA_ADDRESS:
+		t.tma = value
+		// If TMA is written in the same cycle TIMA is reloaded, the new value is also loaded in TIMA
+		if t.reloaded {
+			t.tima = value
+		}
+	case TAC_ADDRESS:
+		// Disabling the timer or changing the clock can produce a falling edge too
+		t.tac = value &^ TAC_UNUSED_MASK
+		t.checkFallingEdge()
 	default:
-		t.log.Fatalf("Trying to map unexpected address: 0x%.4x", addr)
+		t.log.Fatalf("Trying to write unexpected address: 0x%.4x", address.AsWord())
 	}
 }
 
-func (t *timer) step() {
-	*t.tima -= *t.tma
-	// t clock main = 0;
-	if *t.tima == 0 {
-		*t.tima = *t.tma
-		// interrupt flag |= 4;
+func (t *timer) signal() bool {
+	enabled := types.BitIsSet(t.tac, TAC_ENABLE_BIT)
+	bit := tacDividerBit[t.tac&TAC_CLOCK_MASK]
+	return enabled && t.divider&(1<<bit) != 0
+}
+
+func (t *timer) checkFallingEdge() {
+	signal := t.signal()
+	if t.lastSignal && !signal {
+		t.incrementTima()
 	}
+	t.lastSignal = signal
+}
+
+// When TIMA overflows, it stays at 0x00 for a machine cycle,
+// and then it is reloaded with TMA and the timer interrupt is requested.
+func (t *timer) incrementTima() {
+	t.tima++
+	if t.tima == 0x00 {
+		t.reloading = RELOAD_DELAY
+	}
+}
+
+// Advances the timer one machine cycle.
+// Returns true if the timer interrupt must be requested.
+func (t *timer) step() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.reloaded = false
+	interrupt := false
+	if t.reloading > 0 {
+		t.reloading--
+		if t.reloading == 0 {
+			t.tima = t.tma
+			t.reloaded = true
+			interrupt = true
+		}
+	}
+
+	t.divider += STEP_CYCLES
+	t.checkFallingEdge()
+	return interrupt
 }
 
 func (t *timer) Run(wg *sync.WaitGroup) {
 	t.log.Println("Timer started.")
 	for {
-		t.clock.WaitNextCycle()
-
-		if *t.tac == 0xff {
-			t.log.Println("tac=0xff, stopping timer.")
-			t.clock.Disconnect(t)
+		if !t.clock.WaitNextCycle() {
 			break
 		}
 
-		t.clock.Cycles += CYCLES_4096
-		*t.div += 1
-		if *t.div == 0x00 {
-			t.log.Println("tic, div=0x00.")
+		// The interrupt is requested without holding the lock, as it accesses the memory
+		if t.step() {
+			t.irqHandler.RequestInterrupt(TIMER_IRQ)
 		}
+		t.clock.Cycles += STEP_CYCLES
 	}
 	wg.Done()
 }
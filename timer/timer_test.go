@@ -0,0 +1,216 @@
+package timer
+
+import (
+	"github.com/lbarrios/yesSGMB/logger"
+	"github.com/lbarrios/yesSGMB/types"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func newTestLogger() *logger.Logger {
+	l := new(logger.Logger)
+	l.Init()
+	l.Log = log.New(ioutil.Discard, "", 0)
+	return l
+}
+
+// Returns a timer at its power up state, with the internal divider at 0
+func newTestTimer(tac byte) *timer {
+	t := NewTimer(nil, newTestLogger())
+	t.Reset(true)
+	t.WriteRegister(TAC_ADDRESS.AsAddress(), tac)
+	return t
+}
+
+func (t *timer) read(address types.Word) byte {
+	return t.ReadRegister(address.AsAddress())
+}
+
+func (t *timer) write(address types.Word, value byte) {
+	t.WriteRegister(address.AsAddress(), value)
+}
+
+// Steps the timer until TIMA overflows, and returns the number of interrupts requested meanwhile
+func (t *timer) stepUntilOverflow(test *testing.T) int {
+	interrupts := 0
+	for i := 0; t.reloading == 0; i++ {
+		if i > 0x10000 {
+			test.Fatal("TIMA never overflowed")
+		}
+		if t.step() {
+			interrupts++
+		}
+	}
+	return interrupts
+}
+
+func TestTimaFrequency(t *testing.T) {
+	tests := []struct {
+		tac    byte
+		cycles int // clock cycles between TIMA increments
+	}{
+		{0x04, CYCLES_4096},
+		{0x05, CYCLES_262144},
+		{0x06, CYCLES_65536},
+		{0x07, CYCLES_16384},
+	}
+	for _, test := range tests {
+		timer := newTestTimer(test.tac)
+		for i := 0; i < 3*test.cycles/STEP_CYCLES; i++ {
+			timer.step()
+		}
+		if got := timer.read(TIMA_ADDRESS); got != 3 {
+			t.Errorf("TAC %.2X: TIMA is %d after %d cycles, expected 3", test.tac, got, 3*test.cycles)
+		}
+	}
+}
+
+func TestTimaFallingEdgeOnRegisterWrites(t *testing.T) {
+	tests := []struct {
+		name      string
+		tac       byte
+		divider   types.Word
+		register  types.Word
+		value     byte
+		increment bool
+	}{
+		{"DIV reset with the bit set", 0x05, 0x0008, DIV_ADDRESS, 0x00, true},
+		{"DIV reset with the bit clear", 0x05, 0x0010, DIV_ADDRESS, 0x00, false},
+		{"DIV reset with another bit set", 0x04, 0x0100, DIV_ADDRESS, 0x00, false},
+		{"DIV reset with the 4096Hz bit set", 0x04, 0x0200, DIV_ADDRESS, 0x12, true},
+		{"DIV reset with the timer disabled", 0x01, 0x0008, DIV_ADDRESS, 0x00, false},
+		{"disabling the timer with the bit set", 0x05, 0x0008, TAC_ADDRESS, 0x01, true},
+		{"disabling the timer with the bit clear", 0x05, 0x0010, TAC_ADDRESS, 0x01, false},
+		{"selecting a clear bit", 0x05, 0x0008, TAC_ADDRESS, 0x06, true},
+		{"selecting another set bit", 0x05, 0x0028, TAC_ADDRESS, 0x06, false},
+		{"enabling the timer", 0x01, 0x0008, TAC_ADDRESS, 0x05, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timer := newTestTimer(test.tac)
+			timer.divider = test.divider
+			timer.lastSignal = timer.signal()
+			timer.write(test.register, test.value)
+			expected := byte(0)
+			if test.increment {
+				expected = 1
+			}
+			if got := timer.read(TIMA_ADDRESS); got != expected {
+				t.Errorf("TIMA is %d, expected %d", got, expected)
+			}
+		})
+	}
+}
+
+func TestDivResetsTheWholeDivider(t *testing.T) {
+	timer := newTestTimer(0x00)
+	for i := 0; i < 100; i++ {
+		timer.step()
+	}
+	timer.write(DIV_ADDRESS, 0xFF)
+	if timer.divider != 0 {
+		t.Errorf("the internal divider is %.4X after writing DIV, expected 0", timer.divider)
+	}
+	for i := 0; i < 1<<DIV_SHIFT/STEP_CYCLES; i++ {
+		timer.step()
+	}
+	if got := timer.read(DIV_ADDRESS); got != 1 {
+		t.Errorf("DIV is %d after 256 cycles, expected 1", got)
+	}
+}
+
+func TestTimaOverflowDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		trigger func(timer *timer, test *testing.T)
+	}{
+		{"overflow while counting", func(timer *timer, test *testing.T) {
+			if interrupts := timer.stepUntilOverflow(test); interrupts != 0 {
+				test.Errorf("%d interrupts requested before the overflow", interrupts)
+			}
+		}},
+		{"overflow when writing DIV", func(timer *timer, test *testing.T) {
+			timer.divider = 0x0008
+			timer.lastSignal = timer.signal()
+			timer.write(DIV_ADDRESS, 0x00)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timer := newTestTimer(0x05)
+			timer.write(TMA_ADDRESS, 0x42)
+			timer.write(TIMA_ADDRESS, 0xFF)
+			test.trigger(timer, t)
+
+			// TIMA stays at 0x00 for one machine cycle
+			if got := timer.read(TIMA_ADDRESS); got != 0x00 {
+				t.Fatalf("TIMA is %.2X right after the overflow, expected 00", got)
+			}
+			// and then it is reloaded and the interrupt is requested
+			if !timer.step() {
+				t.Errorf("the interrupt was not requested in the reload cycle")
+			}
+			if got := timer.read(TIMA_ADDRESS); got != 0x42 {
+				t.Errorf("TIMA is %.2X after the reload, expected 42", got)
+			}
+			if timer.step() {
+				t.Errorf("the interrupt was requested again after the reload")
+			}
+		})
+	}
+}
+
+func TestRegisterWritesAroundTheReload(t *testing.T) {
+	tests := []struct {
+		name        string
+		beforeWrite bool // the write happens in the cycle between the overflow and the reload
+		register    types.Word
+		value       byte
+		interrupt   bool
+		tima        byte // TIMA after the reload cycle
+		tma         byte
+	}{
+		// Writing TIMA before the reload cancels it, and the interrupt is not requested
+		{"TIMA before the reload", true, TIMA_ADDRESS, 0x10, false, 0x10, 0x42},
+		// The reload uses the new value of TMA
+		{"TMA before the reload", true, TMA_ADDRESS, 0x20, true, 0x20, 0x20},
+		// Writing TIMA in the reload cycle is ignored
+		{"TIMA in the reload cycle", false, TIMA_ADDRESS, 0x10, true, 0x42, 0x42},
+		// Writing TMA in the reload cycle also loads the value in TIMA
+		{"TMA in the reload cycle", false, TMA_ADDRESS, 0x20, true, 0x20, 0x20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timer := newTestTimer(0x05)
+			timer.write(TMA_ADDRESS, 0x42)
+			timer.write(TIMA_ADDRESS, 0xFF)
+			timer.stepUntilOverflow(t)
+
+			if test.beforeWrite {
+				timer.write(test.register, test.value)
+			}
+			interrupt := timer.step()
+			if !test.beforeWrite {
+				timer.write(test.register, test.value)
+			}
+
+			if interrupt != test.interrupt {
+				t.Errorf("interrupt requested = %t, expected %t", interrupt, test.interrupt)
+			}
+			if got := timer.read(TIMA_ADDRESS); got != test.tima {
+				t.Errorf("TIMA is %.2X, expected %.2X", got, test.tima)
+			}
+			if got := timer.read(TMA_ADDRESS); got != test.tma {
+				t.Errorf("TMA is %.2X, expected %.2X", got, test.tma)
+			}
+
+			// After the reload cycle, TIMA can be written again
+			timer.step()
+			timer.write(TIMA_ADDRESS, 0x33)
+			if got := timer.read(TIMA_ADDRESS); got != 0x33 {
+				t.Errorf("TIMA is %.2X after writing it past the reload cycle, expected 33", got)
+			}
+		})
+	}
+}